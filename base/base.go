@@ -5,15 +5,24 @@ package base
 import (
 	"encoding/json"
 	"errors"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/debugger"
 	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/performance"
+	"github.com/chromedp/cdproto/profiler"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"path"
 	"sync"
 	"time"
 )
 
+// Each run of MIDA keeps its temporary files in a directory of its own within DefaultTempDir, so that several
+// instances of MIDA can share a working directory without touching each other's files (or browsers)
+var RunTempDir = path.Join(DefaultTempDir, uuid.New().String()[:8])
+
 // Settings describing the way in which a browser will be opened
 type BrowserSettings struct {
 	BrowserBinary      *string   `json:"browser_binary"`       // The binary for the browser (e.g., "/path/to/chrome.exe")
@@ -22,32 +31,123 @@ type BrowserSettings struct {
 	RemoveBrowserFlags *[]string `json:"remove_browser_flags"` // Flags to be removed from default browser flags
 	SetBrowserFlags    *[]string `json:"set_browser_flags"`    // Flags to use to override default browser flags
 	Extensions         *[]string `json:"extensions"`           // Paths to browser extensions to be used for the crawl
+
+	Profile        *ProfileSettings `json:"profile_settings,omitempty"` // Settings for building the user data directory from a profile
+	RemoteEndpoint *string          `json:"remote_endpoint,omitempty"`  // DevTools endpoint (ws:// or http://) of an already-running browser to use
+
+	Driver     *BrowserDriver `json:"driver,omitempty"`      // The driver used to visit the site
+	ReplayFile *string        `json:"replay_file,omitempty"` // File of recorded DevTools events, replayed by the stub driver
+
+	DisplayMode *DisplayMode `json:"display_mode,omitempty"` // How the browser is displayed (chosen automatically if not set)
+}
+
+// Ways in which the browser can be displayed
+type DisplayMode string
+
+const (
+	Headless       DisplayMode = "headless"        // Chrome's new headless mode
+	HeadlessLegacy DisplayMode = "headless-legacy" // Chrome's original headless mode
+	Headful        DisplayMode = "headful"         // A normal browser window, on the existing display (DISPLAY)
+	Xvfb           DisplayMode = "xvfb"            // A normal browser window, on a virtual display MIDA runs for each crawler
+)
+
+var DisplayModes = [...]DisplayMode{Headless, HeadlessLegacy, Headful, Xvfb}
+
+// Drivers which can carry out a site visit
+type BrowserDriver string
+
+const (
+	Chromium BrowserDriver = "chromium" // Visit the site with Chromium (or Chrome) over the DevTools protocol
+	Stub     BrowserDriver = "stub"     // Replay recorded DevTools events from a file, without a browser
+)
+
+var BrowserDrivers = [...]BrowserDriver{Chromium, Stub}
+
+// Settings for starting the browser from a named profile: a saved user data directory which is copied
+// for each visit, so that visits can share (and build up) history, cookies and storage reproducibly
+type ProfileSettings struct {
+	Name      *string `json:"name"`      // Name of the profile template to copy for the visit
+	Directory *string `json:"directory"` // Directory in which profile templates are kept
+	Persist   *bool   `json:"persist"`   // Save the profile back to the template after the visit
+	Archive   *bool   `json:"archive"`   // Store an archive of the profile (as it was after the visit) with the results
 }
 
 // Conditions under which a crawl will complete successfully
 type CompletionCondition string
 
 const (
-	TimeoutOnly   CompletionCondition = "TimeoutOnly"   // Complete only when the timeout is reached
-	TimeAfterLoad CompletionCondition = "TimeAfterLoad" // Wait a given number of seconds after the load event
-	LoadEvent     CompletionCondition = "LoadEvent"     // Terminate crawl immediately when load event fires
+	TimeoutOnly     CompletionCondition = "TimeoutOnly"     // Complete only when the timeout is reached
+	TimeAfterLoad   CompletionCondition = "TimeAfterLoad"   // Wait a given number of seconds after the load event
+	LoadEvent       CompletionCondition = "LoadEvent"       // Terminate crawl immediately when load event fires
+	NetworkIdle     CompletionCondition = "NetworkIdle"     // Wait for the network to go idle after the load event
+	SelectorPresent CompletionCondition = "SelectorPresent" // Wait for an element matching a CSS selector to appear
+	JSPredicate     CompletionCondition = "JSPredicate"     // Wait for a JavaScript expression to evaluate truthy
 )
 
-var CompletionConditions = [...]CompletionCondition{TimeoutOnly, TimeAfterLoad, LoadEvent}
+var CompletionConditions = [...]CompletionCondition{TimeoutOnly, TimeAfterLoad, LoadEvent, NetworkIdle,
+	SelectorPresent, JSPredicate}
+
+// The reason a site visit ended
+type CompletionReason string
+
+const (
+	CompletionConditionMet  CompletionReason = "condition_met"  // The task's completion condition was met
+	CompletionTimeout       CompletionReason = "timeout"        // The general timeout was reached
+	CompletionBrowserClosed CompletionReason = "browser_closed" // The browser crashed or closed unexpectedly
+	CompletionFailed        CompletionReason = "failed"         // We never successfully navigated to the site
+)
 
 // Settings describing how a particular crawl will terminate
 type CompletionSettings struct {
 	CompletionCondition *CompletionCondition `json:"completion_condition"`      // Condition under which crawl will complete
 	Timeout             *int                 `json:"timeout,omitempty"`         // Maximum amount of time the browser will remain open
 	TimeAfterLoad       *int                 `json:"time_after_load,omitempty"` // Maximum amount of time the browser will remain open after page load
+
+	NetworkIdleConnections *int `json:"network_idle_connections,omitempty"` // Maximum requests in flight for the network to be considered idle
+	NetworkIdleTime        *int `json:"network_idle_time,omitempty"`        // Milliseconds the network must remain idle (in NetworkIdle mode)
+
+	Selector     *string `json:"selector,omitempty"`      // CSS selector to wait for (in SelectorPresent mode)
+	Expression   *string `json:"expression,omitempty"`    // JavaScript expression to wait for (in JSPredicate mode)
+	PollInterval *int    `json:"poll_interval,omitempty"` // Milliseconds between checks of the selector or expression
+	GracePeriod  *int    `json:"grace_period,omitempty"`  // Seconds to remain on the page after the selector or expression is satisfied
 }
 
 // Settings describing which data MIDA will capture from the crawl
 type DataSettings struct {
 	AllResources     *bool `json:"all_resources"`     // Save all resource files
 	ResourceMetadata *bool `json:"resource_metadata"` // Save extensive metadata about each resource
+	HAR              *bool `json:"har"`               // Save a HAR 1.2 archive of the site visit
+	HARBodies        *bool `json:"har_bodies"`        // Embed saved resource bodies in the HAR archive
+	ContentAddressed *bool `json:"content_addressed"` // Store resource bodies by SHA-256 hash, in a store shared by all tasks
+	Coverage         *bool `json:"coverage"`          // Gather JavaScript and CSS code coverage for the visit
+
+	PerformanceMetrics *bool     `json:"performance_metrics"` // Gather browser performance metrics at load and at completion
+	Trace              *bool     `json:"trace"`               // Record a full Chrome trace of the visit
+	TraceCategories    *[]string `json:"trace_categories"`    // Categories to include in the Chrome trace
+
+	// Filters deciding which resource bodies are saved (when AllResources is set). Types are resource types
+	// (e.g., "Script") or MIME types, which may end in a wildcard (e.g., "image/*").
+	BodyAllowTypes *[]string  `json:"body_allow_types,omitempty"` // Only save bodies of these types (all types if empty)
+	BodyDenyTypes  *[]string  `json:"body_deny_types,omitempty"`  // Never save bodies of these types
+	BodyMaxSize    *int       `json:"body_max_size,omitempty"`    // Skip bodies larger than this many bytes once decoded (0 for no limit)
+	BodyParty      *BodyParty `json:"body_party,omitempty"`       // Whether to save bodies from first parties, third parties or both
+	BodyURLInclude *[]string  `json:"body_url_include,omitempty"` // Only save bodies whose URLs match one of these regexes
+	BodyURLExclude *[]string  `json:"body_url_exclude,omitempty"` // Never save bodies whose URLs match one of these regexes
+
+	StreamBodyThreshold *int `json:"stream_body_threshold,omitempty"` // Stream bodies larger than this many bytes, or of unknown size, to disk (0 to never stream)
 }
 
+// Which parties' resource bodies to save, where first-party resources share the site (eTLD+1) of the task URL
+type BodyParty string
+
+const (
+	AllParties BodyParty = "all"   // Save bodies regardless of where they came from
+	FirstParty BodyParty = "first" // Only save bodies from the site of the task URL
+	ThirdParty BodyParty = "third" // Only save bodies from other sites
+)
+
+var BodyParties = [...]BodyParty{AllParties, FirstParty, ThirdParty}
+
 // Settings describing output of results to the local filesystem
 type LocalOutputSettings struct {
 	Enable *bool         `json:"enable"`                  // Whether this storage method is enabled
@@ -72,14 +172,79 @@ type OutputSettings struct {
 	SftpOut  *SftpOutputSettings  `json:"sftp_output_settings"`  // Output settings for the remote filesystem
 }
 
+// Settings describing whether and how MIDA will retry a failed site visit
+type RetrySettings struct {
+	MaxAttempts       *int            `json:"max_attempts"`       // Maximum number of times the site will be visited (1 never retries)
+	Backoff           *int            `json:"backoff"`            // Time (in seconds) to wait before the first retry
+	BackoffMultiplier *float64        `json:"backoff_multiplier"` // Factor by which the wait grows with each further retry
+	RetryableClasses  *[]FailureClass `json:"retryable_classes"`  // Classes of failure which will be retried
+}
+
+// Settings for the analyses MIDA runs over the results of a site visit during postprocessing. Postprocessors
+// are selected by name alone; the rest of the settings are the data some of them need.
+type PostprocessSettings struct {
+	Postprocessors *[]string                   `json:"postprocessors,omitempty"` // Names of the postprocessors to run, in order
+	Options        *map[string]json.RawMessage `json:"options,omitempty"`        // Options for individual postprocessors, keyed by name
+
+	EntityList  *string   `json:"entity_list,omitempty"`  // Disconnect-style entities file mapping domains to the organizations owning them
+	FilterLists *[]string `json:"filter_lists,omitempty"` // Adblock Plus style filter lists (e.g., EasyList) to match requests against
+	LibraryDB   *string   `json:"library_db,omitempty"`   // Database of known JavaScript library versions to identify scripts with
+}
+
+// Classes of failure for a site visit
+type FailureClass string
+
+const (
+	FailureDNS               FailureClass = "dns"                // The host name could not be resolved
+	FailureConnection        FailureClass = "connection_refused" // The connection was refused, reset or otherwise failed
+	FailureTLS               FailureClass = "tls"                // TLS handshake or certificate error
+	FailureHTTPError         FailureClass = "http_error"         // The main document was an HTTP error (4xx or 5xx)
+	FailureNavigationTimeout FailureClass = "navigation_timeout" // We timed out before connecting to the site
+	FailureBrowserCrash      FailureClass = "browser_crash"      // The browser crashed or closed before the visit completed
+	FailureDevToolsSetup     FailureClass = "devtools_setup"     // We could not set up the browser through DevTools
+	FailureOther             FailureClass = "other"              // Any other failure
+)
+
+var FailureClasses = [...]FailureClass{FailureDNS, FailureConnection, FailureTLS, FailureHTTPError,
+	FailureNavigationTimeout, FailureBrowserCrash, FailureDevToolsSetup, FailureOther}
+
+// A record of a single attempt at visiting a site
+type Attempt struct {
+	Number       int          `json:"number"`                  // Attempt number, starting at 1
+	Start        time.Time    `json:"start"`                   // Time at which the attempt started
+	End          time.Time    `json:"end"`                     // Time at which the attempt ended
+	FailureCode  string       `json:"failure_code,omitempty"`  // Failure code for the attempt, or "" if it succeeded
+	FailureClass FailureClass `json:"failure_class,omitempty"` // Class of the attempt's failure
+}
+
+// Settings describing whether and how MIDA will crawl links found on a visited page
+type CrawlSettings struct {
+	MaxDepth     *int      `json:"max_depth"`     // Maximum link depth to crawl (0 visits only the given URL)
+	SameSite     *bool     `json:"same_site"`     // Only follow links with the same eTLD+1 as the page they are found on
+	IncludeRegex *[]string `json:"include_regex"` // Only follow links matching at least one of these regexes (if any are given)
+	ExcludeRegex *[]string `json:"exclude_regex"` // Never follow links matching any of these regexes
+	MaxLinks     *int      `json:"max_links"`     // Maximum number of links to follow from a single page
+}
+
 // A raw MIDA task. This is the struct that is read from/written to file when tasks are stored as JSON.
 type RawTask struct {
 	URL *string `json:"url"` // The URL to be visited
 
-	Browser    *BrowserSettings    `json:"browser_settings"`    // Settings for launching the browser
-	Completion *CompletionSettings `json:"completion_settings"` // Settings for when the site visit will complete
-	Data       *DataSettings       `json:"data_settings"`       // Settings for what data will be collected from the site
-	Output     *OutputSettings     `json:"output_settings"`     // Settings for what/how results will be saved
+	Browser    *BrowserSettings    `json:"browser_settings"`         // Settings for launching the browser
+	Completion *CompletionSettings `json:"completion_settings"`      // Settings for when the site visit will complete
+	Data       *DataSettings       `json:"data_settings"`            // Settings for what data will be collected from the site
+	Output     *OutputSettings     `json:"output_settings"`          // Settings for what/how results will be saved
+	Crawl      *CrawlSettings      `json:"crawl_settings,omitempty"` // Settings for crawling links found on the page
+	Retry      *RetrySettings      `json:"retry_settings,omitempty"` // Settings for retrying failed site visits
+
+	Postprocess *PostprocessSettings `json:"postprocess_settings,omitempty"` // Settings for analyses run after the site visit
+
+	Session *[]SessionStep `json:"session,omitempty"` // Further pages to visit, in order, in the same browser after URL
+
+	// Set for tasks generated by crawling links from another task
+	ParentUUID *string `json:"parent_uuid,omitempty"` // UUID of the task on whose page this task's URL was found
+	RootUUID   *string `json:"root_uuid,omitempty"`   // UUID of the original task from which crawling started
+	Depth      *int    `json:"depth,omitempty"`       // Number of links followed from the original task
 }
 
 // Internal type built from the process of sanitizing a RawTask. Should contain all the parameters needed for a crawl
@@ -91,10 +256,48 @@ type SanitizedTask struct {
 	BrowserBinaryPath string   // Full path to the browser binary we use for the crawl
 	BrowserFlags      []string // List of flags we will use when opening the browser (does not include --remote-debugging-port or similar)
 	UserDataDirectory string   // Full path to the user data directory for the task
+	ProfilePath       string   // Full path to the profile template copied into the user data directory, or "" if none
+	PersistProfile    bool     // Whether to save the user data directory back to the profile template after the visit
+	ArchiveProfile    bool     // Whether to store an archive of the user data directory with the results
+	RemoteEndpoint    string   // DevTools endpoint of an already-running browser to connect to, or "" to launch our own
+
+	Driver      BrowserDriver // The driver used to visit the site
+	ReplayFile  string        // Full path to the file of recorded events replayed by the stub driver
+	DisplayMode DisplayMode   // How the browser is displayed
 
-	CS  CompletionSettings // Task completion settings for the task
-	DS  DataSettings       // Data Gathering Settings for the task
-	OPS OutputSettings     // Output settings for the task
+	CS     CompletionSettings  // Task completion settings for the task
+	DS     DataSettings        // Data Gathering Settings for the task
+	OPS    OutputSettings      // Output settings for the task
+	CrawlS CrawlSettings       // Crawl settings for the task
+	RetryS RetrySettings       // Retry settings for the task
+	PPS    PostprocessSettings // Postprocessing settings for the task
+
+	ParentUUID string // UUID of the parent task, or "" if this task was not generated by crawling
+	RootUUID   string // UUID of the original task from which crawling started (the task's own UUID if not crawled)
+	Depth      int    // Number of links followed to reach this task's URL
+
+	Session []SanitizedSessionStep // Session steps visited after URL, in order
+}
+
+// A single step of a session task. Steps are visited in order in the same browser (and so with the same
+// cookies, cache and storage) once the task's main URL has been visited.
+type SessionStep struct {
+	URL        *string             `json:"url"`                 // The URL to navigate to for this step
+	Completion *CompletionSettings `json:"completion_settings"` // Settings for when this step will complete (defaults to the task's)
+}
+
+// A recording of the DevTools events from a site visit, which the stub driver replays in place of a browser.
+// Events are in the same form as DevTools protocol messages (e.g., {"method": "Network.responseReceived", "params": {...}}).
+type StubRecording struct {
+	Events      []json.RawMessage `json:"events"`                 // Events, in the order they will be replayed
+	Links       []string          `json:"links,omitempty"`        // Links to report as extracted from the page
+	FailureCode string            `json:"failure_code,omitempty"` // If set, replay a visit which failed to navigate with this error
+}
+
+// A session step built from sanitizing a SessionStep
+type SanitizedSessionStep struct {
+	URL string
+	CS  CompletionSettings
 }
 
 // A slice of MIDA tasks, ready to be enqueued
@@ -104,10 +307,16 @@ type TaskSet []RawTask
 type CompressedTaskSet struct {
 	URL *[]string `json:"url"` // List of URLs to be visited
 
-	Browser    *BrowserSettings    `json:"browser_settings"`    // Settings for launching the browser
-	Completion *CompletionSettings `json:"completion_settings"` // Settings for when the site visit will complete
-	Data       *DataSettings       `json:"data_settings"`       // Settings for what data will be collected from the site
-	Output     *OutputSettings     `json:"output_settings"`     // Settings for what/how results will be saved
+	Browser    *BrowserSettings    `json:"browser_settings"`         // Settings for launching the browser
+	Completion *CompletionSettings `json:"completion_settings"`      // Settings for when the site visit will complete
+	Data       *DataSettings       `json:"data_settings"`            // Settings for what data will be collected from the site
+	Output     *OutputSettings     `json:"output_settings"`          // Settings for what/how results will be saved
+	Crawl      *CrawlSettings      `json:"crawl_settings,omitempty"` // Settings for crawling links found on the page
+	Retry      *RetrySettings      `json:"retry_settings,omitempty"` // Settings for retrying failed site visits
+
+	Postprocess *PostprocessSettings `json:"postprocess_settings,omitempty"` // Settings for analyses run after the site visit
+
+	Session *[]SessionStep `json:"session,omitempty"` // Further pages to visit after each URL, in the same browser
 
 	Repeat *int `json:"repeat"` // Number of times to repeat the crawl after it finishes successfully
 }
@@ -120,11 +329,15 @@ type TaskWrapper struct {
 
 	UUID    uuid.UUID
 	TempDir string // Temporary directory where results are stored. Can be the same as the UserDataDir in some cases.
+	Step    int    // Index of the session step this wrapper is for (0 for the task's main URL)
 
 	// Dynamic fields
-	Log         *logrus.Logger
-	LogFile     *os.File
-	FailureCode string // Holds the failure code for the task, or "" if the task has not failed
+	Log          *logrus.Logger `json:"-"`
+	LogFile      *os.File       `json:"-"`
+	FailureCode  string         // Holds the failure code for the task, or "" if the task has not failed
+	FailureClass FailureClass   // The class of failure described by FailureCode
+	Attempts     []Attempt      `json:"-"` // Attempts made at visiting the site so far (stored in TaskSummary)
+	Display      string         // X display (e.g., ":99") the browser should use, or "" to use the display MIDA inherited
 }
 
 // Timing data for the processing of a particular task
@@ -147,7 +360,27 @@ type TaskSummary struct {
 	TaskWrapper *TaskWrapper `json:"task_wrapper"` // Wrapper containing the full task
 	TaskTiming  TaskTiming   `json:"task_timing"`  // Timing data for the task
 
+	CompletionReason CompletionReason `json:"completion_reason"`  // Why the site visit ended
+	Attempts         []Attempt        `json:"attempts,omitempty"` // Every attempt made at the site visit, including retries
+
+	ParentUUID string   `json:"parent_uuid,omitempty"` // UUID of the task on whose page this task's URL was found
+	Depth      int      `json:"depth"`                 // Number of links followed to reach this task's URL
+	ChildURLs  []string `json:"child_urls,omitempty"`  // URLs of the child tasks generated from links on this page
+
 	NumResources int `json:"num_resources,omitempty"` // Number of resources the browser loaded
+
+	FirstPartyRequests      int            `json:"first_party_requests,omitempty"`      // Requests made to the site of the page
+	ThirdPartyRequests      int            `json:"third_party_requests,omitempty"`      // Requests made to other sites
+	ThirdPartyOrganizations map[string]int `json:"third_party_organizations,omitempty"` // Third-party requests per owning organization
+
+	TrackerRequests   int            `json:"tracker_requests,omitempty"`    // Requests which the task's filter lists would block
+	FilterListMatches map[string]int `json:"filter_list_matches,omitempty"` // Blocked requests per filter list
+
+	MixedContentBlocked  int `json:"mixed_content_blocked,omitempty"`  // Insecure requests from secure documents which the browser blocked
+	MixedContentUpgraded int `json:"mixed_content_upgraded,omitempty"` // Insecure requests which were upgraded to secure connections
+	MixedContentLoaded   int `json:"mixed_content_loaded,omitempty"`   // Insecure requests which the browser let through
+
+	Libraries []string `json:"libraries,omitempty"` // Known JavaScript libraries identified on the page ("name@version", or just the name)
 }
 
 // Information about the infrastructure used to perform the crawl
@@ -163,10 +396,30 @@ type CrawlerInfo struct {
 type DevtoolsNetworkRawData struct {
 	RequestWillBeSent map[string][]network.EventRequestWillBeSent
 	ResponseReceived  map[string]network.EventResponseReceived
+	LoadingFinished   map[string]network.EventLoadingFinished
+	LoadingFailed     map[string]network.EventLoadingFailed
+}
+
+type DevToolsDebuggerRawData struct {
+	ScriptParsed map[string]debugger.EventScriptParsed // Keyed by script ID
+}
+
+type DevToolsCoverageRawData struct {
+	ScriptCoverage []*profiler.ScriptCoverage
+	RuleUsage      []*css.RuleUsage
+	StyleSheets    map[string]css.StyleSheetHeader // Keyed by style sheet ID
+}
+
+type DevToolsPerformanceRawData struct {
+	LoadMetrics  []*performance.Metric // Metrics gathered when the load event fired
+	FinalMetrics []*performance.Metric // Metrics gathered when the site visit completed
 }
 
 type DevToolsRawData struct {
-	Network DevtoolsNetworkRawData
+	Network     DevtoolsNetworkRawData
+	Debugger    DevToolsDebuggerRawData
+	Coverage    DevToolsCoverageRawData
+	Performance DevToolsPerformanceRawData
 }
 
 // The results MIDA gathers before they are post-processed
@@ -174,17 +427,171 @@ type RawResult struct {
 	CrawlerInfo CrawlerInfo     // Information about the infrastructure used to visit the site
 	TaskSummary TaskSummary     // Summary information about the task, not necessarily complete in RawResult
 	DevTools    DevToolsRawData // Struct Containing Raw Data gathered from a DevTools site visit
+	Links       []string        // Links extracted from the page when crawling
+	Steps       []*RawResult    // Raw results for each session step visited after the main URL, in order
 	sync.Mutex
 }
 
 type DTResource struct {
-	Requests []network.EventRequestWillBeSent `json:"requests"`  // All requests sent for this particular request
-	Response network.EventResponseReceived    `json:"responses"` // All responses received for this particular request
+	Requests []network.EventRequestWillBeSent `json:"requests"`            // All requests sent for this particular request
+	Response network.EventResponseReceived    `json:"responses"`           // All responses received for this particular request
+	BodyHash string                           `json:"body_hash,omitempty"` // SHA-256 hash (hex) of the response body, if it was saved
+
+	FilterMatch *FilterMatch `json:"filter_match,omitempty"` // Filter list rule deciding whether the request would be blocked
+}
+
+// A filter list rule which matched a request
+type FilterMatch struct {
+	List      string `json:"list"`      // File name of the filter list containing the rule
+	Rule      string `json:"rule"`      // The rule, as written in the list
+	URL       string `json:"url"`       // URL the rule matched (which may be one the request was redirected from)
+	Exception bool   `json:"exception"` // True if the rule is an exception, allowing a request which another rule would block
 }
 
 type FinalResult struct {
-	Summary            TaskSummary           `json:"stats"`             // Statistics on timing and resource usage for the crawl
-	DTResourceMetadata map[string]DTResource `json:"resource_metadata"` // Metadata on each resource loaded
+	Summary            TaskSummary           `json:"stats"`              // Statistics on timing and resource usage for the crawl
+	DTResourceMetadata map[string]DTResource `json:"resource_metadata"`  // Metadata on each resource loaded
+	HAR                *HAR                  `json:"har,omitempty"`      // HAR 1.2 archive of the site visit
+	Coverage           *Coverage             `json:"coverage,omitempty"` // JavaScript and CSS code coverage
+	PerformanceMetrics *PerformanceMetrics   `json:"performance_metrics,omitempty"`
+
+	ChildTasks []*RawTask        `json:"-"` // Tasks generated from links on the page, to be fed back into the pipeline
+	Steps      []*FinalResult    `json:"-"` // Final results for each session step, stored in their own subdirectories
+	BodyHashes map[string]string `json:"-"` // SHA-256 hashes (hex) of the saved resource bodies, keyed by request ID
+
+	// Results added by postprocessors, which storage writes into the results directory
+	Sections map[string]interface{} `json:"-"` // Named sections, each written as JSON to <name>.json
+	Files    map[string][]byte      `json:"-"` // Extra files, written as they are, keyed by file name
+}
+
+// Classification of the resources loaded by a page into first and third parties, where third parties are
+// sites (eTLD+1) other than that of the page itself
+type ThirdPartyAnalysis struct {
+	Site          string                `json:"site"`                   // Site of the page
+	Organization  string                `json:"organization,omitempty"` // Organization owning the site of the page, if known
+	Resources     map[string]PartyLabel `json:"resources"`              // Label for each request, keyed by request ID
+	Sites         map[string]int        `json:"sites"`                  // Number of third-party requests to each site
+	Organizations map[string]int        `json:"organizations"`          // Number of third-party requests to each known organization
+}
+
+// The party which served a single resource
+type PartyLabel struct {
+	URL          string `json:"url"`
+	Site         string `json:"site"`                   // Site of the resource's host
+	ThirdParty   bool   `json:"third_party"`            // True if the resource came from a site other than that of the page
+	Organization string `json:"organization,omitempty"` // Organization owning the site, according to the entity list
+}
+
+// A known JavaScript library identified in a script loaded by a page
+type Library struct {
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`    // Empty if we recognized the library but not its version
+	URL       string `json:"url"`                  // URL of the script containing the library
+	RequestID string `json:"request_id,omitempty"` // Request which loaded the script, if any
+	ScriptID  string `json:"script_id,omitempty"`  // Set instead of RequestID for scripts we only saw parsed
+	Method    string `json:"method"`               // How the library was identified ("hash", "banner" or "url")
+}
+
+// Parsed security headers of the documents loaded by a page, and the flags of the cookies its responses set
+type SecurityHeaders struct {
+	Documents []DocumentSecurityHeaders `json:"documents"` // The page itself and any frames
+	Cookies   []CookieFlags             `json:"cookies"`
+}
+
+// Parsed security headers of a single document, with any weaknesses found in them
+type DocumentSecurityHeaders struct {
+	URL       string `json:"url"`
+	RequestID string `json:"request_id"`
+	MainFrame bool   `json:"main_frame"` // False for frames
+
+	CSP               *CSPolicy           `json:"csp,omitempty"`
+	CSPReportOnly     *CSPolicy           `json:"csp_report_only,omitempty"`
+	HSTS              *HSTSPolicy         `json:"hsts,omitempty"`
+	XFrameOptions     string              `json:"x_frame_options,omitempty"`
+	ReferrerPolicy    string              `json:"referrer_policy,omitempty"`    // The policy browsers will apply
+	PermissionsPolicy map[string][]string `json:"permissions_policy,omitempty"` // Allowlist of origins for each feature
+	COOP              string              `json:"cross_origin_opener_policy,omitempty"`
+	COEP              string              `json:"cross_origin_embedder_policy,omitempty"`
+
+	Findings []SecurityFinding `json:"findings"`
+}
+
+// A Content-Security-Policy header, parsed into a list of policies, each mapping directives to their source lists
+type CSPolicy struct {
+	Raw      string                `json:"raw"`
+	Policies []map[string][]string `json:"policies"`
+}
+
+// A parsed Strict-Transport-Security header
+type HSTSPolicy struct {
+	Raw               string `json:"raw"`
+	MaxAge            int64  `json:"max_age"` // In seconds
+	IncludeSubDomains bool   `json:"include_subdomains"`
+	Preload           bool   `json:"preload"`
+}
+
+// The flags of a cookie set by a response
+type CookieFlags struct {
+	Name       string `json:"name"`
+	RequestID  string `json:"request_id"`
+	URL        string `json:"url"` // URL of the response which set the cookie
+	Secure     bool   `json:"secure"`
+	HTTPOnly   bool   `json:"http_only"`
+	SameSite   string `json:"same_site,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Persistent bool   `json:"persistent"` // False for session cookies
+
+	Findings []SecurityFinding `json:"findings"`
+}
+
+// A weak configuration found in a security header
+type SecurityFinding struct {
+	Header   string `json:"header"`
+	Severity string `json:"severity"` // "high", "medium" or "low"
+	Issue    string `json:"issue"`
+}
+
+// A request for an insecure (HTTP or WS) resource made by a document loaded over HTTPS
+type MixedContentRequest struct {
+	RequestID        string `json:"request_id"`
+	URL              string `json:"url"` // The insecure URL requested
+	DocumentURL      string `json:"document_url"`
+	Type             string `json:"type"`               // Resource type
+	MixedContentType string `json:"mixed_content_type"` // "blockable" (active content) or "optionally-blockable" (passive)
+	Outcome          string `json:"outcome"`            // "blocked", "upgraded", "loaded" or "failed"
+}
+
+// Browser performance metrics (from Performance.getMetrics), keyed by metric name
+type PerformanceMetrics struct {
+	Load  map[string]float64 `json:"load"`  // Metrics when the load event fired (empty if it never fired)
+	Final map[string]float64 `json:"final"` // Metrics when the site visit completed
+}
+
+// Function and block coverage for a single script
+type ScriptCoverage struct {
+	ScriptID   string                       `json:"script_id"`
+	URL        string                       `json:"url"`
+	RequestID  string                       `json:"request_id,omitempty"` // Request ID of the resource the script was loaded from, if any
+	Functions  []*profiler.FunctionCoverage `json:"functions"`
+	TotalBytes int64                        `json:"total_bytes"`
+	UsedBytes  int64                        `json:"used_bytes"`
+	UsedRatio  float64                      `json:"used_ratio"`
+}
+
+// Rule usage for a single style sheet
+type StyleSheetCoverage struct {
+	StyleSheetID string  `json:"style_sheet_id"`
+	URL          string  `json:"url"`
+	RequestID    string  `json:"request_id,omitempty"` // Request ID of the resource the style sheet was loaded from, if any
+	TotalBytes   int64   `json:"total_bytes"`
+	UsedBytes    int64   `json:"used_bytes"`
+	UsedRatio    float64 `json:"used_ratio"`
+}
+
+type Coverage struct {
+	Scripts     []ScriptCoverage     `json:"scripts"`
+	StyleSheets []StyleSheetCoverage `json:"style_sheets"`
 }
 
 func AllocateNewCompressedTaskSet() *CompressedTaskSet {
@@ -194,6 +601,9 @@ func AllocateNewCompressedTaskSet() *CompressedTaskSet {
 	cts.Completion = AllocateNewCompletionSettings()
 	cts.Data = AllocateNewDataSettings()
 	cts.Output = AllocateNewOutputSettings()
+	cts.Crawl = AllocateNewCrawlSettings()
+	cts.Retry = AllocateNewRetrySettings()
+	cts.Postprocess = AllocateNewPostprocessSettings()
 	cts.Repeat = new(int)
 	return cts
 }
@@ -207,6 +617,9 @@ func AllocateNewTask() *RawTask {
 	task.Completion = AllocateNewCompletionSettings()
 	task.Data = AllocateNewDataSettings()
 	task.Output = AllocateNewOutputSettings()
+	task.Crawl = AllocateNewCrawlSettings()
+	task.Retry = AllocateNewRetrySettings()
+	task.Postprocess = AllocateNewPostprocessSettings()
 
 	return task
 }
@@ -220,16 +633,38 @@ func AllocateNewBrowserSettings() *BrowserSettings {
 	bs.SetBrowserFlags = new([]string)
 	bs.Extensions = new([]string)
 	bs.UserDataDirectory = new(string)
+	bs.Profile = AllocateNewProfileSettings()
+	bs.RemoteEndpoint = new(string)
+	bs.Driver = new(BrowserDriver)
+	bs.ReplayFile = new(string)
+	bs.DisplayMode = new(DisplayMode)
 
 	return bs
 }
 
+// AllocateNewProfileSettings allocates a new ProfileSettings struct, initializing everything to zero values
+func AllocateNewProfileSettings() *ProfileSettings {
+	var ps = new(ProfileSettings)
+	ps.Name = new(string)
+	ps.Directory = new(string)
+	ps.Persist = new(bool)
+	ps.Archive = new(bool)
+
+	return ps
+}
+
 // AllocateNewCompletionSettings allocates a new CompletionSettings struct, initializing everything to zero values
 func AllocateNewCompletionSettings() *CompletionSettings {
 	var cs = new(CompletionSettings)
 	cs.TimeAfterLoad = new(int)
 	cs.Timeout = new(int)
 	cs.CompletionCondition = new(CompletionCondition)
+	cs.NetworkIdleConnections = new(int)
+	cs.NetworkIdleTime = new(int)
+	cs.Selector = new(string)
+	cs.Expression = new(string)
+	cs.PollInterval = new(int)
+	cs.GracePeriod = new(int)
 
 	return cs
 }
@@ -239,10 +674,59 @@ func AllocateNewDataSettings() *DataSettings {
 	var ds = new(DataSettings)
 	ds.AllResources = new(bool)
 	ds.ResourceMetadata = new(bool)
+	ds.HAR = new(bool)
+	ds.HARBodies = new(bool)
+	ds.ContentAddressed = new(bool)
+	ds.Coverage = new(bool)
+	ds.PerformanceMetrics = new(bool)
+	ds.Trace = new(bool)
+	ds.TraceCategories = new([]string)
+	ds.BodyAllowTypes = new([]string)
+	ds.BodyDenyTypes = new([]string)
+	ds.BodyMaxSize = new(int)
+	ds.BodyParty = new(BodyParty)
+	ds.BodyURLInclude = new([]string)
+	ds.BodyURLExclude = new([]string)
+	ds.StreamBodyThreshold = new(int)
 
 	return ds
 }
 
+// AllocateNewCrawlSettings allocates a new CrawlSettings struct, initializing everything to zero values
+func AllocateNewCrawlSettings() *CrawlSettings {
+	var cs = new(CrawlSettings)
+	cs.MaxDepth = new(int)
+	cs.SameSite = new(bool)
+	cs.IncludeRegex = new([]string)
+	cs.ExcludeRegex = new([]string)
+	cs.MaxLinks = new(int)
+
+	return cs
+}
+
+// AllocateNewRetrySettings allocates a new RetrySettings struct, initializing everything to zero values
+func AllocateNewRetrySettings() *RetrySettings {
+	var rs = new(RetrySettings)
+	rs.MaxAttempts = new(int)
+	rs.Backoff = new(int)
+	rs.BackoffMultiplier = new(float64)
+	rs.RetryableClasses = new([]FailureClass)
+
+	return rs
+}
+
+// AllocateNewPostprocessSettings allocates a new PostprocessSettings struct, initializing everything to zero values
+func AllocateNewPostprocessSettings() *PostprocessSettings {
+	var pps = new(PostprocessSettings)
+	pps.Postprocessors = new([]string)
+	pps.Options = new(map[string]json.RawMessage)
+	pps.EntityList = new(string)
+	pps.FilterLists = new([]string)
+	pps.LibraryDB = new(string)
+
+	return pps
+}
+
 // AllocateNewOutputSettings allocates a new OutputSettings struct, initializing everything to zero values
 func AllocateNewOutputSettings() *OutputSettings {
 	var ops = new(OutputSettings)
@@ -338,11 +822,15 @@ func ExpandCompressedTaskSet(ts CompressedTaskSet) []RawTask {
 		for _, singleUrl := range *ts.URL {
 			var url = singleUrl
 			newTask := RawTask{
-				URL:        &url,
-				Browser:    ts.Browser,
-				Completion: ts.Completion,
-				Data:       ts.Data,
-				Output:     ts.Output,
+				URL:         &url,
+				Browser:     ts.Browser,
+				Completion:  ts.Completion,
+				Data:        ts.Data,
+				Output:      ts.Output,
+				Crawl:       ts.Crawl,
+				Retry:       ts.Retry,
+				Postprocess: ts.Postprocess,
+				Session:     ts.Session,
 			}
 			rawTasks = append(rawTasks, newTask)
 		}
@@ -3,22 +3,45 @@ package base
 const (
 	// Output Parameters
 	DefaultTempDir              = ".midatmp"
+	DefaultRunOwnerFile         = "owner" // Identifies the MIDA process a run's temporary directory belongs to
 	DefaultLocalOutputPath      = "results"
 	DefaultResourceSubdir       = "resources"
+	DefaultScriptSourceSubdir   = "scripts"        // Sources of inline and eval'd scripts, kept only for postprocessing
+	DefaultResourceStoreSubdir  = "resource_store" // Content-addressed store of resource bodies, directly within the results root
+	DefaultResourceStoreIndex   = "index.json"     // Reference counts for the bodies in a content-addressed store
+	DefaultResourceStoreLock    = "index.lock"     // Held while a process updates a content-addressed store
+	DefaultResourceHashesFile   = "resource_hashes.json"
+	DefaultSessionStepSubdir    = "step_%d" // Formatted with the index of the session step
 	DefaultCrawlMetadataFile    = "metadata.json"
 	DefaultResourceMetadataFile = "resource_metadata.json"
+	DefaultHARFile              = "visit.har"
+	DefaultCoverageFile         = "coverage.json"
+	DefaultPerformanceFile      = "performance_metrics.json"
+	DefaultTraceFile            = "trace.json.gz"
 	DefaultSftpPrivKeyFile      = "~/.ssh/id_rsa"
 	DefaultTaskLogFile          = "task.log"
+	DefaultProfileDirectory     = "profiles"
+	DefaultProfileArchiveFile   = "profile.tar.gz"
 
 	// MIDA Configuration Defaults
 
-	DefaultNavTimeout           = 30 // How long to wait when connecting to a web server
-	DefaultSSHBackoffMultiplier = 5  // Exponential increase in time between tries when connecting for SFTP storage
-	DefaultTaskPriority         = 5  // Queue priority when creating new tasks -- Value should be 1-10
+	DefaultNavTimeout               = 30 // How long to wait when connecting to a web server
+	DefaultRemoteBrowserTimeout     = 10 // How long to wait when looking up the DevTools endpoint of a remote browser
+	DefaultWatchdogGrace            = 60 // Time (in seconds) beyond the longest a visit could take before its browser is killed
+	DefaultSSHBackoffMultiplier     = 5  // Exponential increase in time between tries when connecting for SFTP storage
+	DefaultResourceStoreLockTimeout = 60 // Time (in seconds) after which a resource store lock is considered stale
+	DefaultTaskPriority             = 5  // Queue priority when creating new tasks -- Value should be 1-10
 
 	DefaultEventChannelBufferSize = 10000
+	DefaultTraceReadChunkSize     = 1 << 20 // Bytes to read at a time when streaming a trace from the browser
+	DefaultBodyReadChunkSize      = 1 << 20 // Bytes to read at a time when streaming a resource body from the browser
+	DefaultTraceCompleteTimeout   = 30      // How long to wait (in seconds) for the browser to finish a trace
+	DefaultLibraryScanLimit       = 4 << 20 // Bytes of each script to search for library version banners
 
 	// Browser-Related Parameters
+	DefaultBrowserDriver       = Chromium
+	DefaultXvfbScreen          = "1280x720x16" // Width, height and depth of virtual displays
+	DefaultXvfbStartTimeout    = 10            // How long to wait (in seconds) for a virtual display to start
 	DefaultOSXChromePath       = "/Applications/Google Chrome.app/Contents/MacOS/Google Chrome"
 	DefaultOSXChromiumPath     = "/Applications/Chromium.app/Contents/MacOS/Chromium"
 	DefaultLinuxChromePath     = "/usr/bin/google-chrome-stable"
@@ -31,9 +54,36 @@ const (
 	DefaultTimeout             = 10 // Default time (in seconds) to remain on a page before exiting browser
 	DefaultCompletionCondition = TimeoutOnly
 
+	DefaultNetworkIdleConnections  = 0   // Default maximum number of requests in flight for the network to be idle
+	DefaultNetworkIdleTime         = 500 // Default time (in milliseconds) the network must be idle (in NetworkIdle mode)
+	DefaultNetworkIdlePollInterval = 50  // How often (in milliseconds) we check whether the network has gone idle
+
+	DefaultPollInterval = 250 // Default time (in milliseconds) between checks of selector and JavaScript conditions
+	DefaultGracePeriod  = 0   // Default time (in seconds) to remain on a page after a selector or JavaScript condition is met
+
 	// Defaults for data gathering settings
-	DefaultAllResources     = true
-	DefaultResourceMetadata = true
+	DefaultAllResources       = true
+	DefaultResourceMetadata   = true
+	DefaultHAR                = false
+	DefaultHARBodies          = false
+	DefaultContentAddressed   = false
+	DefaultCoverage           = false
+	DefaultPerformanceMetrics = false
+	DefaultTrace              = false
+	DefaultBodyMaxSize        = 0 // By default, resource bodies of any size are saved
+	DefaultBodyParty          = AllParties
+
+	DefaultStreamBodyThreshold = 0 // By default, bodies are never streamed, but fetched from the browser once loaded
+
+	// Defaults for crawl settings
+	DefaultCrawlMaxDepth = 0    // By default, we only visit the URL we are given
+	DefaultCrawlSameSite = true // Whether to only follow links within the same site (eTLD+1)
+	DefaultCrawlMaxLinks = 10   // Maximum number of links to follow from a single page
+
+	// Defaults for retry settings
+	DefaultRetryMaxAttempts       = 1   // By default, failed site visits are not retried
+	DefaultRetryBackoff           = 5   // Time (in seconds) to wait before the first retry
+	DefaultRetryBackoffMultiplier = 2.0 // Factor by which the wait grows with each further retry
 
 	DefaultShuffle = true // Whether to shuffle order of task processing
 
@@ -66,4 +116,31 @@ var (
 		"--no-sandbox",
 		"--safebrowsing-disable-auto-update",
 	}
+
+	// Failure classes which are retried by default -- those most likely to be transient
+	DefaultRetryableClasses = []FailureClass{
+		FailureConnection,
+		FailureNavigationTimeout,
+		FailureBrowserCrash,
+		FailureDevToolsSetup,
+	}
+
+	// Chrome trace categories we record by default, roughly matching the DevTools performance panel
+	DefaultTraceCategories = []string{
+		"devtools.timeline",
+		"disabled-by-default-devtools.timeline",
+		"disabled-by-default-devtools.timeline.frame",
+		"toplevel",
+		"blink.console",
+		"blink.user_timing",
+		"latencyInfo",
+		"loading",
+		"v8.execute",
+		"disabled-by-default-v8.cpu_profiler",
+	}
+
+	// Postprocessors run by default, in order
+	DefaultPostprocessors = []string{
+		"third_parties",
+	}
 )
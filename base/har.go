@@ -0,0 +1,108 @@
+package base
+
+// Types describing a HAR 1.2 archive (http://www.softwareishard.com/blog/har-12-spec/).
+// Fields beginning with an underscore are custom fields, which the specification allows.
+
+// The root object of a HAR archive
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`           // Version of the HAR format (always "1.2")
+	Creator HARCreator  `json:"creator"`           // Application which created the archive
+	Browser *HARCreator `json:"browser,omitempty"` // Browser which visited the page
+	Pages   []HARPage   `json:"pages"`             // Pages visited (MIDA always visits exactly one)
+	Entries []HAREntry  `json:"entries"`           // All requests made by the browser
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HARPage struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
+}
+
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"` // Milliseconds from page start to DOMContentLoaded (-1 if unknown)
+	OnLoad        float64 `json:"onLoad"`        // Milliseconds from page start to the load event (-1 if unknown)
+}
+
+type HAREntry struct {
+	PageRef         string      `json:"pageref,omitempty"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // Total time of the request in milliseconds (sum of non-negative timings)
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+
+	RequestID    string `json:"_requestId"`    // DevTools request ID, matching resource metadata and resource files
+	ResourceType string `json:"_resourceType"` // DevTools resource type (Document, Script, etc.)
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int64          `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+
+	Error string `json:"_error,omitempty"` // Why no response was received, for requests with a status of 0
+}
+
+type HARCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // "base64" if Text is base64-encoded
+}
+
+// Timings are all in milliseconds, with -1 used for phases which do not apply to a request
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
@@ -0,0 +1,26 @@
+package base
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"regexp"
+)
+
+// Site returns the eTLD+1 for a host name (e.g., "example.co.uk" for "www.example.co.uk"). If the
+// eTLD+1 cannot be determined (e.g., the host is an IP address), the host itself is returned.
+func Site(host string) string {
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+// MatchesAny reports whether s matches at least one of the given regular expressions
+func MatchesAny(regexes []*regexp.Regexp, s string) bool {
+	for _, r := range regexes {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
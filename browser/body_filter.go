@@ -0,0 +1,102 @@
+package browser
+
+import (
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// bodyFilter decides which resource bodies to save during a site visit, according to the body filters in the
+// task's data settings. Filtering happens before a body is requested from the browser where it can, so bodies we
+// do not want are usually never transferred at all.
+type bodyFilter struct {
+	ds      b.DataSettings
+	site    string // Site (eTLD+1) of the task URL, which first-party resources share
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newBodyFilter(st *b.SanitizedTask) *bodyFilter {
+	f := &bodyFilter{ds: st.DS}
+	if u, err := url.Parse(st.URL); err == nil {
+		f.site = b.Site(u.Hostname())
+	}
+
+	// Regexes were checked during sanitization
+	for _, r := range *st.DS.BodyURLInclude {
+		f.include = append(f.include, regexp.MustCompile(r))
+	}
+	for _, r := range *st.DS.BodyURLExclude {
+		f.exclude = append(f.exclude, regexp.MustCompile(r))
+	}
+
+	return f
+}
+
+// allows reports whether the body of a resource should be saved, given the resource's URL, resource type and
+// MIME type, and its size in bytes if that is known yet (or -1 if not). The body is not fetched until it is
+// allowed, so the size is usually its Content-Length, which is never more than its decoded length. Bodies of
+// unknown size have their decoded length checked with fits once they have been fetched.
+func (f *bodyFilter) allows(resourceURL string, resourceType network.ResourceType, mimeType string, size int64) bool {
+	if !f.fits(size) {
+		return false
+	}
+
+	if len(*f.ds.BodyAllowTypes) > 0 && !typeMatches(*f.ds.BodyAllowTypes, resourceType, mimeType) {
+		return false
+	}
+	if typeMatches(*f.ds.BodyDenyTypes, resourceType, mimeType) {
+		return false
+	}
+
+	if *f.ds.BodyParty != b.AllParties {
+		u, err := url.Parse(resourceURL)
+		if err != nil {
+			return false
+		}
+		firstParty := b.Site(u.Hostname()) == f.site
+		if firstParty != (*f.ds.BodyParty == b.FirstParty) {
+			return false
+		}
+	}
+
+	if len(f.include) > 0 && !b.MatchesAny(f.include, resourceURL) {
+		return false
+	}
+	if b.MatchesAny(f.exclude, resourceURL) {
+		return false
+	}
+
+	return true
+}
+
+// fits reports whether a body of the given size in bytes (or -1 if it is unknown) is within the task's maximum
+// body size
+func (f *bodyFilter) fits(size int64) bool {
+	return *f.ds.BodyMaxSize == 0 || size < 0 || size <= int64(*f.ds.BodyMaxSize)
+}
+
+// typeMatches checks a resource against a list of types. Types containing a slash are MIME types, which may end
+// in a wildcard (e.g., "image/*"), while the rest are DevTools resource types (e.g., "Script"). Both are matched
+// case-insensitively.
+func typeMatches(types []string, resourceType network.ResourceType, mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if !strings.Contains(t, "/") {
+			if t == strings.ToLower(string(resourceType)) {
+				return true
+			}
+		} else if strings.HasSuffix(t, "/*") {
+			if strings.HasPrefix(mimeType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		} else if t == mimeType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+package browser
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	b "github.com/pmurley/mida/base"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// streamedBodies records the resource bodies which are being streamed to disk as they arrive, so that they are
+// not requested from the browser a second time once they finish loading
+type streamedBodies struct {
+	sync.Mutex
+	ids map[string]bool // Request IDs of the streamed bodies
+}
+
+func newStreamedBodies() *streamedBodies {
+	return &streamedBodies{ids: make(map[string]bool)}
+}
+
+func (s *streamedBodies) add(requestID string) {
+	s.Lock()
+	s.ids[requestID] = true
+	s.Unlock()
+}
+
+func (s *streamedBodies) has(requestID string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ids[requestID]
+}
+
+// bodyStream is a resource body being streamed to disk, along with what we need to know about its response to
+// apply the task's body filters once the body has finished loading
+type bodyStream struct {
+	file         *os.File
+	url          string
+	resourceType network.ResourceType
+	mimeType     string
+	size         int64 // Bytes written to the file so far
+}
+
+// NetworkBodyStreams is the event handler for streaming large resource bodies to disk. It receives the network
+// events for each resource in the order the browser sent them: responses, the data received for them, and
+// their loading finishing or failing. Responses with bodies larger than the task's streaming threshold, or of
+// unknown size (e.g., chunked media), have their bodies teed to us chunk by chunk as Network.DataReceived
+// events, which are written straight to disk. Nothing is intercepted, so the page loads (and its responses are
+// recorded) just as they would be otherwise, and no body is ever held whole in memory.
+//
+// Every Network.LoadingFinished event is passed on to finishedChan once any streamed body has been written, so
+// that the handler for those events knows which bodies it does not need to fetch.
+func NetworkBodyStreams(eventChan chan interface{}, finishedChan chan *network.EventLoadingFinished,
+	rawResult *b.RawResult, streamed *streamedBodies, wg *sync.WaitGroup, ctxt context.Context, log *logrus.Logger) {
+
+	// For brevity
+	tw := rawResult.TaskSummary.TaskWrapper
+	filter := newBodyFilter(&tw.SanitizedTask)
+	threshold := int64(*tw.SanitizedTask.DS.StreamBodyThreshold)
+
+	// The bodies being streamed, keyed by request ID
+	streams := make(map[string]*bodyStream)
+	abandon := func(requestID string) {
+		if s, ok := streams[requestID]; ok {
+			s.file.Close()
+			_ = os.Remove(s.file.Name())
+			delete(streams, requestID)
+		}
+	}
+
+	done := false
+	for {
+		select {
+		case event, ok := <-eventChan:
+			if !ok { // Channel closed
+				done = true
+				break
+			}
+
+			switch ev := event.(type) {
+			case *network.EventResponseReceived:
+				if ev.Response == nil || ev.Response.Status < 200 || ev.Response.Status >= 300 {
+					break
+				}
+				size := contentLength(ev.Response.Headers)
+				if size >= 0 && size <= threshold {
+					break
+				}
+				if !filter.allows(ev.Response.URL, ev.Type, ev.Response.MimeType, size) {
+					break
+				}
+
+				filename := path.Join(tw.TempDir, b.DefaultResourceSubdir, ev.RequestID.String())
+				f, buffered, err := streamBody(ctxt, ev.RequestID, filename)
+				if err != nil {
+					// Most likely the body finished loading before we asked for it, so it is fetched as usual
+					log.Debugf("not streaming resource (%s): %s", ev.RequestID.String(), err.Error())
+					break
+				}
+				streams[ev.RequestID.String()] = &bodyStream{
+					file:         f,
+					url:          ev.Response.URL,
+					resourceType: ev.Type,
+					mimeType:     ev.Response.MimeType,
+					size:         buffered,
+				}
+				streamed.add(ev.RequestID.String())
+			case *network.EventDataReceived:
+				s, ok := streams[ev.RequestID.String()]
+				if !ok || ev.Data == "" {
+					break
+				}
+				n, err := writeChunk(s.file, ev.Data)
+				s.size += n
+				if err != nil {
+					log.Errorf("failed to stream resource (%s): %s", ev.RequestID.String(), err.Error())
+					abandon(ev.RequestID.String())
+				}
+			case *network.EventLoadingFinished:
+				if s, ok := streams[ev.RequestID.String()]; ok {
+					err := s.file.Close()
+					delete(streams, ev.RequestID.String())
+					if err != nil {
+						log.Errorf("failed to stream resource (%s): %s", ev.RequestID.String(), err.Error())
+						_ = os.Remove(s.file.Name())
+					} else if !filter.fits(s.size) {
+						// Without a Content-Length, the body's size is only known now
+						_ = os.Remove(s.file.Name())
+					}
+				}
+				select {
+				case finishedChan <- ev:
+				case <-ctxt.Done():
+				}
+			case *network.EventLoadingFailed:
+				abandon(ev.RequestID.String())
+			}
+		case <-ctxt.Done(): // Context canceled, browser closed
+			done = true
+			break
+		}
+
+		if done {
+			break
+		}
+	}
+
+	// Bodies which had not finished loading are incomplete, so they are not kept
+	for requestID := range streams {
+		abandon(requestID)
+	}
+
+	wg.Done()
+}
+
+// streamBody asks the browser to tee the body of a response to us as it arrives, creating the file it will be
+// written to. Whatever the browser received before streaming was enabled is written straight away, and the
+// number of bytes written is returned along with the file.
+func streamBody(ctxt context.Context, requestID network.RequestID, filename string) (*os.File, int64, error) {
+	var buffered []byte
+	err := chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		var err error
+		buffered, err = network.StreamResourceContent(requestID).Do(ctxt)
+		return err
+	}))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buffered) > 0 {
+		_, err = f.Write(buffered)
+		if err != nil {
+			f.Close()
+			_ = os.Remove(filename)
+			return nil, 0, err
+		}
+	}
+
+	return f, int64(len(buffered)), nil
+}
+
+// writeChunk decodes a base64-encoded chunk of a body and appends it to the body's file, returning the number of
+// bytes written
+func writeChunk(f *os.File, data string) (int64, error) {
+	chunk, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(chunk)
+	return int64(n), err
+}
+
+// contentLength gets the size of a response body from its Content-Length header, or -1 if the size is unknown
+// (e.g., for chunked responses)
+func contentLength(headers network.Headers) int64 {
+	for k, v := range headers {
+		if strings.EqualFold(k, "Content-Length") {
+			if s, ok := v.(string); ok {
+				size, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+				if err == nil {
+					return size
+				}
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,63 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	b "github.com/pmurley/mida/base"
+	"time"
+)
+
+// conditionExpression builds the JavaScript expression we poll for selector and JavaScript predicate
+// completion conditions. It returns false if the completion condition does not require polling.
+func conditionExpression(cs b.CompletionSettings) (string, bool) {
+	switch *cs.CompletionCondition {
+	case b.SelectorPresent:
+		// Marshaling the selector gives us a safely quoted JavaScript string literal
+		selector, err := json.Marshal(*cs.Selector)
+		if err != nil {
+			return "", false
+		}
+		return "document.querySelector(" + string(selector) + ") !== null", true
+	case b.JSPredicate:
+		return "!!(" + *cs.Expression + ")", true
+	default:
+		return "", false
+	}
+}
+
+// pollCondition evaluates the given expression in the page at the given interval, returning a channel which
+// receives a value the first time the expression evaluates to true. Evaluation errors (for example, because
+// the page is in the middle of navigating) are treated as false. The polling goroutine exits when the context
+// is canceled.
+func pollCondition(ctxt context.Context, expression string, interval time.Duration) <-chan bool {
+	conditionChan := make(chan bool, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				var met bool
+				err := chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+					result, exception, err := runtime.Evaluate(expression).WithReturnByValue(true).Do(ctxt)
+					if err != nil {
+						return err
+					}
+					met = exception == nil && result != nil && string(result.Value) == "true"
+					return nil
+				}))
+				if err == nil && met {
+					conditionChan <- true
+					return
+				}
+			case <-ctxt.Done():
+				return
+			}
+		}
+	}()
+
+	return conditionChan
+}
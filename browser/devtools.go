@@ -3,13 +3,21 @@ package browser
 import (
 	"context"
 	"errors"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/css"
 	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/dom"
 	"github.com/chromedp/cdproto/fetch"
 	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/performance"
+	"github.com/chromedp/cdproto/profiler"
 	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/tracing"
 	"github.com/chromedp/chromedp"
 	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/postprocess"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -20,25 +28,25 @@ import (
 func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 	var err error
 
-	// Fully allocate our raw result object -- should be locked whenever it is read or written
-	rawResult := b.RawResult{
-		CrawlerInfo: b.CrawlerInfo{},
-		TaskSummary: b.TaskSummary{
-			Success:      false,
-			TaskWrapper:  tw,
-			TaskTiming:   b.TaskTiming{},
-			NumResources: 0,
-		},
-		DevTools: b.DevToolsRawData{
-			Network: b.DevtoolsNetworkRawData{
-				RequestWillBeSent: make(map[string][]network.EventRequestWillBeSent),
-				ResponseReceived:  make(map[string]network.EventResponseReceived),
-			},
-		},
+	// A remote browser is already running, so there is nothing for us to launch
+	if tw.SanitizedTask.RemoteEndpoint != "" {
+		return visitRemote(tw)
 	}
 
-	// Open all the event channels we will use to receive events from DevTools
-	ec := openEventChannels()
+	// If the task uses a profile, the user data directory starts out as a copy of it. Visits which will
+	// save the profile back hold it for the whole visit, so they see each other's changes in order.
+	if tw.SanitizedTask.ProfilePath != "" {
+		if tw.SanitizedTask.PersistProfile {
+			l := profileLock(tw.SanitizedTask.ProfilePath)
+			l.Lock()
+			defer l.Unlock()
+		}
+
+		err = copyProfile(tw.SanitizedTask.ProfilePath, tw.SanitizedTask.UserDataDirectory)
+		if err != nil {
+			return nil, errors.New("failed to copy profile into user data directory: " + err.Error())
+		}
+	}
 
 	// Make sure user data directory exists already. If not, create it.
 	// If we can't create it, we consider it a bad enough error that we
@@ -51,20 +59,59 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 		}
 	}
 
-	// If we are gathering all the resources, we need to create the corresponding directory
-	if *(tw.SanitizedTask.DS.AllResources) {
-		// Create a subdirectory where we will store all the files
-		_, err = os.Stat(path.Join(tw.TempDir, b.DefaultResourceSubdir))
+	// Spawn our browser
+	allocContext, allocCancel := chromedp.NewExecAllocator(context.Background(),
+		allocatorOptions(tw, tw.SanitizedTask.UserDataDirectory)...)
+	defer allocCancel()
+	browserContext, browserCancel := chromedp.NewContext(allocContext)
+	defer browserCancel()
+
+	// If the visit hangs, the watchdog kills the browser (and everything it started) once the visit is overdue
+	wd := startWatchdog(tw, tw.SanitizedTask.UserDataDirectory, allocCancel)
+
+	rawResult, err := visitTask(browserContext, tw)
+
+	closeContext, closeCancel := context.WithTimeout(browserContext, 5*time.Second)
+	closeErr := chromedp.Cancel(closeContext)
+	closeCancel()
+	if closeErr != nil {
+		// This isn't an ideal solution, but if the graceful close fails, we have to just kill the browser to free resources
+		tw.Log.Errorf("failed to close browser gracefully, so we had to force it (%s)", closeErr.Error())
+		allocCancel()
+	}
+	killed := wd.stop()
+	reapBrowser(tw, tw.SanitizedTask.UserDataDirectory)
+	tw.Log.Debug("browser is now closed")
+
+	if err != nil {
+		return nil, err
+	}
+	if killed {
+		setKilled(rawResult)
+	}
+
+	// Now that the browser has exited, its profile is safe to copy
+	if tw.SanitizedTask.PersistProfile {
+		err = persistProfile(tw.SanitizedTask.UserDataDirectory, tw.SanitizedTask.ProfilePath)
 		if err != nil {
-			err = os.MkdirAll(path.Join(tw.TempDir, b.DefaultResourceSubdir), 0744)
-			if err != nil {
-				tw.Log.Error("failed to create resource subdir within UDD")
-				return nil, err
-			}
+			tw.Log.Errorf("failed to persist profile: %s", err.Error())
+		}
+	}
+	if tw.SanitizedTask.ArchiveProfile {
+		err = archiveProfile(tw.SanitizedTask.UserDataDirectory, path.Join(tw.TempDir, b.DefaultProfileArchiveFile))
+		if err != nil {
+			tw.Log.Errorf("failed to archive profile: %s", err.Error())
 		}
 	}
 
-	// Build our opts slice
+	setBrowserClose(rawResult)
+	tw.Log.Debug("site visit concluded")
+
+	return rawResult, nil
+}
+
+// allocatorOptions builds the options for launching a browser for the given task, using the given user data directory
+func allocatorOptions(tw *b.TaskWrapper, userDataDir string) []chromedp.ExecAllocatorOption {
 	var opts []chromedp.ExecAllocatorOption
 	for _, flagString := range tw.SanitizedTask.BrowserFlags {
 		name, val, err := ChromeFormatFlag(flagString)
@@ -76,29 +123,172 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 		opts = append(opts, chromedp.Flag(name, val))
 	}
 
-	opts = append(opts, chromedp.Flag("user-data-dir", tw.SanitizedTask.UserDataDirectory))
+	opts = append(opts, chromedp.Flag("user-data-dir", userDataDir))
 	opts = append(opts, chromedp.ExecPath(tw.SanitizedTask.BrowserBinaryPath))
+	if tw.Display != "" {
+		opts = append(opts, chromedp.Env("DISPLAY="+tw.Display))
+	}
+
+	return opts
+}
+
+// visitTask visits the task's URL, followed by any session steps, in the browser tab belonging to the given
+// context. The tab is left open -- closing it (or the browser) is up to the caller.
+func visitTask(tabContext context.Context, tw *b.TaskWrapper) (*b.RawResult, error) {
+	// Event Demux - just receive the events and stick them in the channels for the step we are currently visiting
+	router := &eventRouter{}
+	chromedp.ListenTarget(tabContext, router.route)
+
+	rawResult, err := visitStep(tabContext, tw, router)
+	if err != nil {
+		return nil, err
+	}
+
+	// Visit any further steps of a session task in the same browser, so they share its cookies and cache.
+	// There is no point continuing once a step has failed to navigate or the browser has gone away.
+	for i, step := range tw.SanitizedTask.Session {
+		last := rawResult
+		if len(rawResult.Steps) > 0 {
+			last = rawResult.Steps[len(rawResult.Steps)-1]
+		}
+		if last.TaskSummary.TaskWrapper.FailureCode != "" || tabContext.Err() != nil {
+			tw.Log.Warnf("skipping remaining %d session steps", len(tw.SanitizedTask.Session)-i)
+			break
+		}
+
+		stepWrapper := sessionStepWrapper(tw, i+1, step)
+		err = os.MkdirAll(stepWrapper.TempDir, 0755)
+		if err != nil {
+			tw.Log.Errorf("failed to create temporary directory for session step %d: %s", stepWrapper.Step, err.Error())
+			break
+		}
+
+		tw.Log.Infof("visiting session step %d: %s", stepWrapper.Step, stepWrapper.SanitizedTask.URL)
+		stepResult, err := visitStep(tabContext, stepWrapper, router)
+		if err != nil {
+			tw.Log.Errorf("session step %d failed: %s", stepWrapper.Step, err.Error())
+			break
+		}
+		rawResult.Steps = append(rawResult.Steps, stepResult)
+	}
+
+	return rawResult, nil
+}
+
+// setKilled marks a raw result as failed because the watchdog had to step in, unless it had already failed
+func setKilled(rawResult *b.RawResult) {
+	rawResult.Lock()
+	defer rawResult.Unlock()
+
+	tw := rawResult.TaskSummary.TaskWrapper
+	if tw.FailureCode == "" {
+		tw.FailureCode = "site visit exceeded its hard deadline and was abandoned"
+		tw.FailureClass = b.FailureBrowserCrash
+	}
+	rawResult.TaskSummary.Success = false
+}
+
+// setBrowserClose stores the time at which we closed the browser (or tab) in a raw result and those of its steps
+func setBrowserClose(rawResult *b.RawResult) {
+	for _, rr := range append([]*b.RawResult{rawResult}, rawResult.Steps...) {
+		rr.Lock()
+		rr.TaskSummary.TaskTiming.BrowserClose = time.Now()
+		rr.Unlock()
+	}
+}
+
+// visitStep navigates the (already open) browser to the URL of the given task wrapper and waits for its
+// completion condition, gathering a raw result for this page alone. Event handlers for the step run until
+// the step finishes, but the browser is left open so that further session steps can reuse it.
+func visitStep(browserContext context.Context, tw *b.TaskWrapper, router *eventRouter) (*b.RawResult, error) {
+	var err error
+
+	// Fully allocate our raw result object -- should be locked whenever it is read or written
+	rawResult := b.RawResult{
+		CrawlerInfo: b.CrawlerInfo{},
+		TaskSummary: b.TaskSummary{
+			Success:      false,
+			TaskWrapper:  tw,
+			TaskTiming:   b.TaskTiming{},
+			NumResources: 0,
+			ParentUUID:   tw.SanitizedTask.ParentUUID,
+			Depth:        tw.SanitizedTask.Depth,
+		},
+		DevTools: b.DevToolsRawData{
+			Network: b.DevtoolsNetworkRawData{
+				RequestWillBeSent: make(map[string][]network.EventRequestWillBeSent),
+				ResponseReceived:  make(map[string]network.EventResponseReceived),
+				LoadingFinished:   make(map[string]network.EventLoadingFinished),
+				LoadingFailed:     make(map[string]network.EventLoadingFailed),
+			},
+			Debugger: b.DevToolsDebuggerRawData{
+				ScriptParsed: make(map[string]debugger.EventScriptParsed),
+			},
+			Coverage: b.DevToolsCoverageRawData{
+				StyleSheets: make(map[string]css.StyleSheetHeader),
+			},
+		},
+	}
+
+	// If we are gathering all the resources, we need to create the corresponding directory
+	if *(tw.SanitizedTask.DS.AllResources) {
+		// Create a subdirectory where we will store all the files
+		_, err = os.Stat(path.Join(tw.TempDir, b.DefaultResourceSubdir))
+		if err != nil {
+			err = os.MkdirAll(path.Join(tw.TempDir, b.DefaultResourceSubdir), 0744)
+			if err != nil {
+				tw.Log.Error("failed to create resource subdir within UDD")
+				return nil, err
+			}
+		}
+	}
+
+	// Open all the event channels we will use to receive events from DevTools for this step
+	ec := openEventChannels()
 
 	// Build channels we need for coordinating the site visit across goroutines
-	navChan := make(chan error)                                                          // A channel to signal the completion of navigation, successfully or not
+	navChan := make(chan error, 1)                                                       // A channel to signal the completion of navigation, successfully or not
 	timeoutChan := time.After(time.Duration(*tw.SanitizedTask.CS.Timeout) * time.Second) // Absolute longest we can go
 	loadEventChan := make(chan bool)                                                     // Used to signal the firing of load events
 	var eventHandlerWG sync.WaitGroup                                                    // Used to make sure all the event handlers exit
-
-	// Spawn our browser
-	allocContext, allocCancel := chromedp.NewExecAllocator(context.Background(), opts...)
-	browserContext, _ := chromedp.NewContext(allocContext)
+	idleTracker := newNetworkIdleTracker(*tw.SanitizedTask.CS.NetworkIdleConnections)    // Tracks requests in flight
+
+	// Event handlers for this step exit when the step finishes, or when the browser closes
+	stepContext, stepCancel := context.WithCancel(browserContext)
+	defer stepCancel()
+	ec.done = stepContext.Done()
+
+	// Large resource bodies are streamed to disk as they arrive, if the task asks for it
+	streamed := newStreamedBodies()
+	if *tw.SanitizedTask.DS.AllResources && *tw.SanitizedTask.DS.StreamBodyThreshold > 0 {
+		ec.bodyStreamChan = make(chan interface{}, b.DefaultEventChannelBufferSize)
+		eventHandlerWG.Add(1)
+		go NetworkBodyStreams(ec.bodyStreamChan, ec.loadingFinishedChan, &rawResult, streamed, &eventHandlerWG, stepContext, tw.Log)
+	}
 
 	// Get our event listener goroutines up and running
-	eventHandlerWG.Add(4) // *** UPDATE ME WHEN YOU ADD A NEW EVENT HANDLER ***
-	go PageLoadEventFired(ec.loadEventFiredChan, loadEventChan, &rawResult, &eventHandlerWG, browserContext)
-	go NetworkRequestWillBeSent(ec.requestWillBeSentChan, &rawResult, &eventHandlerWG, browserContext)
-	go NetworkResponseReceived(ec.responseReceivedChan, &rawResult, &eventHandlerWG, browserContext)
-	go NetworkLoadingFinished(ec.loadingFinishedChan, &rawResult, &eventHandlerWG, browserContext, tw.Log)
+	eventHandlerWG.Add(7) // *** UPDATE ME WHEN YOU ADD A NEW EVENT HANDLER ***
+	go PageLoadEventFired(ec.loadEventFiredChan, loadEventChan, &rawResult, &eventHandlerWG, stepContext)
+	go NetworkRequestWillBeSent(ec.requestWillBeSentChan, &rawResult, idleTracker, &eventHandlerWG, stepContext)
+	go NetworkResponseReceived(ec.responseReceivedChan, &rawResult, &eventHandlerWG, stepContext)
+	go NetworkLoadingFinished(ec.loadingFinishedChan, &rawResult, idleTracker, streamed, &eventHandlerWG, stepContext, tw.Log)
+	go NetworkLoadingFailed(ec.loadingFailedChan, &rawResult, idleTracker, &eventHandlerWG, stepContext)
+	go DebuggerScriptParsed(ec.scriptParsedChan, &rawResult, &eventHandlerWG, stepContext)
+	go CSSStyleSheetAdded(ec.styleSheetAddedChan, &rawResult, &eventHandlerWG, stepContext)
+
+	// finishStep stops the event handlers for this step and waits for them to exit
+	finishStep := func() {
+		router.setChannels(nil)
+		stepCancel()
+		eventHandlerWG.Wait()
+	}
+
+	router.setChannels(&ec)
 
-	// Ensure the correct domains are enabled/disabled
+	// Ensure the correct domains are enabled/disabled. Coverage and tracing are started afresh for each
+	// step, so that each step's results only cover its own page.
 	err = chromedp.Run(browserContext, chromedp.ActionFunc(func(cxt context.Context) error {
-		err = runtime.Disable().Do(cxt)
+		err := runtime.Disable().Do(cxt)
 		if err != nil {
 			return err
 		}
@@ -118,92 +308,140 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 			return err
 		}
 
-		return nil
-	}))
-	if err != nil {
-		// If we can't enable the domains on the browser, something is seriously wrong, so we return an error. No results.
-		tw.Log.Error("failed to enable DevTools domains")
+		if *tw.SanitizedTask.DS.Coverage {
+			err = profiler.Enable().Do(cxt)
+			if err != nil {
+				return err
+			}
 
-		closeContext, _ := context.WithTimeout(browserContext, 5*time.Second)
-		err = chromedp.Cancel(closeContext)
-		if err != nil {
-			// This isn't an ideal solution, but if the graceful close fails, we have to just kill the browser to free resources
-			tw.Log.Errorf("failed to close browser gracefully, so we had to force it (%s)", err.Error())
-			allocCancel()
+			_, err = profiler.StartPreciseCoverage().WithCallCount(true).WithDetailed(true).Do(cxt)
+			if err != nil {
+				return err
+			}
+
+			// The CSS domain requires the DOM domain to be enabled first
+			err = dom.Enable().Do(cxt)
+			if err != nil {
+				return err
+			}
+
+			err = css.Enable().Do(cxt)
+			if err != nil {
+				return err
+			}
+
+			err = css.StartRuleUsageTracking().Do(cxt)
+			if err != nil {
+				return err
+			}
 		}
 
-		// Wait for all event handlers to finish
-		eventHandlerWG.Wait()
-		return nil, errors.New("failed to enable DevTools domains")
-	}
-
-	// Event Demux - just receive the events and stick them in the applicable channels
-	chromedp.ListenTarget(browserContext, func(ev interface{}) {
-		switch ev.(type) {
-		case *page.EventLoadEventFired:
-			ec.loadEventFiredChan <- ev.(*page.EventLoadEventFired)
-		case *network.EventRequestWillBeSent:
-			ec.requestWillBeSentChan <- ev.(*network.EventRequestWillBeSent)
-		case *network.EventResponseReceived:
-			ec.responseReceivedChan <- ev.(*network.EventResponseReceived)
-		case *network.EventLoadingFinished:
-			ec.loadingFinishedChan <- ev.(*network.EventLoadingFinished)
+		if *tw.SanitizedTask.DS.PerformanceMetrics {
+			err = performance.Enable().Do(cxt)
+			if err != nil {
+				return err
+			}
+		}
+
+		if *tw.SanitizedTask.DS.Trace {
+			err = startTracing(cxt, *tw.SanitizedTask.DS.TraceCategories)
+			if err != nil {
+				return err
+			}
 		}
 
-	})
+		return nil
+	}))
+	// failStep records a site visit which could not get as far as the completion condition
+	failStep := func(errorCode string, class b.FailureClass) *b.RawResult {
+		tw.Log.Error(errorCode)
+
+		// Shut things down
+		finishStep()
+
+		rawResult.Lock()
+		rawResult.TaskSummary.TaskWrapper.FailureCode = errorCode
+		rawResult.TaskSummary.TaskWrapper.FailureClass = class
+		rawResult.TaskSummary.CompletionReason = b.CompletionFailed
+		rawResult.TaskSummary.Success = false
+		rawResult.Unlock()
+
+		return &rawResult
+	}
+
+	if err != nil {
+		// If we can't enable the domains on the browser, something is seriously wrong, and we have no results
+		return failStep("failed to enable DevTools domains: "+err.Error(), b.FailureDevToolsSetup), nil
+	}
 
-	// Initiate navigation to the applicable page
+	// Initiate navigation to the applicable page. We keep the loader ID, since it is also the request ID
+	// for the main document, which we check for an HTTP error once the visit is over.
+	var loaderID cdp.LoaderID
 	go func() {
-		err = chromedp.Run(browserContext, chromedp.ActionFunc(func(ctxt context.Context) error {
-			_, _, text, err := page.Navigate(tw.SanitizedTask.URL).Do(ctxt)
+		navChan <- chromedp.Run(browserContext, chromedp.ActionFunc(func(ctxt context.Context) error {
+			_, id, text, err := page.Navigate(tw.SanitizedTask.URL).Do(ctxt)
 			if err != nil {
 				return err
-			} else if text != "" {
+			}
+			loaderID = id
+			if text != "" {
 				return errors.New(text)
-			} else {
-				return nil
 			}
+			return nil
 		}))
-		navChan <- err
 	}()
 
+	var failureClass b.FailureClass
 	select {
 	case err = <-navChan:
 		rawResult.Lock()
 		rawResult.TaskSummary.TaskTiming.ConnectionEstablished = time.Now()
 		rawResult.Unlock()
+		if err != nil {
+			failureClass = classifyNetError(err.Error())
+		}
 	case <-time.After(b.DefaultNavTimeout * time.Second):
 		// Our connection to the web server took longer than out navigation timeout (currently 30 seconds)
 		err = errors.New("timeout on connection to webserver")
+		failureClass = b.FailureNavigationTimeout
 	case <-timeoutChan:
 		err = errors.New("total site visit time exceeded before we connected to webserver")
+		failureClass = b.FailureNavigationTimeout
 	case <-browserContext.Done():
 		// The browser somehow closed before we finished navigation
 		err = errors.New("browser closed during connection to site")
+		failureClass = b.FailureBrowserCrash
 	}
 	if err != nil {
-		// Save our error message for storage
-		errorCode := err.Error()
-		tw.Log.Errorf(errorCode)
-
-		// We have failed to navigate to the site. Shut things down.
-		closeContext, _ := context.WithTimeout(browserContext, 5*time.Second)
-		err = chromedp.Cancel(closeContext)
-		if err != nil {
-			// We failed to close chrome gracefully within the allotted timeout
-			allocCancel()
-			tw.Log.Errorf("failed to close browser gracefully, so we had to force it (%s)", err.Error())
-		}
-
-		eventHandlerWG.Wait()
+		// We have failed to navigate to the site
+		return failStep(err.Error(), failureClass), nil
+	}
 
-		rawResult.Lock()
-		rawResult.TaskSummary.TaskWrapper.FailureCode = errorCode
-		rawResult.TaskSummary.Success = false
-		rawResult.TaskSummary.TaskTiming.BrowserClose = time.Now()
-		rawResult.Unlock()
+	// Selector and JavaScript conditions are polled from the moment navigation succeeds, since they may
+	// be satisfied before (or without) the load event
+	var conditionChan <-chan bool // Stays nil (never ready) unless we are polling a condition
+	conditionContext, conditionCancel := context.WithCancel(browserContext)
+	defer conditionCancel()
+	if expression, ok := conditionExpression(tw.SanitizedTask.CS); ok {
+		conditionChan = pollCondition(conditionContext, expression,
+			time.Duration(*tw.SanitizedTask.CS.PollInterval)*time.Millisecond)
+	}
 
-		return &rawResult, nil
+	// waitGracePeriod is used once a selector or JavaScript condition has been met
+	var reason b.CompletionReason
+	waitGracePeriod := func() {
+		reason = b.CompletionConditionMet
+		select {
+		case <-browserContext.Done():
+			// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
+			tw.Log.Warn("browser crashed, closed manually, or we lost connection (during grace period)")
+			reason = b.CompletionBrowserClosed
+		case <-timeoutChan:
+			// We hit our general timeout during the grace period. Fall through to browser close and cleanup
+			tw.Log.Debug("general timeout hit during grace period")
+		case <-time.After(time.Duration(*tw.SanitizedTask.CS.GracePeriod) * time.Second):
+			tw.Log.Debug("grace period finished")
+		}
 	}
 
 	// We have now successfully connected and navigated to the site. Now we wait for a termination condition.
@@ -211,7 +449,20 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 	case <-browserContext.Done():
 		// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
 		tw.Log.Warn("browser crashed, closed manually, or we lost connection")
+		reason = b.CompletionBrowserClosed
+	case <-conditionChan:
+		// Our selector or JavaScript condition was met before the load event fired
+		tw.Log.Debug("completion condition met before load event")
+		waitGracePeriod()
 	case <-loadEventChan:
+		loadTime := time.Now()
+		if *tw.SanitizedTask.DS.PerformanceMetrics {
+			err = gatherPerformanceMetrics(browserContext, &rawResult, true)
+			if err != nil {
+				tw.Log.Errorf("failed to gather performance metrics at load event: %s", err.Error())
+			}
+		}
+
 		// The load event fired. What we do next depends on how the crawl completes
 		switch *tw.SanitizedTask.CS.CompletionCondition {
 		case b.TimeAfterLoad:
@@ -219,25 +470,64 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 			case <-browserContext.Done():
 				// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
 				tw.Log.Warn("browser crashed, closed manually, or we lost connection (after load event)")
+				reason = b.CompletionBrowserClosed
 			case <-timeoutChan:
 				// We hit our general timeout before we got to timeAfterLoad. Fall through to browser close and cleanup
 				tw.Log.Debug("general timeout hit before timeAfterload")
+				reason = b.CompletionTimeout
 			case <-time.After(time.Duration(*tw.SanitizedTask.CS.TimeAfterLoad) * time.Second):
 				// We finished our timeAfterLoad period. Fall through to browser close and cleanup
 				tw.Log.Debug("hit timeAfterLoad")
+				reason = b.CompletionConditionMet
 			}
 		case b.LoadEvent:
 			// We got out load event so we are just done, fall through to browser close and cleanup
 			tw.Log.Debug("got load event so we are concluding site visit")
+			reason = b.CompletionConditionMet
+		case b.NetworkIdle:
+			// Wait for the network to go idle, but no longer than our general timeout
+			idleContext, idleCancel := context.WithCancel(browserContext)
+			select {
+			case <-browserContext.Done():
+				// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
+				tw.Log.Warn("browser crashed, closed manually, or we lost connection (after load event)")
+				reason = b.CompletionBrowserClosed
+			case <-timeoutChan:
+				// We hit our general timeout before the network went idle. Fall through to browser close and cleanup
+				tw.Log.Debug("general timeout hit before network went idle")
+				reason = b.CompletionTimeout
+			case <-idleTracker.waitForIdle(idleContext, time.Duration(*tw.SanitizedTask.CS.NetworkIdleTime)*time.Millisecond, loadTime):
+				// The network has been idle long enough. Fall through to browser close and cleanup
+				tw.Log.Debug("network went idle")
+				reason = b.CompletionConditionMet
+			}
+			idleCancel()
+		case b.SelectorPresent, b.JSPredicate:
+			// Keep polling our condition until it is met or we time out
+			select {
+			case <-browserContext.Done():
+				// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
+				tw.Log.Warn("browser crashed, closed manually, or we lost connection (after load event)")
+				reason = b.CompletionBrowserClosed
+			case <-timeoutChan:
+				// We hit our general timeout before our condition was met. Fall through to browser close and cleanup
+				tw.Log.Debug("general timeout hit before completion condition was met")
+				reason = b.CompletionTimeout
+			case <-conditionChan:
+				tw.Log.Debug("completion condition met")
+				waitGracePeriod()
+			}
 		case b.TimeoutOnly:
 			// We need to just continue waiting for the timeout (or unexpected browser close)
 			select {
 			case <-browserContext.Done():
 				// Browser crashed, closed manually, or we otherwise lost connection to it prematurely
 				tw.Log.Warn("browser crashed, closed manually, or we lost connection (after load event)")
+				reason = b.CompletionBrowserClosed
 			case <-timeoutChan:
 				// We hit our general timeout, fall through to browser close and cleanup
 				tw.Log.Debug("hit general timeout")
+				reason = b.CompletionTimeout
 			}
 		default:
 			// This state should be unreachable -- got an unknown termination condition
@@ -246,25 +536,67 @@ func VisitPageDevtoolsProtocol(tw *b.TaskWrapper) (*b.RawResult, error) {
 	case <-timeoutChan:
 		// Timeout before load event was fired, fall through to browser close and cleanup
 		tw.Log.Debug("general timeout before load event fired")
+		reason = b.CompletionTimeout
 	}
+	conditionCancel()
 
-	closeContext, _ := context.WithTimeout(browserContext, 5*time.Second)
-	err = chromedp.Cancel(closeContext)
-	if err != nil {
-		tw.Log.Errorf("failed to close browser gracefully, so we had to force it (%s)", err.Error())
-		allocCancel()
+	rawResult.Lock()
+	rawResult.TaskSummary.CompletionReason = reason
+	rawResult.Unlock()
+
+	// Gather any data which must be explicitly requested from the browser before we close it
+	if *tw.SanitizedTask.DS.Coverage && browserContext.Err() == nil {
+		err = gatherCoverage(browserContext, &rawResult)
+		if err != nil {
+			tw.Log.Errorf("failed to gather code coverage: %s", err.Error())
+		}
+	}
+	if postprocess.Selected(tw.SanitizedTask.PPS, postprocess.LibrariesPostprocessor) && browserContext.Err() == nil {
+		err = gatherScriptSources(browserContext, &rawResult, path.Join(tw.TempDir, b.DefaultScriptSourceSubdir))
+		if err != nil {
+			tw.Log.Errorf("failed to gather script sources: %s", err.Error())
+		}
+	}
+	if *tw.SanitizedTask.DS.PerformanceMetrics && browserContext.Err() == nil {
+		err = gatherPerformanceMetrics(browserContext, &rawResult, false)
+		if err != nil {
+			tw.Log.Errorf("failed to gather final performance metrics: %s", err.Error())
+		}
+	}
+	if tw.Step == 0 && tw.SanitizedTask.Depth < *tw.SanitizedTask.CrawlS.MaxDepth && browserContext.Err() == nil {
+		links, err := extractLinks(browserContext)
+		if err != nil {
+			tw.Log.Errorf("failed to extract links for crawling: %s", err.Error())
+		} else {
+			rawResult.Lock()
+			rawResult.Links = links
+			rawResult.Unlock()
+		}
+	}
+	if *tw.SanitizedTask.DS.Trace && browserContext.Err() == nil {
+		err = stopTracing(browserContext, ec.tracingCompleteChan, tw.TempDir)
+		if err != nil {
+			tw.Log.Errorf("failed to save trace: %s", err.Error())
+		}
 	}
 
-	tw.Log.Debug("browser is now closed")
+	// Wait for all event handlers for this step to finish
+	finishStep()
+	tw.Log.Debug("finished waiting on background goroutines, step concluded")
 
-	// Store time at which we closed the browser
+	// A visit is only a success if the page actually loaded, and the browser lasted until the end
 	rawResult.Lock()
-	rawResult.TaskSummary.TaskTiming.BrowserClose = time.Now()
+	if code, class := mainDocumentFailure(&rawResult, loaderID.String()); code != "" {
+		tw.FailureCode, tw.FailureClass = code, class
+	} else if reason == b.CompletionBrowserClosed {
+		tw.FailureCode = "browser closed before site visit completed"
+		tw.FailureClass = b.FailureBrowserCrash
+	}
+	rawResult.TaskSummary.Success = tw.FailureCode == ""
 	rawResult.Unlock()
-
-	// Wait for all event handlers to finish
-	eventHandlerWG.Wait()
-	tw.Log.Debug("finished waiting on background goroutines, site visit concluded")
+	if tw.FailureCode != "" {
+		tw.Log.Error(tw.FailureCode)
+	}
 
 	return &rawResult, nil
 }
@@ -275,6 +607,7 @@ type EventChannels struct {
 	requestWillBeSentChan                  chan *network.EventRequestWillBeSent
 	responseReceivedChan                   chan *network.EventResponseReceived
 	loadingFinishedChan                    chan *network.EventLoadingFinished
+	loadingFailedChan                      chan *network.EventLoadingFailed
 	dataReceivedChan                       chan *network.EventDataReceived
 	webSocketCreatedChan                   chan *network.EventWebSocketCreated
 	webSocketFrameSentChan                 chan *network.EventWebSocketFrameSent
@@ -285,7 +618,23 @@ type EventChannels struct {
 	webSocketHandshakeResponseReceivedChan chan *network.EventWebSocketHandshakeResponseReceived
 	EventSourceMessageReceivedChan         chan *network.EventEventSourceMessageReceived
 	requestPausedChan                      chan *fetch.EventRequestPaused
+	bodyStreamChan                         chan interface{} // Network events for streaming bodies, in order (nil if not streaming)
 	scriptParsedChan                       chan *debugger.EventScriptParsed
+	styleSheetAddedChan                    chan *css.EventStyleSheetAdded
+	tracingCompleteChan                    chan *tracing.EventTracingComplete
+
+	done <-chan struct{} // Closed when the step finishes, after which events are no longer sent to its channels
+}
+
+// streamEvent passes a network event on to the body stream handler, if bodies are being streamed
+func (ec *EventChannels) streamEvent(ev interface{}) {
+	if ec.bodyStreamChan == nil {
+		return
+	}
+	select {
+	case ec.bodyStreamChan <- ev:
+	case <-ec.done:
+	}
 }
 
 func openEventChannels() EventChannels {
@@ -295,6 +644,7 @@ func openEventChannels() EventChannels {
 		requestWillBeSentChan:                  make(chan *network.EventRequestWillBeSent, b.DefaultEventChannelBufferSize),
 		responseReceivedChan:                   make(chan *network.EventResponseReceived, b.DefaultEventChannelBufferSize),
 		loadingFinishedChan:                    make(chan *network.EventLoadingFinished, b.DefaultEventChannelBufferSize),
+		loadingFailedChan:                      make(chan *network.EventLoadingFailed, b.DefaultEventChannelBufferSize),
 		dataReceivedChan:                       make(chan *network.EventDataReceived, b.DefaultEventChannelBufferSize),
 		webSocketCreatedChan:                   make(chan *network.EventWebSocketCreated, b.DefaultEventChannelBufferSize),
 		webSocketFrameSentChan:                 make(chan *network.EventWebSocketFrameSent, b.DefaultEventChannelBufferSize),
@@ -306,11 +656,86 @@ func openEventChannels() EventChannels {
 		EventSourceMessageReceivedChan:         make(chan *network.EventEventSourceMessageReceived, b.DefaultEventChannelBufferSize),
 		requestPausedChan:                      make(chan *fetch.EventRequestPaused, b.DefaultEventChannelBufferSize),
 		scriptParsedChan:                       make(chan *debugger.EventScriptParsed, b.DefaultEventChannelBufferSize),
+		styleSheetAddedChan:                    make(chan *css.EventStyleSheetAdded, b.DefaultEventChannelBufferSize),
+		tracingCompleteChan:                    make(chan *tracing.EventTracingComplete, b.DefaultEventChannelBufferSize),
 	}
 
 	return ec
 }
 
+// gatherCoverage collects JavaScript and CSS coverage from the browser. It must be called before the browser
+// is closed, and only if coverage collection was started when the DevTools domains were enabled.
+func gatherCoverage(ctxt context.Context, rawResult *b.RawResult) error {
+	var scriptCoverage []*profiler.ScriptCoverage
+	var ruleUsage []*css.RuleUsage
+
+	err := chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		var err error
+		scriptCoverage, _, err = profiler.TakePreciseCoverage().Do(ctxt)
+		if err != nil {
+			return err
+		}
+
+		ruleUsage, err = css.StopRuleUsageTracking().Do(ctxt)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+
+	rawResult.Lock()
+	rawResult.DevTools.Coverage.ScriptCoverage = scriptCoverage
+	rawResult.DevTools.Coverage.RuleUsage = ruleUsage
+	rawResult.Unlock()
+
+	return nil
+}
+
+// gatherScriptSources saves the source of each script the debugger saw parsed which was not loaded by a request
+// of its own (i.e., inline and eval'd scripts), so that libraries can be identified in them. Scripts loaded by
+// requests are identified from their resource bodies instead. Each source is saved to dir, named by script ID.
+func gatherScriptSources(ctxt context.Context, rawResult *b.RawResult, dir string) error {
+	rawResult.Lock()
+	scriptURLs := make(map[string]bool)
+	for _, requests := range rawResult.DevTools.Network.RequestWillBeSent {
+		if len(requests) > 0 && requests[len(requests)-1].Request != nil &&
+			requests[len(requests)-1].Type == network.ResourceTypeScript {
+			scriptURLs[requests[len(requests)-1].Request.URL] = true
+		}
+	}
+	var scriptIDs []runtime.ScriptID
+	for _, script := range rawResult.DevTools.Debugger.ScriptParsed {
+		// Inline scripts have the URL of their document, and eval'd scripts have none
+		if !scriptURLs[script.URL] {
+			scriptIDs = append(scriptIDs, script.ScriptID)
+		}
+	}
+	rawResult.Unlock()
+
+	if len(scriptIDs) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		for _, id := range scriptIDs {
+			source, _, err := debugger.GetScriptSource(id).Do(ctxt)
+			if err != nil {
+				// The script may have been collected along with a frame which has since gone away
+				continue
+			}
+			err = ioutil.WriteFile(path.Join(dir, id.String()), []byte(source), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
 // ChromeFormatFlag takes a variety of possible flag formats and puts them in a format that chromedp understands (key/value)
 func ChromeFormatFlag(f string) (string, interface{}, error) {
 	if strings.HasPrefix(f, "--") {
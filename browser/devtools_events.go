@@ -2,6 +2,8 @@ package browser
 
 import (
 	"context"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/debugger"
 	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
@@ -28,7 +30,12 @@ func PageLoadEventFired(eventChan chan *page.EventLoadEventFired, loadEventChan
 			rawResult.TaskSummary.TaskTiming.LoadEvent = time.Now()
 			rawResult.Unlock()
 
-			loadEventChan <- true // Signal that a load event has fired
+			// Signal that a load event has fired. Nobody listens for load events after the first, so we
+			// must not block forever if another fires before the step finishes.
+			select {
+			case loadEventChan <- true:
+			case <-ctxt.Done():
+			}
 
 		case <-ctxt.Done(): // Context canceled, browser closed
 			done = true
@@ -44,7 +51,8 @@ func PageLoadEventFired(eventChan chan *page.EventLoadEventFired, loadEventChan
 }
 
 // NetworkRequestWillBeSent is the event handler for the Network.RequestWillBeSent event
-func NetworkRequestWillBeSent(eventChan chan *network.EventRequestWillBeSent, rawResult *b.RawResult, wg *sync.WaitGroup, ctxt context.Context) {
+func NetworkRequestWillBeSent(eventChan chan *network.EventRequestWillBeSent, rawResult *b.RawResult,
+	idle *networkIdleTracker, wg *sync.WaitGroup, ctxt context.Context) {
 	done := false
 	for {
 		select {
@@ -54,6 +62,8 @@ func NetworkRequestWillBeSent(eventChan chan *network.EventRequestWillBeSent, ra
 				break
 			}
 
+			idle.requestStarted(ev.RequestID.String())
+
 			rawResult.Lock()
 			if _, ok := rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()]; !ok {
 				rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()] = make([]network.EventRequestWillBeSent, 0)
@@ -102,11 +112,15 @@ func NetworkResponseReceived(eventChan chan *network.EventResponseReceived, rawR
 }
 
 // NetworkLoadingFinished is the event handler for the Network.LoadingFinished event
-func NetworkLoadingFinished(eventChan chan *network.EventLoadingFinished, rawResult *b.RawResult, wg *sync.WaitGroup, ctxt context.Context, log *logrus.Logger) {
+func NetworkLoadingFinished(eventChan chan *network.EventLoadingFinished, rawResult *b.RawResult,
+	idle *networkIdleTracker, streamed *streamedBodies, wg *sync.WaitGroup, ctxt context.Context, log *logrus.Logger) {
 	var err error
 	done := false
 	resourceDownloadSuccessCounter := 0
 	resourceDownloadAttemptCounter := 0
+	resourceFilteredCounter := 0
+	resourceStreamedCounter := 0
+	filter := newBodyFilter(&rawResult.TaskSummary.TaskWrapper.SanitizedTask)
 	for {
 		select {
 		case ev, ok := <-eventChan:
@@ -115,24 +129,63 @@ func NetworkLoadingFinished(eventChan chan *network.EventLoadingFinished, rawRes
 				break
 			}
 
+			idle.requestFinished(ev.RequestID.String())
+
+			rawResult.Lock()
+			rawResult.DevTools.Network.LoadingFinished[ev.RequestID.String()] = *ev
+			rawResult.Unlock()
+
 			// Skip downloading the resource if we aren't gathering them
 			if !*rawResult.TaskSummary.TaskWrapper.SanitizedTask.DS.AllResources {
 				break
 			}
 
 			rawResult.Lock()
-			if _, ok := rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()]; !ok {
+			requests, ok := rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()]
+			if !ok || len(requests) == 0 {
 				// Skipping downloading a resource we have not seen a request for
 				rawResult.Unlock()
 				break
 			}
+
+			// Skip bodies the task's filters exclude, before they are ever transferred from the browser
+			resourceURL := ""
+			if requests[len(requests)-1].Request != nil {
+				resourceURL = requests[len(requests)-1].Request.URL
+			}
+			resourceType := requests[len(requests)-1].Type
+			mimeType := ""
+			var size int64 = -1
+			if resp, ok := rawResult.DevTools.Network.ResponseReceived[ev.RequestID.String()]; ok && resp.Response != nil {
+				resourceURL = resp.Response.URL
+				resourceType = resp.Type
+				mimeType = resp.Response.MimeType
+				size = contentLength(resp.Response.Headers)
+			}
+			rawResult.Unlock()
+
+			// Large bodies may already have been streamed to disk as they arrived
+			if streamed.has(ev.RequestID.String()) {
+				resourceStreamedCounter += 1
+				break
+			}
+			if !filter.allows(resourceURL, resourceType, mimeType, size) {
+				resourceFilteredCounter += 1
+				break
+			}
+
+			// The body is fetched and written without holding the lock on the raw result, so the
+			// other event handlers can carry on in the meantime
 			resourceDownloadAttemptCounter += 1
 			var respBody []byte
 			err = chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
 				respBody, err = network.GetResponseBody(ev.RequestID).Do(ctxt)
 				return err
 			}))
-			if err == nil {
+			if err == nil && !filter.fits(int64(len(respBody))) {
+				// Without a Content-Length, the body's size is only known once we have it
+				resourceFilteredCounter += 1
+			} else if err == nil {
 				err = ioutil.WriteFile(path.Join(rawResult.TaskSummary.TaskWrapper.TempDir,
 					b.DefaultResourceSubdir, ev.RequestID.String()), respBody, 0644)
 				if err != nil {
@@ -141,8 +194,6 @@ func NetworkLoadingFinished(eventChan chan *network.EventLoadingFinished, rawRes
 					resourceDownloadSuccessCounter += 1
 				}
 			}
-
-			rawResult.Unlock()
 		case <-ctxt.Done(): // Context canceled
 			done = true
 			break
@@ -154,8 +205,96 @@ func NetworkLoadingFinished(eventChan chan *network.EventLoadingFinished, rawRes
 	}
 
 	if *rawResult.TaskSummary.TaskWrapper.SanitizedTask.DS.AllResources {
-		log.Debugf("successfully downloaded %d out of %d resources",
-			resourceDownloadSuccessCounter, resourceDownloadAttemptCounter)
+		log.Debugf("successfully downloaded %d out of %d resources (%d streamed, %d skipped by body filters)",
+			resourceDownloadSuccessCounter, resourceDownloadAttemptCounter, resourceStreamedCounter, resourceFilteredCounter)
+	}
+
+	wg.Done()
+}
+
+// NetworkLoadingFailed is the event handler for the Network.LoadingFailed event
+func NetworkLoadingFailed(eventChan chan *network.EventLoadingFailed, rawResult *b.RawResult,
+	idle *networkIdleTracker, wg *sync.WaitGroup, ctxt context.Context) {
+	done := false
+	for {
+		select {
+		case ev, ok := <-eventChan:
+			if !ok { // Channel closed
+				done = true
+				break
+			}
+
+			idle.requestFinished(ev.RequestID.String())
+
+			rawResult.Lock()
+			rawResult.DevTools.Network.LoadingFailed[ev.RequestID.String()] = *ev
+			rawResult.Unlock()
+		case <-ctxt.Done(): // Context canceled, browser closed
+			done = true
+			break
+		}
+
+		if done {
+			break
+		}
+	}
+
+	wg.Done()
+}
+
+// DebuggerScriptParsed is the event handler for the Debugger.ScriptParsed event
+func DebuggerScriptParsed(eventChan chan *debugger.EventScriptParsed, rawResult *b.RawResult, wg *sync.WaitGroup, ctxt context.Context) {
+	done := false
+	for {
+		select {
+		case ev, ok := <-eventChan:
+			if !ok { // Channel closed
+				done = true
+				break
+			}
+
+			rawResult.Lock()
+			rawResult.DevTools.Debugger.ScriptParsed[ev.ScriptID.String()] = *ev
+			rawResult.Unlock()
+		case <-ctxt.Done(): // Context canceled, browser closed
+			done = true
+			break
+		}
+
+		if done {
+			break
+		}
+	}
+
+	wg.Done()
+}
+
+// CSSStyleSheetAdded is the event handler for the CSS.StyleSheetAdded event
+func CSSStyleSheetAdded(eventChan chan *css.EventStyleSheetAdded, rawResult *b.RawResult, wg *sync.WaitGroup, ctxt context.Context) {
+	done := false
+	for {
+		select {
+		case ev, ok := <-eventChan:
+			if !ok { // Channel closed
+				done = true
+				break
+			}
+
+			if ev.Header == nil {
+				break
+			}
+
+			rawResult.Lock()
+			rawResult.DevTools.Coverage.StyleSheets[ev.Header.StyleSheetID.String()] = *ev.Header
+			rawResult.Unlock()
+		case <-ctxt.Done(): // Context canceled, browser closed
+			done = true
+			break
+		}
+
+		if done {
+			break
+		}
 	}
 
 	wg.Done()
@@ -0,0 +1,122 @@
+package browser
+
+import (
+	"errors"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"time"
+)
+
+// Driver carries out site visits for sanitized tasks, producing a raw result for each. A crawler keeps one
+// driver of each type it needs, so a driver need not be safe for concurrent use.
+type Driver interface {
+	// Visit visits the site for a sanitized task and returns the raw result of the visit
+	Visit(tw *b.TaskWrapper) (*b.RawResult, error)
+
+	// Close frees anything (e.g., a browser) the driver keeps open between visits
+	Close()
+}
+
+// Options for the drivers belonging to a single crawler
+type DriverOptions struct {
+	Pooled       bool // Keep the browser open between visits (see Pool)
+	RecycleAfter int  // Number of visits after which a pooled browser is restarted
+}
+
+// NewDriver creates a new driver of the given type
+func NewDriver(driver b.BrowserDriver, opts DriverOptions) (Driver, error) {
+	switch driver {
+	case b.Chromium:
+		d := &ChromiumDriver{}
+		if opts.Pooled {
+			d.pool = NewPool(opts.RecycleAfter)
+		}
+		return d, nil
+	case b.Stub:
+		return new(StubDriver), nil
+	default:
+		return nil, errors.New("unknown browser driver: " + string(driver))
+	}
+}
+
+// ChromiumDriver visits sites with Chromium (or Chrome) over the DevTools protocol
+type ChromiumDriver struct {
+	pool *Pool           // Browser pool, or nil to launch a new browser for every visit
+	xvfb *VirtualDisplay // Our virtual display, started the first time a task needs it
+}
+
+func (d *ChromiumDriver) Visit(tw *b.TaskWrapper) (*b.RawResult, error) {
+	if tw.SanitizedTask.DisplayMode == b.Xvfb && tw.SanitizedTask.RemoteEndpoint == "" {
+		if d.xvfb != nil {
+			select {
+			case <-d.xvfb.exited:
+				tw.Log.Warn("virtual display exited, starting a new one")
+				d.xvfb = nil
+			default:
+			}
+		}
+		if d.xvfb == nil {
+			xvfb, err := StartVirtualDisplay()
+			if err != nil {
+				return nil, err
+			}
+			d.xvfb = xvfb
+			tw.Log.Debugf("started virtual display %s", xvfb.Display)
+		}
+		tw.Display = d.xvfb.Display
+	}
+
+	if d.pool != nil {
+		return d.pool.Visit(tw)
+	}
+	return VisitPageDevtoolsProtocol(tw)
+}
+
+func (d *ChromiumDriver) Close() {
+	if d.pool != nil {
+		d.pool.Close()
+	}
+	if d.xvfb != nil {
+		d.xvfb.Stop()
+		d.xvfb = nil
+	}
+}
+
+// FailedResult builds the raw result for a task whose site visit could not be carried out at all (e.g.,
+// because the driver returned an error), so that the failure is recorded like any other failed visit
+func FailedResult(tw *b.TaskWrapper, errorCode string, class b.FailureClass, start time.Time) *b.RawResult {
+	tw.Log.Error(errorCode)
+	tw.FailureCode = errorCode
+	tw.FailureClass = class
+
+	return &b.RawResult{
+		CrawlerInfo: b.CrawlerInfo{},
+		TaskSummary: b.TaskSummary{
+			Success:     false,
+			TaskWrapper: tw,
+			TaskTiming: b.TaskTiming{
+				BrowserOpen:  start,
+				BrowserClose: time.Now(),
+			},
+			CompletionReason: b.CompletionFailed,
+			ParentUUID:       tw.SanitizedTask.ParentUUID,
+			Depth:            tw.SanitizedTask.Depth,
+		},
+		DevTools: b.DevToolsRawData{
+			Network: b.DevtoolsNetworkRawData{
+				RequestWillBeSent: make(map[string][]network.EventRequestWillBeSent),
+				ResponseReceived:  make(map[string]network.EventResponseReceived),
+				LoadingFinished:   make(map[string]network.EventLoadingFinished),
+				LoadingFailed:     make(map[string]network.EventLoadingFailed),
+			},
+			Debugger: b.DevToolsDebuggerRawData{
+				ScriptParsed: make(map[string]debugger.EventScriptParsed),
+			},
+			Coverage: b.DevToolsCoverageRawData{
+				StyleSheets: make(map[string]css.StyleSheetHeader),
+			},
+		},
+	}
+}
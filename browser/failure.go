@@ -0,0 +1,43 @@
+package browser
+
+import (
+	"fmt"
+	b "github.com/pmurley/mida/base"
+	"strings"
+)
+
+// mainDocumentFailure returns a failure code and class if the main document of a visit (the response to the
+// navigation with the given loader ID) has an HTTP error status, or "" if it loaded. The raw result must be
+// locked by the caller if event handlers may still be writing to it.
+func mainDocumentFailure(rawResult *b.RawResult, loaderID string) (string, b.FailureClass) {
+	resp, ok := rawResult.DevTools.Network.ResponseReceived[loaderID]
+	if ok && resp.Response != nil && resp.Response.Status >= 400 {
+		return fmt.Sprintf("HTTP %d on main document", resp.Response.Status), b.FailureHTTPError
+	}
+	return "", ""
+}
+
+// classifyNetError maps the error text from a failed navigation (e.g., "net::ERR_NAME_NOT_RESOLVED") to a failure class
+func classifyNetError(text string) b.FailureClass {
+	switch {
+	case strings.Contains(text, "ERR_NAME_NOT_RESOLVED"),
+		strings.Contains(text, "ERR_NAME_RESOLUTION_FAILED"),
+		strings.Contains(text, "ERR_DNS_"):
+		return b.FailureDNS
+	case strings.Contains(text, "ERR_CERT_"),
+		strings.Contains(text, "ERR_SSL_"),
+		strings.Contains(text, "ERR_BAD_SSL_CLIENT_AUTH_CERT"):
+		return b.FailureTLS
+	case strings.Contains(text, "ERR_TIMED_OUT"),
+		strings.Contains(text, "ERR_CONNECTION_TIMED_OUT"):
+		return b.FailureNavigationTimeout
+	case strings.Contains(text, "ERR_CONNECTION_"),
+		strings.Contains(text, "ERR_ADDRESS_UNREACHABLE"),
+		strings.Contains(text, "ERR_ADDRESS_INVALID"),
+		strings.Contains(text, "ERR_EMPTY_RESPONSE"),
+		strings.Contains(text, "ERR_INTERNET_DISCONNECTED"):
+		return b.FailureConnection
+	default:
+		return b.FailureOther
+	}
+}
@@ -0,0 +1,36 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// The browser resolves relative hrefs for us when we read the href property
+const extractLinksExpression = `Array.from(document.querySelectorAll("a[href]"), a => a.href)`
+
+// extractLinks returns the (absolute) targets of all the anchor links in the page's main frame
+func extractLinks(ctxt context.Context) ([]string, error) {
+	var links []string
+	err := chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		result, exception, err := runtime.Evaluate(extractLinksExpression).WithReturnByValue(true).Do(ctxt)
+		if err != nil {
+			return err
+		}
+		if exception != nil {
+			return errors.New("exception while extracting links: " + exception.Text)
+		}
+		if result == nil {
+			return errors.New("no result returned when extracting links")
+		}
+
+		return json.Unmarshal(result.Value, &links)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
@@ -0,0 +1,91 @@
+package browser
+
+import (
+	"context"
+	b "github.com/pmurley/mida/base"
+	"sync"
+	"time"
+)
+
+// networkIdleTracker keeps count of the requests the browser currently has in flight, so we can tell
+// when the network has gone idle. It is fed by the Network domain event handlers, which run in separate
+// goroutines, so a request may be reported finished before it is reported started.
+type networkIdleTracker struct {
+	sync.Mutex
+	inFlight       map[string]bool
+	finished       map[string]bool // Requests which have finished, so a late report of their start is ignored
+	maxConnections int             // The network is idle when no more than this many requests are in flight
+	idleSince      time.Time       // Time at which the network became idle, or zero if it is not idle
+}
+
+func newNetworkIdleTracker(maxConnections int) *networkIdleTracker {
+	return &networkIdleTracker{
+		inFlight:       make(map[string]bool),
+		finished:       make(map[string]bool),
+		maxConnections: maxConnections,
+		idleSince:      time.Now(),
+	}
+}
+
+// requestStarted records a request being sent. Redirects reuse the request ID, so they are only counted once.
+func (t *networkIdleTracker) requestStarted(requestID string) {
+	t.Lock()
+	if !t.finished[requestID] {
+		t.inFlight[requestID] = true
+	}
+	t.update()
+	t.Unlock()
+}
+
+// requestFinished records a request which has either finished loading or failed
+func (t *networkIdleTracker) requestFinished(requestID string) {
+	t.Lock()
+	delete(t.inFlight, requestID)
+	t.finished[requestID] = true
+	t.update()
+	t.Unlock()
+}
+
+// update must be called with the tracker locked
+func (t *networkIdleTracker) update() {
+	if len(t.inFlight) > t.maxConnections {
+		t.idleSince = time.Time{}
+	} else if t.idleSince.IsZero() {
+		t.idleSince = time.Now()
+	}
+}
+
+// waitForIdle returns a channel which receives a value once the network has been idle for idleTime, counting
+// only time after loadTime (so a quiet period before the load event does not count). The polling goroutine
+// exits when the context is canceled.
+func (t *networkIdleTracker) waitForIdle(ctxt context.Context, idleTime time.Duration, loadTime time.Time) <-chan bool {
+	idleChan := make(chan bool, 1)
+
+	go func() {
+		ticker := time.NewTicker(b.DefaultNetworkIdlePollInterval * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Lock()
+				since := t.idleSince
+				t.Unlock()
+				idle := false
+				if !since.IsZero() {
+					if since.Before(loadTime) {
+						since = loadTime
+					}
+					idle = time.Since(since) >= idleTime
+				}
+				if idle {
+					idleChan <- true
+					return
+				}
+			case <-ctxt.Done():
+				return
+			}
+		}
+	}()
+
+	return idleChan
+}
@@ -0,0 +1,56 @@
+package browser
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNetworkIdleTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []string // "+id" for a request starting, "-id" for one finishing
+		inFlight int
+		idle     bool
+	}{
+		{name: "no requests", events: nil, inFlight: 0, idle: true},
+		{name: "started", events: []string{"+1"}, inFlight: 1, idle: false},
+		{name: "started and finished", events: []string{"+1", "-1"}, inFlight: 0, idle: true},
+		{name: "finished before started", events: []string{"-1", "+1"}, inFlight: 0, idle: true},
+		{name: "redirect", events: []string{"+1", "+1", "-1"}, inFlight: 0, idle: true},
+		{name: "one of two finished", events: []string{"+1", "+2", "-2"}, inFlight: 1, idle: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newNetworkIdleTracker(0)
+			for _, event := range test.events {
+				if event[0] == '+' {
+					tracker.requestStarted(event[1:])
+				} else {
+					tracker.requestFinished(event[1:])
+				}
+			}
+			if len(tracker.inFlight) != test.inFlight {
+				t.Errorf("got %d requests in flight, want %d", len(tracker.inFlight), test.inFlight)
+			}
+			if idle := !tracker.idleSince.IsZero(); idle != test.idle {
+				t.Errorf("got idle %v, want %v", idle, test.idle)
+			}
+		})
+	}
+}
+
+func TestNetworkIdleTrackerWaitForIdle(t *testing.T) {
+	tracker := newNetworkIdleTracker(0)
+	tracker.requestFinished("1")
+	tracker.requestStarted("1")
+
+	ctxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case <-tracker.waitForIdle(ctxt, 10*time.Millisecond, time.Now()):
+	case <-ctxt.Done():
+		t.Fatal("network never went idle after a request finished before it started")
+	}
+}
@@ -0,0 +1,114 @@
+package browser
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/chromedp/cdproto/cdp"
+	cdpio "github.com/chromedp/cdproto/io"
+	"github.com/chromedp/cdproto/performance"
+	"github.com/chromedp/cdproto/tracing"
+	"github.com/chromedp/chromedp"
+	b "github.com/pmurley/mida/base"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// startTracing begins recording a Chrome trace, which the browser will hand back to us as a gzipped stream
+func startTracing(ctxt context.Context, categories []string) error {
+	return tracing.Start().
+		WithTraceConfig(&tracing.TraceConfig{IncludedCategories: categories}).
+		WithTransferMode(tracing.TransferModeReturnAsStream).
+		WithStreamCompression(tracing.StreamCompressionGzip).
+		Do(ctxt)
+}
+
+// gatherPerformanceMetrics gets the current performance metrics from the browser. If atLoad is set, they
+// are stored as the metrics for the load event. Otherwise they are stored as the final metrics for the visit.
+func gatherPerformanceMetrics(ctxt context.Context, rawResult *b.RawResult, atLoad bool) error {
+	var metrics []*performance.Metric
+	err := chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		var err error
+		metrics, err = performance.GetMetrics().Do(ctxt)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+
+	rawResult.Lock()
+	if atLoad {
+		rawResult.DevTools.Performance.LoadMetrics = metrics
+	} else {
+		rawResult.DevTools.Performance.FinalMetrics = metrics
+	}
+	rawResult.Unlock()
+
+	return nil
+}
+
+// stopTracing ends the trace started by startTracing, waits for the browser to tell us the trace is complete,
+// and then streams it to the trace file in the task's temporary directory, one chunk at a time.
+func stopTracing(ctxt context.Context, tracingCompleteChan <-chan *tracing.EventTracingComplete, tempDir string) error {
+	err := chromedp.Run(ctxt, tracing.End())
+	if err != nil {
+		return err
+	}
+
+	var ev *tracing.EventTracingComplete
+	select {
+	case ev = <-tracingCompleteChan:
+	case <-ctxt.Done():
+		return errors.New("browser closed before trace was complete")
+	case <-time.After(b.DefaultTraceCompleteTimeout * time.Second):
+		return errors.New("timed out waiting for trace to complete")
+	}
+
+	if ev.Stream == "" {
+		return errors.New("browser did not return a trace stream")
+	}
+
+	f, err := os.Create(path.Join(tempDir, b.DefaultTraceFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return chromedp.Run(ctxt, chromedp.ActionFunc(func(ctxt context.Context) error {
+		return readStream(ctxt, ev.Stream, f, b.DefaultTraceReadChunkSize)
+	}))
+}
+
+// readStream reads a DevTools stream one chunk at a time, writing each chunk to w, and then closes the stream
+func readStream(ctxt context.Context, stream cdpio.StreamHandle, w io.Writer, chunkSize int64) error {
+	defer cdpio.Close(stream).Do(ctxt)
+
+	for {
+		// We execute the read command directly so we can tell whether the chunk is base64-encoded,
+		// which it will be for compressed traces and binary response bodies
+		var res cdpio.ReadReturns
+		err := cdp.Execute(ctxt, cdpio.CommandRead, cdpio.Read(stream).WithSize(chunkSize), &res)
+		if err != nil {
+			return err
+		}
+
+		chunk := []byte(res.Data)
+		if res.Base64encoded {
+			chunk, err = base64.StdEncoding.DecodeString(res.Data)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+
+		if res.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/monitor"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pool keeps a single browser open across many tasks, to avoid paying the cost of launching a browser for
+// each one. Every task is visited in a fresh incognito browser context, which is thrown away afterwards, so
+// no cookies, cache or storage carry over between tasks. A Pool belongs to a single crawler and is not safe
+// for concurrent use.
+type Pool struct {
+	recycleAfter int // Number of tasks after which the browser is restarted (0 to never restart it)
+
+	browserContext context.Context    // Context for the pooled browser, or nil if none is running
+	browserCancel  context.CancelFunc // Cancels the context for the pooled browser
+	allocCancel    context.CancelFunc // Kills the pooled browser
+	launchKey      string             // Identifies the binary, display and flags the pooled browser was launched with
+	userDataDir    string             // User data directory for the pooled browser
+	visits         int                // Number of tasks visited since the browser was launched
+}
+
+// NewPool creates a new (empty) browser pool. The browser is launched for the first task visited.
+func NewPool(recycleAfter int) *Pool {
+	return &Pool{recycleAfter: recycleAfter}
+}
+
+// Visit visits a task in the pooled browser, launching or recycling the browser first if needed. Tasks which
+// use a profile need a browser with their own user data directory, so they get a browser of their own instead,
+// and tasks which connect to a remote browser do not launch one at all.
+func (p *Pool) Visit(tw *b.TaskWrapper) (*b.RawResult, error) {
+	if tw.SanitizedTask.ProfilePath != "" || tw.SanitizedTask.ArchiveProfile || tw.SanitizedTask.RemoteEndpoint != "" {
+		return VisitPageDevtoolsProtocol(tw)
+	}
+
+	key := tw.SanitizedTask.BrowserBinaryPath + "\x00" + tw.Display + "\x00" +
+		strings.Join(tw.SanitizedTask.BrowserFlags, "\x00")
+	if p.browserContext != nil {
+		if p.browserContext.Err() != nil {
+			tw.Log.Warn("pooled browser has crashed or closed, launching a new one")
+			p.Close()
+		} else if key != p.launchKey {
+			tw.Log.Debug("task uses different browser settings, launching a new pooled browser")
+			p.Close()
+		} else if p.recycleAfter > 0 && p.visits >= p.recycleAfter {
+			tw.Log.Debugf("recycling pooled browser after %d tasks", p.visits)
+			p.Close()
+		}
+	}
+
+	if p.browserContext == nil {
+		err := p.launch(tw, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.visits += 1
+
+	// A hung visit takes the whole pooled browser down with it
+	wd := startWatchdog(tw, p.userDataDir, p.allocCancel)
+	rawResult, clean, err := visitIncognito(p.browserContext, tw)
+	killed := wd.stop()
+	if err != nil || !clean || killed {
+		// Start over with a new browser rather than risk anything leaking into the next task
+		p.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if killed {
+		setKilled(rawResult)
+	}
+
+	setBrowserClose(rawResult)
+	tw.Log.Debug("site visit concluded")
+
+	return rawResult, nil
+}
+
+// visitIncognito visits a task in a new tab within a fresh incognito browser context of an already running
+// browser, and then disposes of the browser context, throwing away everything the task left behind. The
+// returned bool is false if the browser context could not be created or disposed of, in which case the
+// browser should not be trusted with further tasks.
+func visitIncognito(browserContext context.Context, tw *b.TaskWrapper) (*b.RawResult, bool, error) {
+	// Create an incognito browser context for this task, along with a tab to visit the site in
+	var browserContextID cdp.BrowserContextID
+	var targetID target.ID
+	err := chromedp.Run(browserContext, chromedp.ActionFunc(func(ctxt context.Context) error {
+		browserExecutor := cdp.WithExecutor(ctxt, chromedp.FromContext(ctxt).Browser)
+
+		var err error
+		browserContextID, err = target.CreateBrowserContext().Do(browserExecutor)
+		if err != nil {
+			return err
+		}
+
+		targetID, err = target.CreateTarget("about:blank").WithBrowserContextID(browserContextID).Do(browserExecutor)
+		return err
+	}))
+	if err != nil {
+		return nil, false, errors.New("failed to create browser context: " + err.Error())
+	}
+
+	tabContext, tabCancel := chromedp.NewContext(browserContext, chromedp.WithTargetID(targetID))
+	rawResult, err := visitTask(tabContext, tw)
+	tabCancel()
+
+	clean := browserContext.Err() == nil
+	if clean {
+		disposeErr := chromedp.Run(browserContext, chromedp.ActionFunc(func(ctxt context.Context) error {
+			return target.DisposeBrowserContext(browserContextID).Do(
+				cdp.WithExecutor(ctxt, chromedp.FromContext(ctxt).Browser))
+		}))
+		if disposeErr != nil {
+			tw.Log.Errorf("failed to dispose of browser context: %s", disposeErr.Error())
+			clean = false
+		}
+	}
+
+	return rawResult, clean, err
+}
+
+// Close shuts down the pooled browser, if there is one, and removes its user data directory
+func (p *Pool) Close() {
+	if p.browserContext == nil {
+		return
+	}
+
+	closeContext, closeCancel := context.WithTimeout(p.browserContext, 5*time.Second)
+	_ = chromedp.Cancel(closeContext)
+	closeCancel()
+	p.browserCancel()
+	p.allocCancel()
+	if killed := killBrowser(p.userDataDir); killed > 0 {
+		log.Log.Warnf("killed %d pooled browser processes still running after the browser was closed", killed)
+		monitor.BrowserWatchdogEvents.WithLabelValues(monitor.WatchdogLeftoverKill).Inc()
+	}
+	_ = os.RemoveAll(p.userDataDir)
+
+	p.browserContext = nil
+	p.browserCancel = nil
+	p.allocCancel = nil
+	p.launchKey = ""
+	p.userDataDir = ""
+	p.visits = 0
+}
+
+// launch starts a new pooled browser using the browser settings of the given task
+func (p *Pool) launch(tw *b.TaskWrapper, key string) error {
+	err := os.MkdirAll(b.RunTempDir, 0755)
+	if err != nil {
+		return err
+	}
+	userDataDir, err := ioutil.TempDir(b.RunTempDir, "pool-")
+	if err != nil {
+		return errors.New("failed to create user data directory for pooled browser: " + err.Error())
+	}
+
+	allocContext, allocCancel := chromedp.NewExecAllocator(context.Background(), allocatorOptions(tw, userDataDir)...)
+	browserContext, browserCancel := chromedp.NewContext(allocContext)
+
+	// Running no actions is enough to launch the browser
+	err = chromedp.Run(browserContext)
+	if err != nil {
+		browserCancel()
+		allocCancel()
+		_ = os.RemoveAll(userDataDir)
+		return errors.New("failed to launch pooled browser: " + err.Error())
+	}
+
+	p.browserContext = browserContext
+	p.browserCancel = browserCancel
+	p.allocCancel = allocCancel
+	p.launchKey = key
+	p.userDataDir = userDataDir
+	p.visits = 0
+
+	tw.Log.Debug("launched new pooled browser")
+
+	return nil
+}
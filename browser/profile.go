@@ -0,0 +1,157 @@
+package browser
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// profileLocks serializes visits which persist the same profile, so that each visit starts from the
+// profile saved by the one before it, rather than racing it to overwrite the template
+var profileLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// profileLock returns the lock for the profile template at the given path
+func profileLock(profilePath string) *sync.Mutex {
+	profileLocks.Lock()
+	defer profileLocks.Unlock()
+
+	l, ok := profileLocks.m[profilePath]
+	if !ok {
+		l = new(sync.Mutex)
+		profileLocks.m[profilePath] = l
+	}
+
+	return l
+}
+
+// copyProfile copies a profile template into the user data directory for a visit. A template
+// which does not exist yet (because it will be created by persisting this visit) is not an error.
+func copyProfile(profilePath string, userDataDir string) error {
+	if _, err := os.Stat(profilePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	return copyDir(profilePath, userDataDir)
+}
+
+// persistProfile saves the user data directory from a visit as the new profile template. The copy is
+// made alongside the template and then swapped in, so a failed copy leaves the old template intact.
+func persistProfile(userDataDir string, profilePath string) error {
+	err := os.MkdirAll(filepath.Dir(profilePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := profilePath + ".tmp"
+	err = os.RemoveAll(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = copyDir(userDataDir, tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+
+	err = os.RemoveAll(profilePath)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, profilePath)
+}
+
+// archiveProfile writes the user data directory from a visit to a gzipped tar file
+func archiveProfile(userDataDir string, archivePath string) error {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	return filepath.Walk(userDataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == userDataDir || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(userDataDir, p)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
+
+// copyDir recursively copies the directories and regular files in src to dst. Anything else (in particular,
+// the symlinks Chrome uses as singleton locks on its user data directory) is skipped.
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
@@ -0,0 +1,91 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/chromedp/chromedp"
+	b "github.com/pmurley/mida/base"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// visitRemote visits a task in an already-running browser, reached through its DevTools endpoint. The browser
+// belongs to someone else, so rather than closing it afterwards, we visit the task in a fresh incognito
+// browser context and then simply disconnect.
+func visitRemote(tw *b.TaskWrapper) (*b.RawResult, error) {
+	wsURL, err := remoteWebSocketURL(tw.SanitizedTask.RemoteEndpoint)
+	if err != nil {
+		return nil, errors.New("failed to resolve remote browser endpoint: " + err.Error())
+	}
+
+	allocContext, allocCancel := chromedp.NewRemoteAllocator(context.Background(), wsURL)
+	defer allocCancel()
+	browserContext, browserCancel := chromedp.NewContext(allocContext)
+	defer browserCancel()
+
+	// Running no actions is enough to connect to the browser
+	err = chromedp.Run(browserContext)
+	if err != nil {
+		return nil, errors.New("failed to connect to remote browser: " + err.Error())
+	}
+	tw.Log.Debugf("connected to remote browser at %s", wsURL)
+
+	// The remote browser is not ours to kill, but we can at least stop waiting on it
+	wd := startWatchdog(tw, "", browserCancel)
+	rawResult, clean, err := visitIncognito(browserContext, tw)
+	killed := wd.stop()
+	if !clean {
+		tw.Log.Warn("remote browser may not have been left in a clean state")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if killed {
+		setKilled(rawResult)
+	}
+
+	setBrowserClose(rawResult)
+	tw.Log.Debug("site visit concluded")
+
+	return rawResult, nil
+}
+
+// remoteWebSocketURL resolves a DevTools endpoint to the WebSocket URL of the browser. WebSocket endpoints
+// are used as they are, while HTTP endpoints (e.g., "http://localhost:9222") are looked up using /json/version.
+func remoteWebSocketURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		return endpoint, nil
+	}
+
+	u.Path = "/json/version"
+	client := http.Client{Timeout: b.DefaultRemoteBrowserTimeout * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected response from " + u.String() + ": " + resp.Status)
+	}
+
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	if err != nil {
+		return "", err
+	}
+	if version.WebSocketDebuggerURL == "" {
+		return "", errors.New("browser did not report a WebSocket debugger URL")
+	}
+
+	return version.WebSocketDebuggerURL, nil
+}
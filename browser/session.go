@@ -0,0 +1,108 @@
+package browser
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/tracing"
+	b "github.com/pmurley/mida/base"
+	"path"
+	"sync"
+)
+
+// eventRouter receives every DevTools event from the browser and forwards it to the event channels of
+// the step currently being visited. A browser is listened to for its entire lifetime, but each step of
+// a session task gathers its own raw result, so the channels are swapped out between steps.
+type eventRouter struct {
+	sync.Mutex
+	ec *EventChannels // Channels for the current step, or nil to drop events between steps
+}
+
+func (r *eventRouter) setChannels(ec *EventChannels) {
+	r.Lock()
+	r.ec = ec
+	r.Unlock()
+}
+
+// route forwards an event to the current step's handlers. A send never outlasts the step it was meant
+// for: once the step finishes its handlers stop draining their channels, so a send which would block is
+// given up, rather than holding up the browser's listener (and every event after this one) forever.
+func (r *eventRouter) route(ev interface{}) {
+	r.Lock()
+	ec := r.ec
+	r.Unlock()
+
+	if ec == nil {
+		return
+	}
+
+	switch ev.(type) {
+	case *page.EventLoadEventFired:
+		select {
+		case ec.loadEventFiredChan <- ev.(*page.EventLoadEventFired):
+		case <-ec.done:
+		}
+	case *network.EventRequestWillBeSent:
+		select {
+		case ec.requestWillBeSentChan <- ev.(*network.EventRequestWillBeSent):
+		case <-ec.done:
+		}
+	case *network.EventResponseReceived:
+		select {
+		case ec.responseReceivedChan <- ev.(*network.EventResponseReceived):
+		case <-ec.done:
+		}
+		ec.streamEvent(ev)
+	case *network.EventDataReceived:
+		ec.streamEvent(ev)
+	case *network.EventLoadingFinished:
+		// When bodies are streamed, the stream handler passes these on once it has finished with them
+		if ec.bodyStreamChan != nil {
+			ec.streamEvent(ev)
+		} else {
+			select {
+			case ec.loadingFinishedChan <- ev.(*network.EventLoadingFinished):
+			case <-ec.done:
+			}
+		}
+	case *network.EventLoadingFailed:
+		select {
+		case ec.loadingFailedChan <- ev.(*network.EventLoadingFailed):
+		case <-ec.done:
+		}
+		ec.streamEvent(ev)
+	case *debugger.EventScriptParsed:
+		select {
+		case ec.scriptParsedChan <- ev.(*debugger.EventScriptParsed):
+		case <-ec.done:
+		}
+	case *css.EventStyleSheetAdded:
+		select {
+		case ec.styleSheetAddedChan <- ev.(*css.EventStyleSheetAdded):
+		case <-ec.done:
+		}
+	case *tracing.EventTracingComplete:
+		// Nothing reads this channel unless the step is tracing, so the event is dropped if it is full
+		select {
+		case ec.tracingCompleteChan <- ev.(*tracing.EventTracingComplete):
+		default:
+		}
+	}
+}
+
+// sessionStepWrapper builds the task wrapper for one step of a session task. It shares the task's UUID,
+// log and settings, but has the step's own URL and completion settings, and a temporary directory
+// of its own within the task's temporary directory.
+func sessionStepWrapper(tw *b.TaskWrapper, index int, step b.SanitizedSessionStep) *b.TaskWrapper {
+	stepWrapper := *tw
+	stepWrapper.SanitizedTask.URL = step.URL
+	stepWrapper.SanitizedTask.CS = step.CS
+	stepWrapper.SanitizedTask.Session = nil
+	stepWrapper.Step = index
+	stepWrapper.TempDir = path.Join(tw.TempDir, fmt.Sprintf(b.DefaultSessionStepSubdir, index))
+	stepWrapper.FailureCode = ""
+
+	return &stepWrapper
+}
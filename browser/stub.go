@@ -0,0 +1,147 @@
+package browser
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	b "github.com/pmurley/mida/base"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// StubDriver "visits" a site by replaying a recording of DevTools events from a file, without a browser.
+// Replays are deterministic, which makes the stub driver useful for exercising the rest of the pipeline.
+// Only the events MIDA records are replayed -- anything which would need to be requested from a live
+// browser (response bodies, coverage, performance metrics and traces) is left empty.
+type StubDriver struct{}
+
+func (d *StubDriver) Visit(tw *b.TaskWrapper) (*b.RawResult, error) {
+	data, err := ioutil.ReadFile(tw.SanitizedTask.ReplayFile)
+	if err != nil {
+		return nil, errors.New("failed to read replay file: " + err.Error())
+	}
+
+	var recording b.StubRecording
+	err = json.Unmarshal(data, &recording)
+	if err != nil {
+		return nil, errors.New("failed to parse replay file: " + err.Error())
+	}
+
+	rawResult := b.RawResult{
+		CrawlerInfo: b.CrawlerInfo{},
+		TaskSummary: b.TaskSummary{
+			Success:     false,
+			TaskWrapper: tw,
+			TaskTiming:  b.TaskTiming{},
+			ParentUUID:  tw.SanitizedTask.ParentUUID,
+			Depth:       tw.SanitizedTask.Depth,
+		},
+		DevTools: b.DevToolsRawData{
+			Network: b.DevtoolsNetworkRawData{
+				RequestWillBeSent: make(map[string][]network.EventRequestWillBeSent),
+				ResponseReceived:  make(map[string]network.EventResponseReceived),
+				LoadingFinished:   make(map[string]network.EventLoadingFinished),
+				LoadingFailed:     make(map[string]network.EventLoadingFailed),
+			},
+			Debugger: b.DevToolsDebuggerRawData{
+				ScriptParsed: make(map[string]debugger.EventScriptParsed),
+			},
+			Coverage: b.DevToolsCoverageRawData{
+				StyleSheets: make(map[string]css.StyleSheetHeader),
+			},
+		},
+	}
+	rawResult.TaskSummary.TaskTiming.BrowserOpen = time.Now()
+
+	if len(tw.SanitizedTask.Session) > 0 {
+		tw.Log.Warn("the stub driver does not replay session steps")
+	}
+
+	// We have no bodies to save, but storage expects the same layout as a real visit
+	if *tw.SanitizedTask.DS.AllResources {
+		err = os.MkdirAll(path.Join(tw.TempDir, b.DefaultResourceSubdir), 0744)
+		if err != nil {
+			return nil, errors.New("failed to create resource subdir: " + err.Error())
+		}
+	}
+
+	if recording.FailureCode != "" {
+		tw.Log.Error(recording.FailureCode)
+		rawResult.TaskSummary.TaskWrapper.FailureCode = recording.FailureCode
+		rawResult.TaskSummary.TaskWrapper.FailureClass = classifyNetError(recording.FailureCode)
+		rawResult.TaskSummary.CompletionReason = b.CompletionFailed
+		rawResult.TaskSummary.TaskTiming.BrowserClose = time.Now()
+		return &rawResult, nil
+	}
+	rawResult.TaskSummary.TaskTiming.ConnectionEstablished = time.Now()
+
+	loaderID := "" // Loader ID of the navigation to the page, which the first document request belongs to
+	for i, rawEvent := range recording.Events {
+		var msg cdproto.Message
+		err = json.Unmarshal(rawEvent, &msg)
+		if err != nil {
+			return nil, errors.New("failed to parse replay event: " + err.Error())
+		}
+
+		ev, err := cdproto.UnmarshalMessage(&msg)
+		if err != nil {
+			// Recordings may contain events MIDA doesn't know about, which a browser would have sent anyway
+			tw.Log.Debugf("skipping unknown replay event %d (%s)", i, msg.Method)
+			continue
+		}
+
+		if req, ok := ev.(*network.EventRequestWillBeSent); ok && loaderID == "" && req.Type == network.ResourceTypeDocument {
+			loaderID = req.LoaderID.String()
+		}
+		replayEvent(&rawResult, ev)
+	}
+
+	if tw.Step == 0 && tw.SanitizedTask.Depth < *tw.SanitizedTask.CrawlS.MaxDepth {
+		rawResult.Links = recording.Links
+	}
+
+	// Just as for a real browser, a visit is only a success if the page actually loaded
+	rawResult.TaskSummary.CompletionReason = b.CompletionConditionMet
+	if code, class := mainDocumentFailure(&rawResult, loaderID); code != "" {
+		tw.FailureCode, tw.FailureClass = code, class
+	}
+	rawResult.TaskSummary.Success = tw.FailureCode == ""
+	rawResult.TaskSummary.TaskTiming.BrowserClose = time.Now()
+	tw.Log.Debugf("replayed %d events from %s", len(recording.Events), tw.SanitizedTask.ReplayFile)
+	if tw.FailureCode != "" {
+		tw.Log.Error(tw.FailureCode)
+	}
+
+	return &rawResult, nil
+}
+
+func (d *StubDriver) Close() {}
+
+// replayEvent records a single event in a raw result, just as the corresponding DevTools event handler would
+func replayEvent(rawResult *b.RawResult, ev interface{}) {
+	switch ev := ev.(type) {
+	case *page.EventLoadEventFired:
+		rawResult.TaskSummary.TaskTiming.LoadEvent = time.Now()
+	case *network.EventRequestWillBeSent:
+		rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()] = append(
+			rawResult.DevTools.Network.RequestWillBeSent[ev.RequestID.String()], *ev)
+	case *network.EventResponseReceived:
+		rawResult.DevTools.Network.ResponseReceived[ev.RequestID.String()] = *ev
+	case *network.EventLoadingFinished:
+		rawResult.DevTools.Network.LoadingFinished[ev.RequestID.String()] = *ev
+	case *network.EventLoadingFailed:
+		rawResult.DevTools.Network.LoadingFailed[ev.RequestID.String()] = *ev
+	case *debugger.EventScriptParsed:
+		rawResult.DevTools.Debugger.ScriptParsed[ev.ScriptID.String()] = *ev
+	case *css.EventStyleSheetAdded:
+		if ev.Header != nil {
+			rawResult.DevTools.Coverage.StyleSheets[ev.Header.StyleSheetID.String()] = *ev.Header
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package browser
+
+import (
+	"bytes"
+	"context"
+	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/monitor"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// watchdog enforces a hard deadline on a site visit. If the visit is still going at the deadline, the watchdog
+// kills the browser along with every process it started, and then cancels the contexts belonging to the visit.
+type watchdog struct {
+	timer *time.Timer
+	fired int32 // Set to 1 (atomically) once the deadline has passed
+}
+
+// startWatchdog starts a watchdog for a visit to the given task. The browser's processes are identified by its user
+// data directory, which is empty if the browser is not ours to kill (e.g., a remote browser). cancel should cancel
+// every context belonging to the visit.
+func startWatchdog(tw *b.TaskWrapper, userDataDir string, cancel context.CancelFunc) *watchdog {
+	w := new(watchdog)
+	deadline := visitDeadline(tw)
+	w.timer = time.AfterFunc(deadline, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		tw.Log.Errorf("site visit still running after its hard deadline (%s), abandoning it", deadline)
+		monitor.BrowserWatchdogEvents.WithLabelValues(monitor.WatchdogDeadlineKill).Inc()
+
+		if userDataDir != "" {
+			killed := killBrowser(userDataDir)
+			tw.Log.Debugf("watchdog killed %d browser processes", killed)
+		}
+		cancel()
+	})
+
+	return w
+}
+
+// stop stops the watchdog, returning true if the deadline had already passed
+func (w *watchdog) stop() bool {
+	w.timer.Stop()
+	return atomic.LoadInt32(&w.fired) == 1
+}
+
+// visitDeadline is the longest a visit to the given task (including any session steps) could legitimately take
+func visitDeadline(tw *b.TaskWrapper) time.Duration {
+	steps := []b.CompletionSettings{tw.SanitizedTask.CS}
+	for _, step := range tw.SanitizedTask.Session {
+		steps = append(steps, step.CS)
+	}
+
+	seconds := b.DefaultWatchdogGrace
+	for _, cs := range steps {
+		seconds += b.DefaultNavTimeout + *cs.Timeout
+		if cs.GracePeriod != nil {
+			seconds += *cs.GracePeriod
+		}
+		if *tw.SanitizedTask.DS.Trace {
+			seconds += b.DefaultTraceCompleteTimeout
+		}
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// reapBrowser kills anything left running by a browser which should already have exited. Renderer and GPU
+// processes do not always die with the browser itself.
+func reapBrowser(tw *b.TaskWrapper, userDataDir string) {
+	killed := killBrowser(userDataDir)
+	if killed > 0 {
+		tw.Log.Warnf("killed %d browser processes still running after the browser was closed", killed)
+		monitor.BrowserWatchdogEvents.WithLabelValues(monitor.WatchdogLeftoverKill).Inc()
+	}
+}
+
+// ClaimRunTempDir creates the temporary directory for this run of MIDA (see base.RunTempDir) and records that it
+// belongs to this process, so that other instances of MIDA sharing the working directory leave its browsers alone.
+// It must be called before any browsers are launched.
+func ClaimRunTempDir(runTempDir string) error {
+	err := os.MkdirAll(runTempDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	self := os.Getpid()
+	owner := strconv.Itoa(self) + " " + processStartTime(self)
+	return ioutil.WriteFile(filepath.Join(runTempDir, b.DefaultRunOwnerFile), []byte(owner), 0644)
+}
+
+// ReapOrphans kills any browsers (and their child processes) left behind by earlier runs of MIDA which did not
+// exit cleanly: those whose user data directories are within the temporary directory of a run (see
+// ClaimRunTempDir) whose MIDA process is no longer running. Browsers belonging to runs of MIDA which are still
+// going, or which we can't attribute to any run, are left alone. It returns the number of browsers killed.
+func ReapOrphans(tempDir string) int {
+	tempDir, err := filepath.Abs(tempDir)
+	if err != nil {
+		return 0
+	}
+
+	procs := listProcesses()
+	orphans := make(map[int]bool)
+	runsEnded := make(map[string]bool) // Whether each run we have seen a browser for has ended
+	for _, p := range procs {
+		udd := userDataDirArg(p.args)
+		if udd == "" {
+			continue
+		}
+		if !filepath.IsAbs(udd) {
+			cwd, err := os.Readlink("/proc/" + strconv.Itoa(p.pid) + "/cwd")
+			if err != nil {
+				continue
+			}
+			udd = filepath.Join(cwd, udd)
+		}
+		if !strings.HasPrefix(udd, tempDir+string(filepath.Separator)) {
+			continue
+		}
+
+		run := strings.SplitN(strings.TrimPrefix(udd, tempDir+string(filepath.Separator)), string(filepath.Separator), 2)[0]
+		ended, ok := runsEnded[run]
+		if !ok {
+			ended = runEnded(filepath.Join(tempDir, run))
+			runsEnded[run] = ended
+		}
+		if ended {
+			orphans[p.pid] = true
+		}
+	}
+
+	var roots []int
+	browsers := 0
+	for _, p := range procs {
+		if orphans[p.pid] {
+			roots = append(roots, p.pid)
+			if !orphans[p.ppid] {
+				browsers += 1
+			}
+		}
+	}
+	if browsers == 0 {
+		return 0
+	}
+
+	killProcesses(procs, roots)
+	monitor.BrowserWatchdogEvents.WithLabelValues(monitor.WatchdogOrphanKill).Add(float64(browsers))
+
+	return browsers
+}
+
+// runEnded returns true if the MIDA process which owned the given run temporary directory is no longer running.
+// The owner is recorded with its start time, so a new process which happens to reuse its PID is not mistaken for
+// it. A directory with no owner (e.g., one which is not a run directory at all) is never considered ended.
+func runEnded(runTempDir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(runTempDir, b.DefaultRunOwnerFile))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false
+	}
+
+	return processStartTime(pid) != fields[1]
+}
+
+// processStartTime returns the time at which a process started (in clock ticks after boot), or "" if it is not
+// running or we can't tell
+func processStartTime(pid int) string {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	// The command name is in parentheses and may itself contain spaces or parentheses. The start time is
+	// the 22nd field, and so the 20th after the command name.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return ""
+	}
+	fields := strings.Fields(string(stat[i+2:]))
+	if len(fields) < 20 {
+		return ""
+	}
+
+	return fields[19]
+}
+
+// A process running on this machine, as read from /proc
+type process struct {
+	pid   int
+	ppid  int
+	state byte     // Process state (e.g., 'Z' for a zombie)
+	args  []string // Command line
+}
+
+// listProcesses reads the processes running on this machine from /proc. Elsewhere than Linux, we have no
+// portable way of listing processes, so nothing is returned, and the watchdog can only cancel contexts.
+func listProcesses() []process {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var procs []process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Processes may exit while we read them, so we just skip any we can't read
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name is in parentheses and may itself contain spaces or parentheses
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 || i+2 >= len(stat) {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+2:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile("/proc/" + entry.Name() + "/cmdline")
+		if err != nil {
+			continue
+		}
+
+		procs = append(procs, process{
+			pid:   pid,
+			ppid:  ppid,
+			state: fields[0][0],
+			args:  strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"),
+		})
+	}
+
+	return procs
+}
+
+// userDataDirArg returns the user data directory from a browser's command line, or "" if there isn't one
+func userDataDirArg(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--user-data-dir=") {
+			return strings.TrimPrefix(arg, "--user-data-dir=")
+		}
+	}
+	return ""
+}
+
+// killBrowser kills every process using the given user data directory, along with all of their descendants,
+// returning the number of processes killed
+func killBrowser(userDataDir string) int {
+	procs := listProcesses()
+	var roots []int
+	for _, p := range procs {
+		if userDataDirArg(p.args) == userDataDir {
+			roots = append(roots, p.pid)
+		}
+	}
+	if len(roots) == 0 {
+		return 0
+	}
+
+	return killProcesses(procs, roots)
+}
+
+// killProcesses kills the given processes and all of their descendants, returning the number of processes killed
+func killProcesses(procs []process, roots []int) int {
+	children := make(map[int][]int)
+	for _, p := range procs {
+		children[p.ppid] = append(children[p.ppid], p.pid)
+	}
+
+	self := os.Getpid()
+	seen := make(map[int]bool)
+	queue := append([]int{}, roots...)
+	var killed []int
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if seen[pid] || pid == self {
+			continue
+		}
+		seen[pid] = true
+		queue = append(queue, children[pid]...)
+
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if proc.Kill() == nil {
+			killed = append(killed, pid)
+		}
+	}
+
+	isRoot := make(map[int]bool)
+	for _, pid := range roots {
+		isRoot[pid] = true
+	}
+	go reapZombies(killed, isRoot)
+
+	return len(killed)
+}
+
+// reapZombies waits on any of the given (killed) processes which have become zombie children of MIDA. When
+// MIDA runs as PID 1 in a container, browser processes whose parents die are re-parented to MIDA, and nothing
+// else will ever wait on them. Browsers we launched ourselves (the roots) are left for chromedp to wait on.
+func reapZombies(pids []int, skip map[int]bool) {
+	// Give the killed processes time to die, and their children time to be re-parented
+	time.Sleep(time.Second)
+
+	wanted := make(map[int]bool)
+	for _, pid := range pids {
+		if !skip[pid] {
+			wanted[pid] = true
+		}
+	}
+
+	self := os.Getpid()
+	for _, p := range listProcesses() {
+		if !wanted[p.pid] || p.ppid != self || p.state != 'Z' {
+			continue
+		}
+		proc, err := os.FindProcess(p.pid)
+		if err != nil {
+			continue
+		}
+		_, _ = proc.Wait()
+	}
+}
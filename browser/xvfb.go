@@ -0,0 +1,82 @@
+package browser
+
+import (
+	"bufio"
+	"errors"
+	b "github.com/pmurley/mida/base"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VirtualDisplay is an Xvfb server run by MIDA, so that a crawler can run a headful browser on a machine
+// without a display. Each crawler runs its own, so their browsers never share a display.
+type VirtualDisplay struct {
+	Display string // The X display (e.g., ":99") browsers should use
+	cmd     *exec.Cmd
+	exited  chan struct{} // Closed when the Xvfb process exits
+}
+
+// StartVirtualDisplay starts an Xvfb server on a free display, waiting until it is ready for use. Xvfb picks
+// the display itself (-displayfd), skipping any in use by other X servers (including those of other instances
+// of MIDA), and only reports it once it is listening for connections.
+func StartVirtualDisplay() (*VirtualDisplay, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.New("failed to create pipe for Xvfb: " + err.Error())
+	}
+	defer r.Close()
+
+	// The write end of the pipe becomes file descriptor 3 in Xvfb
+	cmd := exec.Command("Xvfb", "-displayfd", "3", "-ac", "-screen", "0", b.DefaultXvfbScreen, "-nolisten", "tcp")
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, errors.New("failed to start Xvfb: " + err.Error())
+	}
+
+	vd := &VirtualDisplay{
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		_ = cmd.Wait()
+		close(vd.exited)
+	}()
+
+	// Xvfb writes the display number, followed by a newline, once it is ready. If it exits first, the read
+	// fails, since Xvfb held the only other copy of the write end of the pipe.
+	numberChan := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		numberChan <- strings.TrimSpace(line)
+	}()
+
+	select {
+	case number := <-numberChan:
+		if _, err := strconv.Atoi(number); err != nil {
+			vd.Stop()
+			return nil, errors.New("Xvfb exited or failed to report a display while starting")
+		}
+		vd.Display = ":" + number
+		return vd, nil
+	case <-time.After(b.DefaultXvfbStartTimeout * time.Second):
+		vd.Stop()
+		return nil, errors.New("timed out waiting for Xvfb to start")
+	}
+}
+
+// Stop shuts down the Xvfb server, killing it if it does not exit promptly
+func (vd *VirtualDisplay) Stop() {
+	_ = vd.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-vd.exited:
+	case <-time.After(5 * time.Second):
+		_ = vd.cmd.Process.Kill()
+		<-vd.exited
+	}
+}
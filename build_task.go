@@ -77,6 +77,40 @@ func BuildCompressedTaskSet(cmd *cobra.Command, args []string) (*b.CompressedTas
 	if err != nil {
 		return nil, err
 	}
+	*ts.Browser.Profile.Name, err = cmd.Flags().GetString("profile")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.Profile.Directory, err = cmd.Flags().GetString("profile-dir")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.Profile.Persist, err = cmd.Flags().GetBool("persist-profile")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.Profile.Archive, err = cmd.Flags().GetBool("archive-profile")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.RemoteEndpoint, err = cmd.Flags().GetString("remote-browser")
+	if err != nil {
+		return nil, err
+	}
+	driverString, err := cmd.Flags().GetString("driver")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.Driver = b.BrowserDriver(driverString)
+	*ts.Browser.ReplayFile, err = cmd.Flags().GetString("replay-file")
+	if err != nil {
+		return nil, err
+	}
+	displayModeString, err := cmd.Flags().GetString("display")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Browser.DisplayMode = b.DisplayMode(displayModeString)
 
 	*ts.Completion.Timeout, err = cmd.Flags().GetInt("timeout")
 	if err != nil {
@@ -86,6 +120,30 @@ func BuildCompressedTaskSet(cmd *cobra.Command, args []string) (*b.CompressedTas
 	if err != nil {
 		return nil, err
 	}
+	*ts.Completion.NetworkIdleConnections, err = cmd.Flags().GetInt("network-idle-connections")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Completion.NetworkIdleTime, err = cmd.Flags().GetInt("network-idle-time")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Completion.Selector, err = cmd.Flags().GetString("selector")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Completion.Expression, err = cmd.Flags().GetString("expression")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Completion.PollInterval, err = cmd.Flags().GetInt("poll-interval")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Completion.GracePeriod, err = cmd.Flags().GetInt("grace-period")
+	if err != nil {
+		return nil, err
+	}
 	CCString, err := cmd.Flags().GetString("completion")
 	if err != nil {
 		return nil, err
@@ -100,6 +158,122 @@ func BuildCompressedTaskSet(cmd *cobra.Command, args []string) (*b.CompressedTas
 	if err != nil {
 		return nil, err
 	}
+	*ts.Data.HAR, err = cmd.Flags().GetBool("har")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.HARBodies, err = cmd.Flags().GetBool("har-bodies")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.ContentAddressed, err = cmd.Flags().GetBool("content-addressed")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.Coverage, err = cmd.Flags().GetBool("coverage")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.PerformanceMetrics, err = cmd.Flags().GetBool("performance-metrics")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.Trace, err = cmd.Flags().GetBool("trace")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.TraceCategories, err = cmd.Flags().GetStringSlice("trace-categories")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.BodyAllowTypes, err = cmd.Flags().GetStringSlice("body-types")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.BodyDenyTypes, err = cmd.Flags().GetStringSlice("body-exclude-types")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.BodyMaxSize, err = cmd.Flags().GetInt("body-max-size")
+	if err != nil {
+		return nil, err
+	}
+	bodyParty, err := cmd.Flags().GetString("body-party")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.BodyParty = b.BodyParty(bodyParty)
+	*ts.Data.BodyURLInclude, err = cmd.Flags().GetStringSlice("body-url-include")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.BodyURLExclude, err = cmd.Flags().GetStringSlice("body-url-exclude")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Data.StreamBodyThreshold, err = cmd.Flags().GetInt("stream-bodies-over")
+	if err != nil {
+		return nil, err
+	}
+
+	*ts.Crawl.MaxDepth, err = cmd.Flags().GetInt("crawl-depth")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Crawl.SameSite, err = cmd.Flags().GetBool("crawl-same-site")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Crawl.IncludeRegex, err = cmd.Flags().GetStringSlice("crawl-include")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Crawl.ExcludeRegex, err = cmd.Flags().GetStringSlice("crawl-exclude")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Crawl.MaxLinks, err = cmd.Flags().GetInt("crawl-max-links")
+	if err != nil {
+		return nil, err
+	}
+
+	*ts.Retry.MaxAttempts, err = cmd.Flags().GetInt("max-attempts")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Retry.Backoff, err = cmd.Flags().GetInt("retry-backoff")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Retry.BackoffMultiplier, err = cmd.Flags().GetFloat64("retry-backoff-multiplier")
+	if err != nil {
+		return nil, err
+	}
+	retryClasses, err := cmd.Flags().GetStringSlice("retry-classes")
+	if err != nil {
+		return nil, err
+	}
+	for _, rc := range retryClasses {
+		*ts.Retry.RetryableClasses = append(*ts.Retry.RetryableClasses, b.FailureClass(rc))
+	}
+
+	// Postprocessing settings
+	*ts.Postprocess.EntityList, err = cmd.Flags().GetString("entity-list")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Postprocess.FilterLists, err = cmd.Flags().GetStringSlice("filter-lists")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Postprocess.LibraryDB, err = cmd.Flags().GetString("library-db")
+	if err != nil {
+		return nil, err
+	}
+	*ts.Postprocess.Postprocessors, err = cmd.Flags().GetStringSlice("run-postprocessors")
+	if err != nil {
+		return nil, err
+	}
 
 	// Output settings, either local or remote
 	resultsOutputPath, err := cmd.Flags().GetString("results-output-path")
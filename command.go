@@ -4,9 +4,11 @@ import (
 	"github.com/pmurley/mida/amqp"
 	b "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/postprocess"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/teamnsrg/mida/storage"
+	"strings"
 )
 
 // getRootCommand returns the root cobra command which will be executed based on arguments passed to the program
@@ -15,23 +17,34 @@ func getRootCommand() *cobra.Command {
 	var cmdRoot = &cobra.Command{Use: "mida"}
 
 	var (
-		numCrawlers int
-		numStorers  int
-		monitor     bool
-		promPort    int
-		logLevel    int
+		numCrawlers       int
+		numStorers        int
+		numPostprocessors int
+		monitor           bool
+		promPort          int
+		logLevel          int
+		pool              bool
+		poolRecycle       int
 	)
 
 	cmdRoot.PersistentFlags().IntVarP(&numCrawlers, "crawlers", "c", viper.GetInt("crawlers"),
 		"Number of parallel browser instances to use for crawling")
 	cmdRoot.PersistentFlags().IntVarP(&numStorers, "storers", "s", viper.GetInt("storers"),
 		"Number of parallel goroutines working to store task results")
+	cmdRoot.PersistentFlags().IntVarP(&numPostprocessors, "postprocessors", "", viper.GetInt("postprocessors"),
+		"Number of parallel goroutines working to postprocess task results")
 	cmdRoot.PersistentFlags().BoolVarP(&monitor, "monitor", "m", false,
 		"Enable monitoring via Prometheus by hosting a HTTP server")
 	cmdRoot.PersistentFlags().IntVarP(&promPort, "prom-port", "z", viper.GetInt("prom-port"),
 		"Port used for hosting metrics for a Prometheus server")
 	cmdRoot.PersistentFlags().IntVarP(&logLevel, "log-level", "l", viper.GetInt("log-level"),
 		"Log Level for MIDA (0=Error, 1=Warn, 2=Info, 3=Debug)")
+	cmdRoot.PersistentFlags().BoolVarP(&pool, "pool", "", viper.GetBool("pool"),
+		"Keep one browser open per crawler, visiting each task in a fresh incognito context")
+	cmdRoot.PersistentFlags().IntVarP(&poolRecycle, "pool-recycle", "", viper.GetInt("pool-recycle"),
+		"Number of tasks after which a pooled browser is restarted (0 to never restart)")
+	cmdRoot.PersistentFlags().StringSliceP("filter-lists", "", viper.GetStringSlice("filter-lists"),
+		"Filter lists for tasks which don't name their own (go and build set the task's own lists instead)")
 
 	err = viper.BindPFlags(cmdRoot.PersistentFlags())
 	if err != nil {
@@ -170,15 +183,62 @@ func getBuildCommand() *cobra.Command {
 		removeBrowserFlags []string
 		setBrowserFlags    []string
 		extensions         []string
+		profile            string
+		profileDir         string
+		persistProfile     bool
+		archiveProfile     bool
+		remoteBrowser      string
+		driver             string
+		replayFile         string
+		displayMode        string
 
 		// Completion settings
-		completionCondition string
-		timeout             int
-		timeAfterLoad       int
+		completionCondition    string
+		timeout                int
+		timeAfterLoad          int
+		networkIdleConnections int
+		networkIdleTime        int
+		selector               string
+		expression             string
+		pollInterval           int
+		gracePeriod            int
 
 		// Data Gathering settings
-		resourceMetadata bool
-		allResources     bool
+		resourceMetadata   bool
+		allResources       bool
+		har                bool
+		harBodies          bool
+		contentAddressed   bool
+		coverage           bool
+		performanceMetrics bool
+		trace              bool
+		traceCategories    []string
+		bodyAllowTypes     []string
+		bodyDenyTypes      []string
+		bodyMaxSize        int
+		bodyParty          string
+		bodyURLInclude     []string
+		bodyURLExclude     []string
+		streamBodiesOver   int
+
+		// Crawl settings
+		crawlDepth    int
+		crawlSameSite bool
+		crawlInclude  []string
+		crawlExclude  []string
+		crawlMaxLinks int
+
+		// Retry settings
+		maxAttempts            int
+		retryBackoff           int
+		retryBackoffMultiplier float64
+		retryClasses           []string
+
+		// Postprocessing settings
+		entityList     string
+		filterLists    []string
+		libraryDB      string
+		postprocessors []string
 
 		// Output settings
 		resultsOutputPath string // Results from task path
@@ -245,18 +305,104 @@ func getBuildCommand() *cobra.Command {
 		"Overrides default browser flags (comma-separated, no '--')")
 	cmdBuild.Flags().StringSliceP("extensions", "e", extensions,
 		"Full paths to browser extensions to use (comma-separated, no'--')")
+	cmdBuild.Flags().StringVarP(&profile, "profile", "", "",
+		"Name of a browser profile to copy as the user data directory for each visit")
+	cmdBuild.Flags().StringVarP(&profileDir, "profile-dir", "", b.DefaultProfileDirectory,
+		"Directory containing browser profiles")
+	cmdBuild.Flags().BoolVarP(&persistProfile, "persist-profile", "", false,
+		"Save the browser profile back after each visit, so later visits build on it")
+	cmdBuild.Flags().BoolVarP(&archiveProfile, "archive-profile", "", false,
+		"Store an archive of the browser profile with the results of each visit")
+	cmdBuild.Flags().StringVarP(&remoteBrowser, "remote-browser", "", "",
+		"DevTools endpoint (ws:// or http://) of an already-running browser to use instead of launching one")
+	cmdBuild.Flags().StringVarP(&driver, "driver", "", string(b.DefaultBrowserDriver),
+		"Driver used to visit sites (chromium, stub)")
+	cmdBuild.Flags().StringVarP(&replayFile, "replay-file", "", "",
+		"File of recorded DevTools events for the stub driver to replay")
+	cmdBuild.Flags().StringVarP(&displayMode, "display", "", "",
+		"Browser display mode (headless, headless-legacy, headful, xvfb), chosen automatically if not set")
 
 	cmdBuild.Flags().StringVarP(&completionCondition, "completion", "y", string(b.DefaultCompletionCondition),
-		"Completion condition for tasks (CompleteOnTimeoutOnly, CompleteOnLoadEvent, CompleteOnTimeoutAfterLoad")
+		"Completion condition for tasks (TimeoutOnly, LoadEvent, TimeAfterLoad, NetworkIdle, SelectorPresent, JSPredicate)")
 	cmdBuild.Flags().IntVarP(&timeout, "timeout", "t", b.DefaultTimeout,
 		"Timeout (in seconds) after which the browser will close and the task will complete")
 	cmdBuild.Flags().IntVarP(&timeAfterLoad, "time-after-load", "", b.DefaultTimeAfterLoad,
 		"Time after load event to remain on page (overridden by timeout if reached first)")
+	cmdBuild.Flags().IntVarP(&networkIdleConnections, "network-idle-connections", "", b.DefaultNetworkIdleConnections,
+		"Maximum requests in flight for the network to be considered idle (NetworkIdle mode)")
+	cmdBuild.Flags().IntVarP(&networkIdleTime, "network-idle-time", "", b.DefaultNetworkIdleTime,
+		"Time (in milliseconds) the network must remain idle after load event (NetworkIdle mode)")
+	cmdBuild.Flags().StringVarP(&selector, "selector", "", "",
+		"CSS selector which completes the task when it appears (SelectorPresent mode)")
+	cmdBuild.Flags().StringVarP(&expression, "expression", "", "",
+		"JavaScript expression which completes the task when it evaluates truthy (JSPredicate mode)")
+	cmdBuild.Flags().IntVarP(&pollInterval, "poll-interval", "", b.DefaultPollInterval,
+		"Time (in milliseconds) between checks of the selector or expression")
+	cmdBuild.Flags().IntVarP(&gracePeriod, "grace-period", "", b.DefaultGracePeriod,
+		"Time (in seconds) to remain on page after the selector or expression is satisfied")
 
 	cmdBuild.Flags().BoolVarP(&allResources, "all-resources", "", b.DefaultAllResources,
 		"Gather and store all resources downloaded by browser")
 	cmdBuild.Flags().BoolVarP(&resourceMetadata, "resource-metadata", "", b.DefaultResourceMetadata,
 		"Gather and store metadata about all resources downloaded by browser")
+	cmdBuild.Flags().BoolVarP(&har, "har", "", b.DefaultHAR,
+		"Build and store a HAR archive of each site visit")
+	cmdBuild.Flags().BoolVarP(&harBodies, "har-bodies", "", b.DefaultHARBodies,
+		"Include stored resource bodies in the HAR archive (requires --all-resources)")
+	cmdBuild.Flags().BoolVarP(&contentAddressed, "content-addressed", "", b.DefaultContentAddressed,
+		"Store resource bodies by SHA-256 hash in a store shared by all tasks, instead of with each task")
+	cmdBuild.Flags().BoolVarP(&coverage, "coverage", "", b.DefaultCoverage,
+		"Gather JavaScript and CSS code coverage")
+	cmdBuild.Flags().BoolVarP(&performanceMetrics, "performance-metrics", "", b.DefaultPerformanceMetrics,
+		"Gather browser performance metrics at load event and at completion")
+	cmdBuild.Flags().BoolVarP(&trace, "trace", "", b.DefaultTrace,
+		"Record a full Chrome trace of each site visit")
+	cmdBuild.Flags().StringSliceP("trace-categories", "", traceCategories,
+		"Chrome trace categories to record (comma-separated, defaults to timeline categories)")
+	cmdBuild.Flags().StringSliceP("body-types", "", bodyAllowTypes,
+		"Only save resource bodies of these resource or MIME types (e.g., Script,image/*)")
+	cmdBuild.Flags().StringSliceP("body-exclude-types", "", bodyDenyTypes,
+		"Never save resource bodies of these resource or MIME types")
+	cmdBuild.Flags().IntVarP(&bodyMaxSize, "body-max-size", "", b.DefaultBodyMaxSize,
+		"Skip resource bodies larger than this many bytes once decoded (0 for no limit)")
+	cmdBuild.Flags().StringVarP(&bodyParty, "body-party", "", string(b.DefaultBodyParty),
+		"Which resource bodies to save by party: all, first or third")
+	cmdBuild.Flags().StringSliceP("body-url-include", "", bodyURLInclude,
+		"Only save resource bodies whose URLs match one of these regexes")
+	cmdBuild.Flags().StringSliceP("body-url-exclude", "", bodyURLExclude,
+		"Never save resource bodies whose URLs match one of these regexes")
+	cmdBuild.Flags().IntVarP(&streamBodiesOver, "stream-bodies-over", "", b.DefaultStreamBodyThreshold,
+		"Stream resource bodies larger than this many bytes, or of unknown size, straight to disk (0 to never stream)")
+
+	cmdBuild.Flags().IntVarP(&crawlDepth, "crawl-depth", "", b.DefaultCrawlMaxDepth,
+		"Depth of links to follow from each page (0 visits only the given URLs)")
+	cmdBuild.Flags().BoolVarP(&crawlSameSite, "crawl-same-site", "", b.DefaultCrawlSameSite,
+		"Only follow links within the same site (eTLD+1) as the page they are found on")
+	cmdBuild.Flags().StringSliceP("crawl-include", "", crawlInclude,
+		"Only follow links matching one of these regexes (comma-separated)")
+	cmdBuild.Flags().StringSliceP("crawl-exclude", "", crawlExclude,
+		"Never follow links matching any of these regexes (comma-separated)")
+	cmdBuild.Flags().IntVarP(&crawlMaxLinks, "crawl-max-links", "", b.DefaultCrawlMaxLinks,
+		"Maximum number of links to follow from a single page")
+
+	cmdBuild.Flags().IntVarP(&maxAttempts, "max-attempts", "", b.DefaultRetryMaxAttempts,
+		"Maximum number of times to attempt each site visit")
+	cmdBuild.Flags().IntVarP(&retryBackoff, "retry-backoff", "", b.DefaultRetryBackoff,
+		"Time (in seconds) to wait before retrying a failed site visit")
+	cmdBuild.Flags().Float64VarP(&retryBackoffMultiplier, "retry-backoff-multiplier", "", b.DefaultRetryBackoffMultiplier,
+		"Factor by which the wait before retrying grows with each retry")
+	cmdBuild.Flags().StringSliceP("retry-classes", "", retryClasses,
+		"Failure classes to retry (comma-separated: dns, connection_refused, tls, http_error, navigation_timeout, browser_crash, devtools_setup, other)")
+
+	cmdBuild.Flags().StringVarP(&entityList, "entity-list", "", "",
+		"Disconnect-style entities JSON file mapping third-party domains to the organizations owning them (for third_parties)")
+	cmdBuild.Flags().StringSliceP("filter-lists", "", filterLists,
+		"Adblock Plus style filter lists (e.g., EasyList) to match requests against (comma-separated, for filter_lists)")
+	cmdBuild.Flags().StringVarP(&libraryDB, "library-db", "", "",
+		"JSON database of known JavaScript library versions, used to identify the libraries each page loads (for libraries)")
+	cmdBuild.Flags().StringSliceP("run-postprocessors", "", postprocessors,
+		"Postprocessors to run, in order (comma-separated, from: "+strings.Join(postprocess.Registered(), ", ")+
+			"; default: "+strings.Join(b.DefaultPostprocessors, ", ")+")")
 
 	cmdBuild.Flags().StringVarP(&resultsOutputPath, "results-output-path", "r", storage.DefaultOutputPath,
 		"Path (local or remote) to store results in. A new directory will be created inside this one for each task.")
@@ -284,15 +430,62 @@ func getGoCommand() *cobra.Command {
 		removeBrowserFlags []string
 		setBrowserFlags    []string
 		extensions         []string
+		profile            string
+		profileDir         string
+		persistProfile     bool
+		archiveProfile     bool
+		remoteBrowser      string
+		driver             string
+		replayFile         string
+		displayMode        string
 
 		// Completion settings
-		completionCondition string
-		timeout             int
-		timeAfterLoad       int
+		completionCondition    string
+		timeout                int
+		timeAfterLoad          int
+		networkIdleConnections int
+		networkIdleTime        int
+		selector               string
+		expression             string
+		pollInterval           int
+		gracePeriod            int
 
 		// Data Gathering settings
-		resourceMetadata bool
-		allResources     bool
+		resourceMetadata   bool
+		allResources       bool
+		har                bool
+		harBodies          bool
+		contentAddressed   bool
+		coverage           bool
+		performanceMetrics bool
+		trace              bool
+		traceCategories    []string
+		bodyAllowTypes     []string
+		bodyDenyTypes      []string
+		bodyMaxSize        int
+		bodyParty          string
+		bodyURLInclude     []string
+		bodyURLExclude     []string
+		streamBodiesOver   int
+
+		// Crawl settings
+		crawlDepth    int
+		crawlSameSite bool
+		crawlInclude  []string
+		crawlExclude  []string
+		crawlMaxLinks int
+
+		// Retry settings
+		maxAttempts            int
+		retryBackoff           int
+		retryBackoffMultiplier float64
+		retryClasses           []string
+
+		// Postprocessing settings
+		entityList     string
+		filterLists    []string
+		libraryDB      string
+		postprocessors []string
 
 		// Output settings
 		resultsOutputPath string // Results from task path
@@ -335,18 +528,104 @@ func getGoCommand() *cobra.Command {
 		"Overrides default browser flags (comma-separated, no '--')")
 	cmdGo.Flags().StringSliceP("extensions", "e", extensions,
 		"Full paths to browser extensions to use (comma-separated, no'--')")
+	cmdGo.Flags().StringVarP(&profile, "profile", "", "",
+		"Name of a browser profile to copy as the user data directory for each visit")
+	cmdGo.Flags().StringVarP(&profileDir, "profile-dir", "", b.DefaultProfileDirectory,
+		"Directory containing browser profiles")
+	cmdGo.Flags().BoolVarP(&persistProfile, "persist-profile", "", false,
+		"Save the browser profile back after each visit, so later visits build on it")
+	cmdGo.Flags().BoolVarP(&archiveProfile, "archive-profile", "", false,
+		"Store an archive of the browser profile with the results of each visit")
+	cmdGo.Flags().StringVarP(&remoteBrowser, "remote-browser", "", "",
+		"DevTools endpoint (ws:// or http://) of an already-running browser to use instead of launching one")
+	cmdGo.Flags().StringVarP(&driver, "driver", "", string(b.DefaultBrowserDriver),
+		"Driver used to visit sites (chromium, stub)")
+	cmdGo.Flags().StringVarP(&replayFile, "replay-file", "", "",
+		"File of recorded DevTools events for the stub driver to replay")
+	cmdGo.Flags().StringVarP(&displayMode, "display", "", "",
+		"Browser display mode (headless, headless-legacy, headful, xvfb), chosen automatically if not set")
 
 	cmdGo.Flags().StringVarP(&completionCondition, "completion", "y", string(b.DefaultCompletionCondition),
-		"Completion condition for tasks (CompleteOnTimeoutOnly, CompleteOnLoadEvent, CompleteOnTimeoutAfterLoad")
+		"Completion condition for tasks (TimeoutOnly, LoadEvent, TimeAfterLoad, NetworkIdle, SelectorPresent, JSPredicate)")
 	cmdGo.Flags().IntVarP(&timeout, "timeout", "t", b.DefaultTimeout,
 		"Timeout (in seconds) after which the browser will close and the task will complete")
 	cmdGo.Flags().IntVarP(&timeAfterLoad, "time-after-load", "", b.DefaultTimeAfterLoad,
 		"Time after load event to remain on page (overridden by timeout if reached first)")
+	cmdGo.Flags().IntVarP(&networkIdleConnections, "network-idle-connections", "", b.DefaultNetworkIdleConnections,
+		"Maximum requests in flight for the network to be considered idle (NetworkIdle mode)")
+	cmdGo.Flags().IntVarP(&networkIdleTime, "network-idle-time", "", b.DefaultNetworkIdleTime,
+		"Time (in milliseconds) the network must remain idle after load event (NetworkIdle mode)")
+	cmdGo.Flags().StringVarP(&selector, "selector", "", "",
+		"CSS selector which completes the task when it appears (SelectorPresent mode)")
+	cmdGo.Flags().StringVarP(&expression, "expression", "", "",
+		"JavaScript expression which completes the task when it evaluates truthy (JSPredicate mode)")
+	cmdGo.Flags().IntVarP(&pollInterval, "poll-interval", "", b.DefaultPollInterval,
+		"Time (in milliseconds) between checks of the selector or expression")
+	cmdGo.Flags().IntVarP(&gracePeriod, "grace-period", "", b.DefaultGracePeriod,
+		"Time (in seconds) to remain on page after the selector or expression is satisfied")
 
 	cmdGo.Flags().BoolVarP(&allResources, "all-resources", "", b.DefaultAllResources,
 		"Gather and store all resources downloaded by browser")
 	cmdGo.Flags().BoolVarP(&resourceMetadata, "resource-metadata", "", b.DefaultResourceMetadata,
 		"Gather and store metadata about all resources downloaded by browser")
+	cmdGo.Flags().BoolVarP(&har, "har", "", b.DefaultHAR,
+		"Build and store a HAR archive of each site visit")
+	cmdGo.Flags().BoolVarP(&harBodies, "har-bodies", "", b.DefaultHARBodies,
+		"Include stored resource bodies in the HAR archive (requires --all-resources)")
+	cmdGo.Flags().BoolVarP(&contentAddressed, "content-addressed", "", b.DefaultContentAddressed,
+		"Store resource bodies by SHA-256 hash in a store shared by all tasks, instead of with each task")
+	cmdGo.Flags().BoolVarP(&coverage, "coverage", "", b.DefaultCoverage,
+		"Gather JavaScript and CSS code coverage")
+	cmdGo.Flags().BoolVarP(&performanceMetrics, "performance-metrics", "", b.DefaultPerformanceMetrics,
+		"Gather browser performance metrics at load event and at completion")
+	cmdGo.Flags().BoolVarP(&trace, "trace", "", b.DefaultTrace,
+		"Record a full Chrome trace of each site visit")
+	cmdGo.Flags().StringSliceP("trace-categories", "", traceCategories,
+		"Chrome trace categories to record (comma-separated, defaults to timeline categories)")
+	cmdGo.Flags().StringSliceP("body-types", "", bodyAllowTypes,
+		"Only save resource bodies of these resource or MIME types (e.g., Script,image/*)")
+	cmdGo.Flags().StringSliceP("body-exclude-types", "", bodyDenyTypes,
+		"Never save resource bodies of these resource or MIME types")
+	cmdGo.Flags().IntVarP(&bodyMaxSize, "body-max-size", "", b.DefaultBodyMaxSize,
+		"Skip resource bodies larger than this many bytes once decoded (0 for no limit)")
+	cmdGo.Flags().StringVarP(&bodyParty, "body-party", "", string(b.DefaultBodyParty),
+		"Which resource bodies to save by party: all, first or third")
+	cmdGo.Flags().StringSliceP("body-url-include", "", bodyURLInclude,
+		"Only save resource bodies whose URLs match one of these regexes")
+	cmdGo.Flags().StringSliceP("body-url-exclude", "", bodyURLExclude,
+		"Never save resource bodies whose URLs match one of these regexes")
+	cmdGo.Flags().IntVarP(&streamBodiesOver, "stream-bodies-over", "", b.DefaultStreamBodyThreshold,
+		"Stream resource bodies larger than this many bytes, or of unknown size, straight to disk (0 to never stream)")
+
+	cmdGo.Flags().IntVarP(&crawlDepth, "crawl-depth", "", b.DefaultCrawlMaxDepth,
+		"Depth of links to follow from each page (0 visits only the given URLs)")
+	cmdGo.Flags().BoolVarP(&crawlSameSite, "crawl-same-site", "", b.DefaultCrawlSameSite,
+		"Only follow links within the same site (eTLD+1) as the page they are found on")
+	cmdGo.Flags().StringSliceP("crawl-include", "", crawlInclude,
+		"Only follow links matching one of these regexes (comma-separated)")
+	cmdGo.Flags().StringSliceP("crawl-exclude", "", crawlExclude,
+		"Never follow links matching any of these regexes (comma-separated)")
+	cmdGo.Flags().IntVarP(&crawlMaxLinks, "crawl-max-links", "", b.DefaultCrawlMaxLinks,
+		"Maximum number of links to follow from a single page")
+
+	cmdGo.Flags().IntVarP(&maxAttempts, "max-attempts", "", b.DefaultRetryMaxAttempts,
+		"Maximum number of times to attempt each site visit")
+	cmdGo.Flags().IntVarP(&retryBackoff, "retry-backoff", "", b.DefaultRetryBackoff,
+		"Time (in seconds) to wait before retrying a failed site visit")
+	cmdGo.Flags().Float64VarP(&retryBackoffMultiplier, "retry-backoff-multiplier", "", b.DefaultRetryBackoffMultiplier,
+		"Factor by which the wait before retrying grows with each retry")
+	cmdGo.Flags().StringSliceP("retry-classes", "", retryClasses,
+		"Failure classes to retry (comma-separated: dns, connection_refused, tls, http_error, navigation_timeout, browser_crash, devtools_setup, other)")
+
+	cmdGo.Flags().StringVarP(&entityList, "entity-list", "", "",
+		"Disconnect-style entities JSON file mapping third-party domains to the organizations owning them (for third_parties)")
+	cmdGo.Flags().StringSliceP("filter-lists", "", filterLists,
+		"Adblock Plus style filter lists (e.g., EasyList) to match requests against (comma-separated, for filter_lists)")
+	cmdGo.Flags().StringVarP(&libraryDB, "library-db", "", "",
+		"JSON database of known JavaScript library versions, used to identify the libraries each page loads (for libraries)")
+	cmdGo.Flags().StringSliceP("run-postprocessors", "", postprocessors,
+		"Postprocessors to run, in order (comma-separated, from: "+strings.Join(postprocess.Registered(), ", ")+
+			"; default: "+strings.Join(b.DefaultPostprocessors, ", ")+")")
 
 	cmdGo.Flags().StringVarP(&resultsOutputPath, "results-output-path", "r", storage.DefaultOutputPath,
 		"Path (local or remote) to store results in. A new directory will be created inside this one for each task.")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/spf13/viper"
+	"strings"
 )
 
 // initViperConfig
@@ -9,8 +10,9 @@ func initViperConfig() {
 	// Initialize the hardcoded defaults
 	setDefaults()
 
-	// We will read environment variables with the "MIDA" prefix
+	// We will read environment variables with the "MIDA" prefix (e.g., MIDA_FILTER_LISTS for "filter-lists")
 	viper.SetEnvPrefix("MIDA")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 }
 
@@ -19,11 +21,17 @@ func setDefaults() {
 	// MIDA-Wide Configuration Defaults
 	viper.SetDefault("crawlers", 1)
 	viper.SetDefault("storers", 1)
+	viper.SetDefault("postprocessors", 1)
 	viper.SetDefault("prom-port", 8001)
 	viper.SetDefault("monitor", false)
 	viper.SetDefault("log-level", 2)
+	viper.SetDefault("pool", false)
+	viper.SetDefault("pool-recycle", 100)
 	viper.SetDefault("task-file", "examples/example_task.json")
 
+	// Filter lists used by tasks which don't name their own (--filter-lists, or MIDA_FILTER_LISTS separated by spaces)
+	viper.SetDefault("filter-lists", []string{})
+
 	viper.SetDefault("amqp-user", "")
 	viper.SetDefault("amqp-pass", "")
 	viper.SetDefault("amqp-uri", "amqp://localhost:5672")
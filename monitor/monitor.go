@@ -36,6 +36,10 @@ func RunPrometheusClient(monitoringChan <-chan *b.TaskSummary, port int) {
 		})
 	prometheus.MustRegister(storageDurationHistogram)
 
+	registerWorkerMetrics()
+	registerWatchdogMetrics()
+	registerPipelineMetrics()
+
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
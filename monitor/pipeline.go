@@ -0,0 +1,24 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages reported by the pipeline_queue_depth gauge, each named for the stage the waiting tasks are queued for
+const (
+	StageCrawl       = "crawl"       // Sanitized tasks waiting for a crawler
+	StagePostprocess = "postprocess" // Raw results waiting for a postprocessing worker
+	StageStorage     = "storage"     // Final results waiting for a storage worker
+)
+
+// QueueDepth is the number of tasks waiting for each stage of the pipeline. Like the worker metrics, it is
+// updated whether or not monitoring is enabled.
+var QueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pipeline_queue_depth",
+		Help: "Tasks waiting to be picked up by each stage of the pipeline",
+	}, []string{"stage"})
+
+func registerPipelineMetrics() {
+	prometheus.MustRegister(QueueDepth)
+}
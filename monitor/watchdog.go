@@ -0,0 +1,23 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Events counted by the browser_watchdog_events_total counter
+const (
+	WatchdogDeadlineKill = "deadline_kill" // A browser was still running at its hard deadline and was killed
+	WatchdogLeftoverKill = "leftover_kill" // Processes belonging to a browser were still running after it was closed
+	WatchdogOrphanKill   = "orphan_kill"   // A browser left behind by an earlier run of MIDA was killed at startup
+)
+
+// BrowserWatchdogEvents counts the times the browser watchdog has had to kill browser processes, by event
+var BrowserWatchdogEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "browser_watchdog_events_total",
+		Help: "Times the browser watchdog has killed browser processes, by the reason they were killed",
+	}, []string{"event"})
+
+func registerWatchdogMetrics() {
+	prometheus.MustRegister(BrowserWatchdogEvents)
+}
@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// States a crawler worker may be in, as reported by the crawler_state gauge
+const (
+	WorkerIdle     = 0 // Waiting for a task
+	WorkerVisiting = 1 // Visiting a site
+	WorkerStopped  = 2 // Exited, either because the pipeline is finished or because it could not be restarted
+)
+
+// Worker health metrics. These are updated by the crawlers whether or not monitoring is enabled, and are
+// only exported when the Prometheus client is running.
+var (
+	CrawlerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "crawler_state",
+			Help: "The current state of each crawler worker (0: idle, 1: visiting, 2: stopped)",
+		}, []string{"crawler"})
+
+	CrawlerLastActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "crawler_last_active_timestamp_seconds",
+			Help: "The time at which each crawler worker last started or finished a site visit",
+		}, []string{"crawler"})
+
+	CrawlerVisitErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "crawler_visit_errors_total",
+			Help: "Site visits which could not be carried out because of a driver error or panic",
+		}, []string{"crawler"})
+
+	CrawlerRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "crawler_restarts_total",
+			Help: "Times each crawler worker has crashed and been restarted",
+		}, []string{"crawler"})
+)
+
+func registerWorkerMetrics() {
+	prometheus.MustRegister(CrawlerState, CrawlerLastActive, CrawlerVisitErrors, CrawlerRestarts)
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/browser"
 	"github.com/pmurley/mida/log"
 	"github.com/pmurley/mida/monitor"
+	"github.com/pmurley/mida/postprocess"
+	"github.com/pmurley/mida/sanitize"
 	"github.com/pmurley/mida/storage"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
 	"sync"
 )
 
@@ -17,11 +21,31 @@ func InitPipeline(cmd *cobra.Command, args []string) {
 	sanitizedTaskChan := make(chan *b.TaskWrapper) // channel connecting stages 2 and 3
 	rawResultChan := make(chan *b.RawResult)       // channel connecting stages 3 and 4
 	finalResultChan := make(chan *b.FinalResult)   // channel connection stages 4 and 5
+	requeueTaskChan := make(chan *b.RawTask)       // channel for tasks generated later in the pipeline to re-enter stage 2
+	retryTaskChan := make(chan *b.TaskWrapper)     // channel for failed tasks to be retried, from stage 3 back to stage 2
 	monitorChan := make(chan *b.TaskSummary)
 
-	var crawlerWG sync.WaitGroup  // Tracks active crawler workers
-	var storageWG sync.WaitGroup  // Tracks active storage workers
-	var pipelineWG sync.WaitGroup // Tracks tasks currently in pipeline
+	var crawlerWG sync.WaitGroup     // Tracks active crawler workers
+	var postprocessWG sync.WaitGroup // Tracks active postprocessing workers
+	var storageWG sync.WaitGroup     // Tracks active storage workers
+	var pipelineWG sync.WaitGroup    // Tracks tasks currently in pipeline
+
+	// Claim our own temporary directory, and then kill any browsers left running by an earlier run of MIDA
+	// which did not exit cleanly
+	err := browser.ClaimRunTempDir(sanitize.ExpandPath(b.RunTempDir))
+	if err != nil {
+		log.Log.Errorf("failed to create temporary directory for this run: %s", err.Error())
+	}
+	if orphans := browser.ReapOrphans(sanitize.ExpandPath(b.DefaultTempDir)); orphans > 0 {
+		log.Log.Warnf("killed %d orphaned browsers left behind by an earlier run", orphans)
+	}
+
+	// Filter lists for tasks which don't name their own are checked once, rather than failing every task
+	globalFilterLists, err := sanitize.FilterLists(viper.GetStringSlice("filter-lists"))
+	if err != nil {
+		log.Log.Fatalf("invalid filter lists: %s", err.Error())
+	}
+	postprocess.SetGlobalFilterLists(globalFilterLists)
 
 	// Start goroutine that runs the Prometheus monitoring HTTP server
 	if viper.GetBool("monitor") {
@@ -35,18 +59,33 @@ func InitPipeline(cmd *cobra.Command, args []string) {
 		go stage5(finalResultChan, monitorChan, &storageWG, &pipelineWG)
 	}
 
-	// Start goroutine that handles crawl results sanitization
-	go stage4(rawResultChan, finalResultChan)
+	// Start goroutine(s) that postprocess crawl results. Once every postprocessor has exited, we close the
+	// channel going to the storers, so that they can exit in turn.
+	numPostprocessors := viper.GetInt("postprocessors")
+	if numPostprocessors < 1 {
+		log.Log.Warn("at least one postprocessor is required, using 1")
+		numPostprocessors = 1
+	}
+	visited := postprocess.NewVisitedSet() // Pages already visited by each crawl, shared by the postprocessors
+	postprocessWG.Add(numPostprocessors)
+	for i := 0; i < numPostprocessors; i++ {
+		go stage4(rawResultChan, finalResultChan, requeueTaskChan, visited, &postprocessWG, &pipelineWG)
+	}
+	go func() {
+		postprocessWG.Wait()
+		close(finalResultChan)
+	}()
 
-	// Start site visitors(s) which take sanitized tasks as arguments
+	// Start site visitors(s) which take sanitized tasks as arguments. Each is supervised, so that a crawler
+	// which crashes is restarted rather than leaving its tasks stranded in the pipeline.
 	numCrawlers := viper.GetInt("crawlers")
 	crawlerWG.Add(numCrawlers)
 	for i := 0; i < numCrawlers; i++ {
-		go stage3(sanitizedTaskChan, rawResultChan, &crawlerWG)
+		go superviseCrawler(i, sanitizedTaskChan, rawResultChan, retryTaskChan, &crawlerWG)
 	}
 
 	// Start goroutine which sanitizes input tasks
-	go stage2(rawTaskChan, sanitizedTaskChan, &pipelineWG)
+	go stage2(rawTaskChan, requeueTaskChan, retryTaskChan, sanitizedTaskChan, &pipelineWG)
 
 	// Start the goroutine responsible for getting our tasks
 	go stage1(rawTaskChan, cmd, args)
@@ -59,16 +98,17 @@ func InitPipeline(cmd *cobra.Command, args []string) {
 	// going to storers -- the channel close will ripple through the pipeline
 	storageWG.Wait()
 
-	err := storage.CleanupConnections()
+	err = storage.CleanupConnections()
 	if err != nil {
 		log.Log.Error(err)
 	}
 
-	// Cleanup any remaining temporary files before we exit
-	//err = os.RemoveAll(sanitize.ExpandPath(b.DefaultTempDir))
-	//if err != nil {
-	//	log.Log.Error(err)
-	//}
+	// Cleanup any remaining temporary files before we exit. Other instances of MIDA may be using the rest
+	// of the temporary directory, so we only remove our own.
+	err = os.RemoveAll(sanitize.ExpandPath(b.RunTempDir))
+	if err != nil {
+		log.Log.Error(err)
+	}
 
 	return
 }
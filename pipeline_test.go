@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/browser"
+	"github.com/pmurley/mida/postprocess"
+	"github.com/pmurley/mida/sanitize"
+	"github.com/pmurley/mida/storage"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runStubTask carries a task replaying the given recording through sanitize, the stub driver, postprocessing
+// and local storage, just as the pipeline would, returning the directory the results were stored in
+func runStubTask(t *testing.T, replayFile string) string {
+	dir, err := ioutil.TempDir("", "mida-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// Temporary files for the task are kept relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// Settings left out of the task take their defaults, just as for tasks read from a file
+	taskURL := "https://example.com/"
+	driver := b.Stub
+	rt := b.RawTask{
+		URL: &taskURL,
+		Browser: &b.BrowserSettings{
+			Driver:     &driver,
+			ReplayFile: &replayFile,
+		},
+	}
+
+	tw, err := sanitize.Task(&rt)
+	if err != nil {
+		t.Fatalf("failed to sanitize task: %s", err)
+	}
+	defer tw.LogFile.Close()
+
+	rawResult, err := new(browser.StubDriver).Visit(&tw)
+	if err != nil {
+		t.Fatalf("stub visit failed: %s", err)
+	}
+
+	fr, err := postprocess.Run(rawResult)
+	if err != nil {
+		t.Fatalf("postprocessing failed: %s", err)
+	}
+
+	outPath := path.Join(dir, "results")
+	err = storage.Local(&fr, tw.SanitizedTask.OPS.LocalOut.DS, outPath)
+	if err != nil {
+		t.Fatalf("failed to store results: %s", err)
+	}
+
+	return outPath
+}
+
+// readSummary reads the task summary stored in a results directory
+func readSummary(t *testing.T, outPath string) map[string]interface{} {
+	data, err := ioutil.ReadFile(path.Join(outPath, b.DefaultCrawlMetadataFile))
+	if err != nil {
+		t.Fatalf("failed to read task summary: %s", err)
+	}
+
+	var summary map[string]interface{}
+	err = json.Unmarshal(data, &summary)
+	if err != nil {
+		t.Fatalf("failed to parse task summary: %s", err)
+	}
+
+	return summary
+}
+
+func TestStubPipeline(t *testing.T) {
+	replayFile, err := filepath.Abs("examples/stub_recording.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outPath := runStubTask(t, replayFile)
+
+	summary := readSummary(t, outPath)
+	if summary["success"] != true {
+		t.Errorf("expected a successful visit, got summary %v", summary)
+	}
+	if summary["completion_reason"] != string(b.CompletionConditionMet) {
+		t.Errorf("expected completion reason %q, got %v", b.CompletionConditionMet, summary["completion_reason"])
+	}
+	if summary["first_party_requests"] != 1.0 {
+		t.Errorf("expected 1 first-party request, got %v", summary["first_party_requests"])
+	}
+
+	data, err := ioutil.ReadFile(path.Join(outPath, b.DefaultResourceMetadataFile))
+	if err != nil {
+		t.Fatalf("failed to read resource metadata: %s", err)
+	}
+	var resources map[string]b.DTResource
+	err = json.Unmarshal(data, &resources)
+	if err != nil {
+		t.Fatalf("failed to parse resource metadata: %s", err)
+	}
+	resource, ok := resources["1000.1"]
+	if !ok {
+		t.Fatalf("expected metadata for the main document, got %v", resources)
+	}
+	if resource.Response.Response == nil || resource.Response.Response.Status != 200 {
+		t.Errorf("expected the main document to have status 200")
+	}
+
+	if _, err := os.Stat(path.Join(outPath, postprocess.ThirdPartiesPostprocessor+".json")); err != nil {
+		t.Errorf("expected the third-party analysis to be stored: %s", err)
+	}
+	if _, err := os.Stat(path.Join(outPath, b.DefaultTaskLogFile)); err != nil {
+		t.Errorf("expected the task log to be stored: %s", err)
+	}
+}
+
+func TestStubPipelineHTTPError(t *testing.T) {
+	data, err := ioutil.ReadFile("examples/stub_recording.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "mida-replay-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Replace(string(data), `"status": 200`, `"status": 404`, 1))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := readSummary(t, runStubTask(t, f.Name()))
+	if summary["success"] != false {
+		t.Errorf("expected an HTTP error on the main document to fail the visit")
+	}
+	tw, _ := summary["task_wrapper"].(map[string]interface{})
+	if tw["FailureClass"] != string(b.FailureHTTPError) {
+		t.Errorf("expected failure class %q, got %v", b.FailureHTTPError, tw["FailureClass"])
+	}
+}
@@ -0,0 +1,144 @@
+package postprocess
+
+import (
+	"errors"
+	b "github.com/pmurley/mida/base"
+)
+
+// Names of the postprocessors built into MIDA
+const (
+	ThirdPartiesPostprocessor    = "third_parties"
+	FilterListsPostprocessor     = "filter_lists"
+	LibrariesPostprocessor       = "libraries"
+	SecurityHeadersPostprocessor = "security_headers"
+	MixedContentPostprocessor    = "mixed_content"
+)
+
+// The built-in postprocessors add their results to the final result as sections named after themselves, so
+// each is stored in a file of its own (e.g., third_parties.json). A task selects them by name, just like any
+// other postprocessor.
+func init() {
+	Register(NewPostprocessor(ThirdPartiesPostprocessor, thirdParties))
+	Register(NewPostprocessor(FilterListsPostprocessor, filterLists))
+	Register(NewPostprocessor(LibrariesPostprocessor, libraries))
+	Register(NewPostprocessor(SecurityHeadersPostprocessor, securityHeaders))
+	Register(NewPostprocessor(MixedContentPostprocessor, mixedContent))
+}
+
+// thirdParties labels each resource as first- or third-party, counting requests to each in the summary
+func thirdParties(rr *b.RawResult, fr *b.FinalResult) error {
+	pps := rr.TaskSummary.TaskWrapper.SanitizedTask.PPS
+	var el EntityList
+	if *pps.EntityList != "" {
+		var err error
+		el, err = LoadEntityList(*pps.EntityList)
+		if err != nil {
+			return err
+		}
+	}
+
+	analysis, err := ThirdParties(rr, el)
+	if err != nil {
+		return err
+	}
+	fr.Sections[ThirdPartiesPostprocessor] = analysis
+	for _, label := range analysis.Resources {
+		if label.ThirdParty {
+			fr.Summary.ThirdPartyRequests += 1
+		} else {
+			fr.Summary.FirstPartyRequests += 1
+		}
+	}
+	if len(analysis.Organizations) > 0 {
+		fr.Summary.ThirdPartyOrganizations = analysis.Organizations
+	}
+
+	return nil
+}
+
+// filterLists records the filter list rule matching each resource, counting tracker requests in the summary
+func filterLists(rr *b.RawResult, fr *b.FinalResult) error {
+	lists := taskFilterLists(rr.TaskSummary.TaskWrapper.SanitizedTask.PPS)
+	if len(lists) == 0 {
+		return errors.New("no filter lists given")
+	}
+
+	m, err := LoadFilterLists(lists)
+	if err != nil {
+		return err
+	}
+
+	for k, match := range FilterLists(rr, m) {
+		if resource, ok := fr.DTResourceMetadata[k]; ok {
+			match := match
+			resource.FilterMatch = &match
+			fr.DTResourceMetadata[k] = resource
+		}
+		if !match.Exception {
+			fr.Summary.TrackerRequests += 1
+			if fr.Summary.FilterListMatches == nil {
+				fr.Summary.FilterListMatches = make(map[string]int)
+			}
+			fr.Summary.FilterListMatches[match.List] += 1
+		}
+	}
+
+	return nil
+}
+
+// libraries identifies known JavaScript libraries, listing them in the summary
+func libraries(rr *b.RawResult, fr *b.FinalResult) error {
+	pps := rr.TaskSummary.TaskWrapper.SanitizedTask.PPS
+	if *pps.LibraryDB == "" {
+		return errors.New("no library database given")
+	}
+
+	db, err := LoadLibraryDB(*pps.LibraryDB)
+	if err != nil {
+		return err
+	}
+
+	libs, err := Libraries(rr, db, fr.BodyHashes)
+	if err != nil {
+		return err
+	}
+	fr.Sections[LibrariesPostprocessor] = libs
+	seen := make(map[string]bool)
+	for _, lib := range libs {
+		name := lib.Name
+		if lib.Version != "" {
+			name += "@" + lib.Version
+		}
+		if !seen[name] {
+			seen[name] = true
+			fr.Summary.Libraries = append(fr.Summary.Libraries, name)
+		}
+	}
+
+	return nil
+}
+
+// securityHeaders parses and evaluates security headers and cookie flags
+func securityHeaders(rr *b.RawResult, fr *b.FinalResult) error {
+	fr.Sections[SecurityHeadersPostprocessor] = SecurityHeaders(rr)
+
+	return nil
+}
+
+// mixedContent finds mixed content requests, counting them by outcome in the summary
+func mixedContent(rr *b.RawResult, fr *b.FinalResult) error {
+	requests := MixedContent(rr)
+	fr.Sections[MixedContentPostprocessor] = requests
+	for _, mcr := range requests {
+		switch mcr.Outcome {
+		case MixedContentBlocked:
+			fr.Summary.MixedContentBlocked += 1
+		case MixedContentUpgraded:
+			fr.Summary.MixedContentUpgraded += 1
+		case MixedContentLoaded:
+			fr.Summary.MixedContentLoaded += 1
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/profiler"
+	b "github.com/pmurley/mida/base"
+	"sort"
+)
+
+// Coverage builds per-script and per-style sheet coverage from the raw coverage data gathered
+// during a site visit, linking scripts and style sheets to the requests they were loaded from.
+func Coverage(rr *b.RawResult) (*b.Coverage, error) {
+	result := b.Coverage{
+		Scripts:     make([]b.ScriptCoverage, 0),
+		StyleSheets: make([]b.StyleSheetCoverage, 0),
+	}
+
+	requestIDs := requestIDsByURL(rr)
+
+	for _, sc := range rr.DevTools.Coverage.ScriptCoverage {
+		if sc == nil {
+			continue
+		}
+
+		scriptURL := sc.URL
+		if parsed, ok := rr.DevTools.Debugger.ScriptParsed[sc.ScriptID.String()]; ok && scriptURL == "" {
+			scriptURL = parsed.URL
+		}
+
+		total, used := scriptCoverageBytes(sc.Functions)
+		entry := b.ScriptCoverage{
+			ScriptID:   sc.ScriptID.String(),
+			URL:        scriptURL,
+			RequestID:  requestIDs[scriptURL],
+			Functions:  sc.Functions,
+			TotalBytes: total,
+			UsedBytes:  used,
+		}
+		if total > 0 {
+			entry.UsedRatio = float64(used) / float64(total)
+		}
+		result.Scripts = append(result.Scripts, entry)
+	}
+
+	// Gather the used ranges for each style sheet. Style sheets with no rules at all
+	// will not appear in the rule usage, but we still want to report them.
+	usedRanges := make(map[string][][2]int64)
+	for _, ru := range rr.DevTools.Coverage.RuleUsage {
+		if ru == nil || !ru.Used {
+			continue
+		}
+		id := ru.StyleSheetID.String()
+		usedRanges[id] = append(usedRanges[id], [2]int64{int64(ru.StartOffset), int64(ru.EndOffset)})
+	}
+
+	for id, header := range rr.DevTools.Coverage.StyleSheets {
+		entry := b.StyleSheetCoverage{
+			StyleSheetID: id,
+			URL:          header.SourceURL,
+			RequestID:    requestIDs[header.SourceURL],
+			TotalBytes:   int64(header.Length),
+			UsedBytes:    mergedRangeLength(usedRanges[id]),
+		}
+		if entry.TotalBytes > 0 {
+			entry.UsedRatio = float64(entry.UsedBytes) / float64(entry.TotalBytes)
+		}
+		result.StyleSheets = append(result.StyleSheets, entry)
+	}
+
+	sort.Slice(result.Scripts, func(i, j int) bool {
+		return result.Scripts[i].ScriptID < result.Scripts[j].ScriptID
+	})
+	sort.Slice(result.StyleSheets, func(i, j int) bool {
+		return result.StyleSheets[i].StyleSheetID < result.StyleSheets[j].StyleSheetID
+	})
+
+	return &result, nil
+}
+
+// scriptCoverageBytes computes the total size of a script and the number of bytes which executed at
+// least once. Ranges nest, with inner ranges overriding the counts of the ranges which contain them.
+// The first range of the first function always spans the whole script (the top-level function).
+func scriptCoverageBytes(functions []*profiler.FunctionCoverage) (int64, int64) {
+	var total int64
+	for _, f := range functions {
+		for _, r := range f.Ranges {
+			if r.EndOffset > total {
+				total = r.EndOffset
+			}
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+
+	executed := make([]bool, total)
+	for _, f := range functions {
+		for _, r := range f.Ranges {
+			for i := r.StartOffset; i < r.EndOffset && i < total; i++ {
+				executed[i] = r.Count > 0
+			}
+		}
+	}
+
+	var used int64
+	for _, e := range executed {
+		if e {
+			used += 1
+		}
+	}
+
+	return total, used
+}
+
+// mergedRangeLength returns the number of bytes covered by a set of possibly overlapping ranges
+func mergedRangeLength(ranges [][2]int64) int64 {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	var length, end int64
+	for _, r := range ranges {
+		if r[1] <= end {
+			continue
+		}
+		if r[0] > end {
+			end = r[0]
+		}
+		length += r[1] - end
+		end = r[1]
+	}
+
+	return length
+}
+
+// requestIDsByURL maps the final URL of each request (after redirects) to its request ID
+func requestIDsByURL(rr *b.RawResult) map[string]string {
+	result := make(map[string]string)
+	for requestID, requests := range rr.DevTools.Network.RequestWillBeSent {
+		if len(requests) == 0 || requests[len(requests)-1].Request == nil {
+			continue
+		}
+		result[requests[len(requests)-1].Request.URL] = requestID
+	}
+
+	return result
+}
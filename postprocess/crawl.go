@@ -0,0 +1,148 @@
+package postprocess
+
+import (
+	"errors"
+	b "github.com/pmurley/mida/base"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ChildTasks filters the links extracted from a page according to the task's crawl settings and
+// builds a new task for each link we will follow. Child tasks inherit all the settings of their
+// parent, so crawling continues until the maximum depth is reached. Links are only de-duplicated
+// within the page here: pages already visited by the crawl are skipped using a VisitedSet.
+func ChildTasks(rr *b.RawResult) ([]*b.RawTask, error) {
+	tw := rr.TaskSummary.TaskWrapper
+	st := tw.SanitizedTask
+	children := make([]*b.RawTask, 0)
+
+	if st.Depth >= *st.CrawlS.MaxDepth || len(rr.Links) == 0 {
+		return children, nil
+	}
+
+	parentURL, err := url.Parse(st.URL)
+	if err != nil {
+		return children, errors.New("failed to parse task URL for crawling: " + err.Error())
+	}
+	parentSite := b.Site(parentURL.Hostname())
+
+	var include, exclude []*regexp.Regexp
+	for _, r := range *st.CrawlS.IncludeRegex {
+		include = append(include, regexp.MustCompile(r))
+	}
+	for _, r := range *st.CrawlS.ExcludeRegex {
+		exclude = append(exclude, regexp.MustCompile(r))
+	}
+
+	seen := map[string]bool{normalizeURL(parentURL): true}
+	parentUUID := tw.UUID.String()
+	rootUUID := st.RootUUID
+
+	for _, link := range rr.Links {
+		if len(children) >= *st.CrawlS.MaxLinks {
+			break
+		}
+
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		childURL := normalizeURL(u)
+		if seen[childURL] {
+			continue
+		}
+		seen[childURL] = true
+
+		if *st.CrawlS.SameSite && b.Site(u.Hostname()) != parentSite {
+			continue
+		}
+		if len(include) > 0 && !b.MatchesAny(include, childURL) {
+			continue
+		}
+		if b.MatchesAny(exclude, childURL) {
+			continue
+		}
+
+		depth := st.Depth + 1
+		child := tw.RawTask
+		child.URL = &childURL
+		child.ParentUUID = &parentUUID
+		child.RootUUID = &rootUUID
+		child.Depth = &depth
+		child.Session = nil // Pages found by crawling are visited on their own, not as sessions
+		children = append(children, &child)
+	}
+
+	return children, nil
+}
+
+// NormalizeURL returns the form of a URL used to tell whether a crawl has already visited it
+func NormalizeURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return normalizeURL(u), nil
+}
+
+// normalizeURL drops the parts of a URL which do not change the page it leads to. Note that it modifies u.
+func normalizeURL(u *url.URL) string {
+	// Links which differ only by fragment lead to the same page
+	u.Fragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// A VisitedSet records the pages each crawl has visited (or queued for a visit), so that pages linked from
+// several others in the same crawl are only visited once. Crawls are identified by the UUID of the task they
+// started from. A crawl's pages are forgotten once none of its tasks remain to be postprocessed.
+type VisitedSet struct {
+	sync.Mutex
+	visited map[string]map[string]bool
+	pending map[string]int // Tasks of each crawl which have been queued but not yet postprocessed
+}
+
+func NewVisitedSet() *VisitedSet {
+	return &VisitedSet{
+		visited: make(map[string]map[string]bool),
+		pending: make(map[string]int),
+	}
+}
+
+// Visit records that the crawl with the given root UUID will visit the (normalized) URL, returning false if
+// the crawl has already visited it. Each URL for which Visit returns true must be matched by a call to Done
+// once the task visiting it has been postprocessed.
+func (v *VisitedSet) Visit(rootUUID string, u string) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.visited[rootUUID] == nil {
+		v.visited[rootUUID] = make(map[string]bool)
+	}
+	if v.visited[rootUUID][u] {
+		return false
+	}
+	v.visited[rootUUID][u] = true
+	v.pending[rootUUID] += 1
+
+	return true
+}
+
+// Done records that a task of the crawl with the given root UUID has been postprocessed
+func (v *VisitedSet) Done(rootUUID string) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.pending[rootUUID] -= 1
+	if v.pending[rootUUID] <= 0 {
+		delete(v.pending, rootUUID)
+		delete(v.visited, rootUUID)
+	}
+}
@@ -1,20 +1,25 @@
 package postprocess
 
 import (
+	"github.com/chromedp/cdproto/performance"
 	b "github.com/pmurley/mida/base"
 )
 
+// DevTools builds the final result for a site visit from the raw data gathered through the DevTools protocol.
+// Analyses of that data are left to the postprocessors run afterwards (see Run).
 func DevTools(rr *b.RawResult) (b.FinalResult, error) {
 	finalResult := b.FinalResult{
 		Summary:            rr.TaskSummary,
 		DTResourceMetadata: make(map[string]b.DTResource),
+		Sections:           make(map[string]interface{}),
+		Files:              make(map[string][]byte),
 	}
 
 	// For brevity
 	st := rr.TaskSummary.TaskWrapper.SanitizedTask
 
 	// Ignore any requests/responses which do not have a matching request/response
-	if *st.DS.ResourceMetadata {
+	if *st.DS.ResourceMetadata || *st.DS.HAR {
 		for k := range rr.DevTools.Network.RequestWillBeSent {
 			if _, ok := rr.DevTools.Network.ResponseReceived[k]; ok {
 
@@ -35,5 +40,61 @@ func DevTools(rr *b.RawResult) (b.FinalResult, error) {
 		}
 	}
 
+	// Hashes identify resource bodies in content-addressed storage, and let analyses recognize identical bodies
+	if *st.DS.AllResources {
+		hashes, err := BodyHashes(rr.TaskSummary.TaskWrapper)
+		if err != nil {
+			return finalResult, err
+		}
+		finalResult.BodyHashes = hashes
+		for k, resource := range finalResult.DTResourceMetadata {
+			if hash, ok := hashes[k]; ok {
+				resource.BodyHash = hash
+				finalResult.DTResourceMetadata[k] = resource
+			}
+		}
+	}
+
+	if *st.DS.HAR {
+		har, err := HAR(rr, finalResult.DTResourceMetadata, *st.DS.HARBodies)
+		if err != nil {
+			return finalResult, err
+		}
+		finalResult.HAR = har
+	}
+
+	if *st.DS.Coverage {
+		coverage, err := Coverage(rr)
+		if err != nil {
+			return finalResult, err
+		}
+		finalResult.Coverage = coverage
+	}
+
+	if *st.DS.PerformanceMetrics {
+		finalResult.PerformanceMetrics = &b.PerformanceMetrics{
+			Load:  metricsMap(rr.DevTools.Performance.LoadMetrics),
+			Final: metricsMap(rr.DevTools.Performance.FinalMetrics),
+		}
+	}
+
+	children, err := ChildTasks(rr)
+	if err != nil {
+		return finalResult, err
+	}
+	finalResult.ChildTasks = children
+
 	return finalResult, nil
 }
+
+// metricsMap converts a list of DevTools performance metrics to a map from metric name to value
+func metricsMap(metrics []*performance.Metric) map[string]float64 {
+	result := make(map[string]float64)
+	for _, m := range metrics {
+		if m != nil {
+			result[m.Name] = m.Value
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,665 @@
+package postprocess
+
+import (
+	"bufio"
+	"errors"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A single network filter from an Adblock Plus style filter list (e.g., EasyList or EasyPrivacy)
+type filterRule struct {
+	text      string // The rule, as written in the list
+	list      string // File name of the list containing the rule
+	exception bool   // Exception rules (@@) allow requests which other rules would block
+	important bool   // Important rules block requests even if an exception rule matches them
+	matchCase bool
+
+	pattern      string         // Pattern with anchors removed, lowercased unless matchCase is set
+	regex        *regexp.Regexp // Set instead of pattern for rules written as regular expressions
+	domainAnchor bool           // Pattern must match from the start of a domain label in the host (||)
+	startAnchor  bool           // Pattern must match from the start of the URL (|)
+	endAnchor    bool           // Pattern must match to the end of the URL (|)
+
+	types      map[string]bool // Resource types the rule applies to, or nil for all but documents
+	notTypes   map[string]bool // Resource types the rule does not apply to
+	thirdParty int             // 1 if the rule only applies to third-party requests, -1 for first-party only
+	domains    []string        // Document domains the rule is limited to, if any
+	notDomains []string        // Document domains the rule does not apply on
+}
+
+// filterTypes maps the resource type options of filter rules to the names we use for resource types
+var filterTypes = map[string]string{
+	"script":         "script",
+	"image":          "image",
+	"stylesheet":     "stylesheet",
+	"css":            "stylesheet",
+	"object":         "object",
+	"xmlhttprequest": "xmlhttprequest",
+	"xhr":            "xmlhttprequest",
+	"subdocument":    "subdocument",
+	"frame":          "subdocument",
+	"ping":           "ping",
+	"beacon":         "ping",
+	"media":          "media",
+	"font":           "font",
+	"websocket":      "websocket",
+	"other":          "other",
+	"document":       "document",
+	"doc":            "document",
+}
+
+// Tokens found in so many URLs that they are useless for narrowing down the rules which might match one
+var commonFilterTokens = map[string]bool{
+	"http":  true,
+	"https": true,
+	"www":   true,
+	"com":   true,
+}
+
+// ruleIndex holds rules keyed by a token which must appear in any URL they match, so that we only try a
+// small fraction of the rules against each URL
+type ruleIndex struct {
+	byToken map[string][]*filterRule
+	others  []*filterRule // Rules for which we could not pick out a token
+}
+
+// A FilterMatcher matches requests against a set of filter lists
+type FilterMatcher struct {
+	blocks     ruleIndex
+	exceptions ruleIndex
+}
+
+// Filter lists are shared by every task using them, so each set of lists is only read once
+var (
+	filterMatchers     = make(map[string]*FilterMatcher)
+	filterMatchersLock sync.Mutex
+)
+
+// Filter lists configured for this instance of MIDA, used by tasks which don't name their own
+var (
+	globalFilterLists     []string
+	globalFilterListsLock sync.Mutex
+)
+
+// SetGlobalFilterLists sets the filter lists used by tasks which don't name their own. The paths should already
+// have been checked (see sanitize.FilterLists).
+func SetGlobalFilterLists(paths []string) {
+	globalFilterListsLock.Lock()
+	globalFilterLists = append([]string{}, paths...)
+	globalFilterListsLock.Unlock()
+}
+
+// GlobalFilterLists returns the filter lists used by tasks which don't name their own
+func GlobalFilterLists() []string {
+	globalFilterListsLock.Lock()
+	defer globalFilterListsLock.Unlock()
+	return append([]string{}, globalFilterLists...)
+}
+
+// taskFilterLists returns the filter lists a task is matched against: its own, or failing that, the global ones
+func taskFilterLists(pps b.PostprocessSettings) []string {
+	if pps.FilterLists != nil && len(*pps.FilterLists) > 0 {
+		return *pps.FilterLists
+	}
+	return GlobalFilterLists()
+}
+
+// LoadFilterLists reads the given Adblock Plus style filter lists into a single matcher, or returns the matcher
+// already built from the same lists. Exception rules in any of the lists apply to blocking rules in all of them.
+func LoadFilterLists(paths []string) (*FilterMatcher, error) {
+	filterMatchersLock.Lock()
+	defer filterMatchersLock.Unlock()
+
+	key := strings.Join(paths, "\n")
+	if m, ok := filterMatchers[key]; ok {
+		return m, nil
+	}
+
+	m := &FilterMatcher{
+		blocks:     ruleIndex{byToken: make(map[string][]*filterRule)},
+		exceptions: ruleIndex{byToken: make(map[string][]*filterRule)},
+	}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			rule := parseFilterRule(scanner.Text(), filepath.Base(p))
+			if rule == nil {
+				continue
+			}
+			if rule.exception {
+				m.exceptions.add(rule)
+			} else {
+				m.blocks.add(rule)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, errors.New("failed to read filter list " + p + ": " + err.Error())
+		}
+	}
+	filterMatchers[key] = m
+
+	return m, nil
+}
+
+// parseFilterRule parses a single line of a filter list, returning nil for comments, element hiding rules,
+// and any rules we can't or don't need to support
+func parseFilterRule(line string, list string) *filterRule {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil
+	}
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#", "#%#", "#@?#", "#@$#"} {
+		if strings.Contains(line, sep) {
+			return nil
+		}
+	}
+
+	rule := &filterRule{text: line, list: list}
+	s := line
+	if strings.HasPrefix(s, "@@") {
+		rule.exception = true
+		s = s[2:]
+	}
+
+	// Options follow the last $, except in regular expressions, which may contain $ themselves
+	if i := strings.LastIndex(s, "$"); i >= 0 && !strings.Contains(s[i+1:], "/") {
+		if !rule.parseOptions(s[i+1:]) {
+			return nil
+		}
+		s = s[:i]
+	}
+
+	if len(s) > 1 && s[0] == '/' && s[len(s)-1] == '/' {
+		expr := s[1 : len(s)-1]
+		if !rule.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil
+		}
+		rule.regex = re
+		return rule
+	}
+
+	if strings.HasPrefix(s, "||") {
+		rule.domainAnchor = true
+		s = s[2:]
+	} else if strings.HasPrefix(s, "|") {
+		rule.startAnchor = true
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "|") {
+		rule.endAnchor = true
+		s = s[:len(s)-1]
+	}
+	if !rule.domainAnchor && !rule.startAnchor {
+		s = strings.TrimLeft(s, "*")
+	}
+	if !rule.endAnchor {
+		s = strings.TrimRight(s, "*")
+	}
+	if !rule.matchCase {
+		s = strings.ToLower(s)
+	}
+	rule.pattern = s
+
+	return rule
+}
+
+// parseOptions parses the comma-separated options of a rule, returning false if the rule uses an option
+// we don't support
+func (r *filterRule) parseOptions(options string) bool {
+	for _, option := range strings.Split(options, ",") {
+		option = strings.ToLower(strings.TrimSpace(option))
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+
+		negated := strings.HasPrefix(name, "~")
+		name = strings.TrimPrefix(name, "~")
+
+		if t, ok := filterTypes[name]; ok {
+			if negated {
+				if r.notTypes == nil {
+					r.notTypes = make(map[string]bool)
+				}
+				r.notTypes[t] = true
+			} else {
+				if r.types == nil {
+					r.types = make(map[string]bool)
+				}
+				r.types[t] = true
+			}
+			continue
+		}
+
+		switch name {
+		case "third-party", "3p":
+			r.thirdParty = 1
+			if negated {
+				r.thirdParty = -1
+			}
+		case "first-party", "1p":
+			r.thirdParty = -1
+			if negated {
+				r.thirdParty = 1
+			}
+		case "domain":
+			for _, d := range strings.Split(value, "|") {
+				if strings.HasPrefix(d, "~") {
+					r.notDomains = append(r.notDomains, d[1:])
+				} else if d != "" {
+					r.domains = append(r.domains, d)
+				}
+			}
+		case "match-case":
+			r.matchCase = true
+		case "important":
+			r.important = true
+		case "all":
+			r.types = make(map[string]bool)
+			for _, t := range filterTypes {
+				r.types[t] = true
+			}
+		case "collapse":
+			// Only affects how blocked elements are hidden
+		default:
+			// Other options either change what the rule does (e.g., redirect or csp) rather than which
+			// requests it blocks, or restrict it in ways we can't check, so we skip the rule
+			return false
+		}
+	}
+
+	return true
+}
+
+// add adds a rule to the index, under the most useful token it contains
+func (idx *ruleIndex) add(r *filterRule) {
+	token := r.token()
+	if token == "" {
+		idx.others = append(idx.others, r)
+		return
+	}
+	idx.byToken[token] = append(idx.byToken[token], r)
+}
+
+// token picks out the longest run of token characters in the rule's pattern which must appear as a complete
+// run in any URL the rule matches, or "" if there is no such run
+func (r *filterRule) token() string {
+	if r.regex != nil {
+		return ""
+	}
+
+	p := strings.ToLower(r.pattern)
+	best := ""
+	for i := 0; i < len(p); {
+		if !isTokenChar(p[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p) && isTokenChar(p[j]) {
+			j++
+		}
+
+		// A run at an unanchored edge of the pattern, or next to a wildcard, may be part of a longer run in the URL
+		complete := (i > 0 && p[i-1] != '*') || (i == 0 && (r.domainAnchor || r.startAnchor))
+		complete = complete && ((j < len(p) && p[j] != '*') || (j == len(p) && r.endAnchor))
+		if complete && !commonFilterTokens[p[i:j]] && j-i > len(best) {
+			best = p[i:j]
+		}
+		i = j
+	}
+
+	return best
+}
+
+// candidates returns the rules in the index which might match a URL with the given tokens
+func (idx *ruleIndex) candidates(tokens []string) []*filterRule {
+	result := append([]*filterRule{}, idx.others...)
+	for _, t := range tokens {
+		result = append(result, idx.byToken[t]...)
+	}
+	return result
+}
+
+// A request, in the terms filter rules are written in
+type filterRequest struct {
+	url          string
+	lowerURL     string
+	host         string
+	resourceType string
+	documentHost string // Host of the document which made the request
+	thirdParty   bool
+	tokens       []string
+}
+
+// match returns the rule deciding whether the request would be blocked, and whether it would be. If no blocking
+// rule matches, the result is nil. An exception rule is returned (with false) if it overrides a blocking rule.
+func (m *FilterMatcher) match(req *filterRequest) (*filterRule, bool) {
+	var block *filterRule
+	for _, r := range m.blocks.candidates(req.tokens) {
+		if r.matches(req) {
+			block = r
+			if r.important {
+				return r, true
+			}
+		}
+	}
+	if block == nil {
+		return nil, false
+	}
+
+	for _, r := range m.exceptions.candidates(req.tokens) {
+		if r.matches(req) {
+			return r, false
+		}
+	}
+
+	return block, true
+}
+
+// documentException returns the exception rule with the $document option matching the URL of a document, if
+// any. Such a rule allows every request the document makes, turning off blocking for the whole page or frame.
+func (m *FilterMatcher) documentException(docURL string) *filterRule {
+	u, err := url.Parse(docURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+
+	req := &filterRequest{
+		url:          docURL,
+		lowerURL:     strings.ToLower(docURL),
+		host:         strings.ToLower(u.Hostname()),
+		resourceType: "document",
+		documentHost: strings.ToLower(u.Hostname()),
+	}
+	req.tokens = urlTokens(req.lowerURL)
+	for _, r := range m.exceptions.candidates(req.tokens) {
+		if r.types["document"] && r.matches(req) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if the rule applies to the given request
+func (r *filterRule) matches(req *filterRequest) bool {
+	if r.types != nil && !r.types[req.resourceType] {
+		return false
+	}
+	if r.types == nil && req.resourceType == "document" {
+		return false
+	}
+	if r.notTypes[req.resourceType] {
+		return false
+	}
+	if (r.thirdParty == 1 && !req.thirdParty) || (r.thirdParty == -1 && req.thirdParty) {
+		return false
+	}
+
+	for _, d := range r.notDomains {
+		if domainMatches(req.documentHost, d) {
+			return false
+		}
+	}
+	if len(r.domains) > 0 {
+		found := false
+		for _, d := range r.domains {
+			if domainMatches(req.documentHost, d) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.regex != nil {
+		return r.regex.MatchString(req.url)
+	}
+
+	s := req.lowerURL
+	if r.matchCase {
+		s = req.url
+	}
+
+	if r.domainAnchor {
+		hostStart := strings.Index(s, "://")
+		if hostStart < 0 {
+			return false
+		}
+		hostStart += 3
+		for i := hostStart; i < hostStart+len(req.host) && i < len(s); i++ {
+			if (i == hostStart || s[i-1] == '.') && matchPattern(r.pattern, s[i:], r.endAnchor) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if r.startAnchor {
+		return matchPattern(r.pattern, s, r.endAnchor)
+	}
+
+	// Skip straight to the places where the literal start of the pattern appears
+	literal := r.pattern
+	if i := strings.IndexAny(literal, "*^"); i >= 0 {
+		literal = literal[:i]
+	}
+	for i := 0; i <= len(s); i++ {
+		if literal != "" {
+			j := strings.Index(s[i:], literal)
+			if j < 0 {
+				return false
+			}
+			i += j
+		}
+		if matchPattern(r.pattern, s[i:], r.endAnchor) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern matches a filter pattern against the start of s. A * matches any run of characters, and a ^
+// matches a single separator character or the end of s. If anchorEnd is set, the pattern must match all of s.
+func matchPattern(p string, s string, anchorEnd bool) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			p = p[1:]
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(p, s[i:], anchorEnd) {
+					return true
+				}
+			}
+			return false
+		case '^':
+			if len(s) == 0 {
+				p = p[1:]
+				continue
+			}
+			if !isSeparator(s[0]) {
+				return false
+			}
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+		}
+		p = p[1:]
+		s = s[1:]
+	}
+
+	return !anchorEnd || len(s) == 0
+}
+
+// isSeparator returns true for the characters matched by ^ in a filter pattern
+func isSeparator(c byte) bool {
+	return !isTokenChar(c) && !(c >= 'A' && c <= 'Z') && c != '_' && c != '-' && c != '.'
+}
+
+// isTokenChar returns true for the characters making up the tokens used to index filter rules
+func isTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '%'
+}
+
+// urlTokens splits a (lowercased) URL into the distinct runs of token characters it contains
+func urlTokens(s string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for i := 0; i < len(s); {
+		if !isTokenChar(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isTokenChar(s[j]) {
+			j++
+		}
+		if !seen[s[i:j]] {
+			seen[s[i:j]] = true
+			tokens = append(tokens, s[i:j])
+		}
+		i = j
+	}
+
+	return tokens
+}
+
+// domainMatches returns true if host is the given domain or one of its subdomains
+func domainMatches(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// filterResourceType converts the type of a request to the resource type named in filter rules
+func filterResourceType(req *network.EventRequestWillBeSent, mainFrame cdp.FrameID) string {
+	switch req.Type {
+	case network.ResourceTypeDocument:
+		if mainFrame != "" && req.FrameID != mainFrame {
+			return "subdocument"
+		}
+		return "document"
+	case network.ResourceTypeStylesheet:
+		return "stylesheet"
+	case network.ResourceTypeImage:
+		return "image"
+	case network.ResourceTypeMedia:
+		return "media"
+	case network.ResourceTypeFont:
+		return "font"
+	case network.ResourceTypeScript:
+		return "script"
+	case network.ResourceTypeXHR, network.ResourceTypeFetch, network.ResourceTypeEventSource:
+		return "xmlhttprequest"
+	case network.ResourceTypeWebSocket:
+		return "websocket"
+	case network.ResourceTypePing, network.ResourceTypeCSPViolationReport:
+		return "ping"
+	default:
+		return "other"
+	}
+}
+
+// FilterLists matches each request made during a site visit against the given filter lists. It returns the
+// deciding rule for each request which any blocking rule matched, keyed by request ID. Each URL in a chain of
+// redirects is checked in turn, as the browser would, and the first one which a blocking rule matches decides.
+// An exception rule with the $document option matching the page allows every request the page makes, and one
+// matching a frame allows every request the frame makes, just as blockers do. Important rules still block.
+func FilterLists(rr *b.RawResult, m *FilterMatcher) map[string]b.FilterMatch {
+	result := make(map[string]b.FilterMatch)
+
+	// $document exceptions for each document making requests, looked up once per document
+	documentExceptions := make(map[string]*filterRule)
+	documentException := func(docURL string) *filterRule {
+		if r, ok := documentExceptions[docURL]; ok {
+			return r
+		}
+		r := m.documentException(docURL)
+		documentExceptions[docURL] = r
+		return r
+	}
+
+	pageAddress := pageURL(rr)
+	page, _ := url.Parse(pageAddress)
+	var mainFrame cdp.FrameID
+	if requests := pageRequests(rr); requests != nil {
+		mainFrame = requests[0].FrameID
+	}
+
+	for k, requests := range rr.DevTools.Network.RequestWillBeSent {
+		for i := range requests {
+			req := &requests[i]
+			if req.Request == nil {
+				continue
+			}
+			u, err := url.Parse(req.Request.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss") {
+				continue
+			}
+
+			// Rules refer to the document which made the request, which may be a frame rather than the page
+			documentHost := ""
+			if d, err := url.Parse(req.DocumentURL); err == nil && d.Hostname() != "" {
+				documentHost = d.Hostname()
+			} else if page != nil {
+				documentHost = page.Hostname()
+			}
+
+			fr := &filterRequest{
+				url:          req.Request.URL,
+				lowerURL:     strings.ToLower(req.Request.URL),
+				host:         strings.ToLower(u.Hostname()),
+				resourceType: filterResourceType(req, mainFrame),
+				documentHost: strings.ToLower(documentHost),
+			}
+			fr.thirdParty = b.Site(fr.host) != b.Site(fr.documentHost)
+			fr.tokens = urlTokens(fr.lowerURL)
+
+			rule, blocked := m.match(fr)
+			if rule == nil {
+				continue
+			}
+			if blocked && !rule.important {
+				if ex := documentException(pageAddress); ex != nil {
+					rule = ex
+				} else if ex := documentException(req.DocumentURL); ex != nil {
+					rule = ex
+				}
+			}
+			result[k] = b.FilterMatch{
+				List:      rule.list,
+				Rule:      rule.text,
+				URL:       req.Request.URL,
+				Exception: rule.exception,
+			}
+			break
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,289 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/network"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestFilterList writes a filter list made up of the given rules, returning its path
+func writeTestFilterList(t *testing.T, name string, rules ...string) string {
+	p := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(p, []byte(strings.Join(rules, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseFilterRule(t *testing.T) {
+	tests := []struct {
+		line string
+		want *filterRule // Only the fields parsing sets are compared (text and list are filled in)
+	}{
+		{line: "! A comment", want: nil},
+		{line: "[Adblock Plus 2.0]", want: nil},
+		{line: "example.com##.ad", want: nil},
+		{line: "example.com#@#.ad", want: nil},
+		{line: "/ads/*$redirect=noop.js", want: nil},
+		{line: "", want: nil},
+		{
+			line: "/banner/*/img^",
+			want: &filterRule{pattern: "/banner/*/img^"},
+		},
+		{
+			line: "||Ads.Example.com^",
+			want: &filterRule{pattern: "ads.example.com^", domainAnchor: true},
+		},
+		{
+			line: "|https://tracker.|",
+			want: &filterRule{pattern: "https://tracker.", startAnchor: true, endAnchor: true},
+		},
+		{
+			line: "**/pixel.gif**",
+			want: &filterRule{pattern: "/pixel.gif"},
+		},
+		{
+			line: "/Track.js$match-case",
+			want: &filterRule{pattern: "/Track.js", matchCase: true},
+		},
+		{
+			line: "@@||cdn.example.com^$script,~third-party",
+			want: &filterRule{pattern: "cdn.example.com^", domainAnchor: true, exception: true,
+				types: map[string]bool{"script": true}, thirdParty: -1},
+		},
+		{
+			line: "||ads.example.com^$important,3p,~image,domain=news.com|~sports.news.com",
+			want: &filterRule{pattern: "ads.example.com^", domainAnchor: true, important: true, thirdParty: 1,
+				notTypes: map[string]bool{"image": true}, domains: []string{"news.com"},
+				notDomains: []string{"sports.news.com"}},
+		},
+		{
+			line: "@@||example.org^$document",
+			want: &filterRule{pattern: "example.org^", domainAnchor: true, exception: true,
+				types: map[string]bool{"document": true}},
+		},
+		{
+			line: "||beacon.example.com^$xhr,beacon",
+			want: &filterRule{pattern: "beacon.example.com^", domainAnchor: true,
+				types: map[string]bool{"xmlhttprequest": true, "ping": true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			got := parseFilterRule(test.line, "list.txt")
+			if test.want == nil {
+				if got != nil {
+					t.Fatalf("got rule %+v, want none", *got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("got no rule")
+			}
+			test.want.text = test.line
+			test.want.list = "list.txt"
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, *test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterRuleRegex(t *testing.T) {
+	rule := parseFilterRule(`/^https?:\/\/[a-z]+\.ads\.com\/$/$script`, "list.txt")
+	if rule == nil || rule.regex == nil {
+		t.Fatal("regex rule was not parsed")
+	}
+	if !rule.types["script"] {
+		t.Error("options after a regex were not parsed")
+	}
+	if !rule.regex.MatchString("https://CDN.ads.com/") {
+		t.Error("regex rule is not case-insensitive")
+	}
+
+	if rule := parseFilterRule(`/unclosed(/`, "list.txt"); rule != nil {
+		t.Error("invalid regex was parsed")
+	}
+}
+
+// testFilterRequest describes a request made by the page at https://www.news.com/ (or a frame within it)
+type testFilterRequest struct {
+	id           string
+	resourceType network.ResourceType
+	url          string
+	documentURL  string
+}
+
+func TestFilterLists(t *testing.T) {
+	const pageAddress = "https://www.news.com/"
+	requests := []testFilterRequest{
+		{"page", network.ResourceTypeDocument, pageAddress, pageAddress},
+		{"ad", network.ResourceTypeScript, "https://ads.example.com/ad.js", pageAddress},
+		{"image", network.ResourceTypeImage, "https://ads.example.com/banner.png", pageAddress},
+		{"own", network.ResourceTypeScript, "https://www.news.com/ads/ad.js", pageAddress},
+		{"frame", network.ResourceTypeDocument, "https://widgets.example.net/frame.html", pageAddress},
+		{"in frame", network.ResourceTypeScript, "https://ads.example.com/frame.js",
+			"https://widgets.example.net/frame.html"},
+	}
+
+	tests := []struct {
+		name  string
+		rules []string
+		want  map[string]string // Rule matching each request, prefixed with "@@" if it is an exception
+	}{
+		{
+			name:  "blocking rules",
+			rules: []string{"||ads.example.com^$third-party", "/ads/*"},
+			want: map[string]string{
+				"ad":       "||ads.example.com^$third-party",
+				"image":    "||ads.example.com^$third-party",
+				"own":      "/ads/*",
+				"in frame": "||ads.example.com^$third-party",
+			},
+		},
+		{
+			name:  "type options",
+			rules: []string{"||ads.example.com^$script"},
+			want: map[string]string{
+				"ad":       "||ads.example.com^$script",
+				"in frame": "||ads.example.com^$script",
+			},
+		},
+		{
+			name:  "request exception",
+			rules: []string{"||ads.example.com^", "@@||ads.example.com/banner.png"},
+			want: map[string]string{
+				"ad":       "||ads.example.com^",
+				"image":    "@@||ads.example.com/banner.png",
+				"in frame": "||ads.example.com^",
+			},
+		},
+		{
+			name:  "page document exception",
+			rules: []string{"||ads.example.com^", "/ads/*", "@@||news.com^$document"},
+			want: map[string]string{
+				"ad":       "@@||news.com^$document",
+				"image":    "@@||news.com^$document",
+				"own":      "@@||news.com^$document",
+				"in frame": "@@||news.com^$document",
+			},
+		},
+		{
+			name:  "frame document exception",
+			rules: []string{"||ads.example.com^", "@@||widgets.example.net^$document"},
+			want: map[string]string{
+				"ad":       "||ads.example.com^",
+				"image":    "||ads.example.com^",
+				"in frame": "@@||widgets.example.net^$document",
+			},
+		},
+		{
+			name:  "important rules ignore document exceptions",
+			rules: []string{"||ads.example.com^$script,important", "@@||news.com^$document"},
+			want: map[string]string{
+				"ad":       "||ads.example.com^$script,important",
+				"in frame": "||ads.example.com^$script,important",
+			},
+		},
+		{
+			name:  "document exceptions need a blocked request",
+			rules: []string{"@@||news.com^$document"},
+			want:  map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := newTestRawResult(t, pageAddress)
+			for _, req := range requests {
+				addTestRequest(rr, req.id, req.resourceType, req.url, req.documentURL)
+			}
+
+			m, err := LoadFilterLists([]string{writeTestFilterList(t, "list.txt", test.rules...)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for k, match := range FilterLists(rr, m) {
+				if match.List != "list.txt" {
+					t.Errorf("request %s matched a rule from %s", k, match.List)
+				}
+				if match.Exception != strings.HasPrefix(match.Rule, "@@") {
+					t.Errorf("request %s matched rule %s with exception %v", k, match.Rule, match.Exception)
+				}
+				got[k] = match.Rule
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got matches %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterListsPostprocessorGlobalLists(t *testing.T) {
+	globalList := writeTestFilterList(t, "global.txt", "||ads.example.com^")
+	taskList := writeTestFilterList(t, "task.txt", "||tracker.example.org^")
+	defer SetGlobalFilterLists(GlobalFilterLists())
+
+	tests := []struct {
+		name        string
+		globalLists []string
+		taskLists   []string
+		wantErr     bool
+		wantMatches map[string]int
+	}{
+		{
+			name:        "global lists",
+			globalLists: []string{globalList},
+			wantMatches: map[string]int{"global.txt": 1},
+		},
+		{
+			name:        "task lists replace global lists",
+			globalLists: []string{globalList},
+			taskLists:   []string{taskList},
+			wantMatches: map[string]int{"task.txt": 1},
+		},
+		{
+			name:        "task lists alone",
+			taskLists:   []string{taskList},
+			wantMatches: map[string]int{"task.txt": 1},
+		},
+		{
+			name:    "no lists",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetGlobalFilterLists(test.globalLists)
+			rr := newTestRawResult(t, "https://www.news.com/")
+			*rr.TaskSummary.TaskWrapper.SanitizedTask.PPS.FilterLists = test.taskLists
+			addTestRequest(rr, "ad", network.ResourceTypeScript, "https://ads.example.com/ad.js",
+				"https://www.news.com/")
+			addTestRequest(rr, "tracker", network.ResourceTypeImage, "https://tracker.example.org/p.gif",
+				"https://www.news.com/")
+
+			fr := newTestFinalResult(rr)
+			err := filterLists(rr, fr)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fr.Summary.FilterListMatches, test.wantMatches) {
+				t.Errorf("got matches %v, want %v", fr.Summary.FilterListMatches, test.wantMatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"testing"
+)
+
+// testFrame is the frame every test request is made from, so the page's frame is the main frame
+const testFrame = "main"
+
+// newTestRawResult builds the raw result of a visit to taskURL which has not recorded anything yet. The task's
+// temporary directory is removed once the test finishes.
+func newTestRawResult(t *testing.T, taskURL string) *b.RawResult {
+	tw := &b.TaskWrapper{
+		TempDir: t.TempDir(),
+		Log:     logrus.New(),
+	}
+	tw.Log.SetOutput(ioutil.Discard)
+	tw.SanitizedTask.URL = taskURL
+	tw.SanitizedTask.DS = *b.AllocateNewDataSettings()
+	tw.SanitizedTask.PPS = *b.AllocateNewPostprocessSettings()
+
+	return &b.RawResult{
+		TaskSummary: b.TaskSummary{TaskWrapper: tw},
+		DevTools: b.DevToolsRawData{
+			Network: b.DevtoolsNetworkRawData{
+				RequestWillBeSent: make(map[string][]network.EventRequestWillBeSent),
+				ResponseReceived:  make(map[string]network.EventResponseReceived),
+				LoadingFinished:   make(map[string]network.EventLoadingFinished),
+				LoadingFailed:     make(map[string]network.EventLoadingFailed),
+			},
+			Debugger: b.DevToolsDebuggerRawData{
+				ScriptParsed: make(map[string]debugger.EventScriptParsed),
+			},
+		},
+	}
+}
+
+// addTestRequest records a request for requestURL made by the document at documentURL. Calling it again with
+// the same request ID records a redirect.
+func addTestRequest(rr *b.RawResult, requestID string, resourceType network.ResourceType, requestURL string,
+	documentURL string) {
+	rr.DevTools.Network.RequestWillBeSent[requestID] = append(rr.DevTools.Network.RequestWillBeSent[requestID],
+		network.EventRequestWillBeSent{
+			RequestID:   network.RequestID(requestID),
+			Request:     &network.Request{URL: requestURL, Method: "GET"},
+			DocumentURL: documentURL,
+			Type:        resourceType,
+			FrameID:     testFrame,
+		})
+}
+
+// addTestResponse records the response to a request, along with its loading finishing
+func addTestResponse(rr *b.RawResult, requestID string, resourceType network.ResourceType, responseURL string,
+	status int64, headers map[string]string) {
+	h := make(network.Headers)
+	for k, v := range headers {
+		h[k] = v
+	}
+	rr.DevTools.Network.ResponseReceived[requestID] = network.EventResponseReceived{
+		RequestID: network.RequestID(requestID),
+		Type:      resourceType,
+		Response:  &network.Response{URL: responseURL, Status: status, Headers: h},
+	}
+	rr.DevTools.Network.LoadingFinished[requestID] = network.EventLoadingFinished{
+		RequestID: network.RequestID(requestID),
+	}
+}
+
+// newTestFinalResult builds the final result postprocessors add their results to
+func newTestFinalResult(rr *b.RawResult) *b.FinalResult {
+	return &b.FinalResult{
+		Summary:            rr.TaskSummary,
+		DTResourceMetadata: make(map[string]b.DTResource),
+		Sections:           make(map[string]interface{}),
+		Files:              make(map[string][]byte),
+	}
+}
@@ -0,0 +1,365 @@
+package postprocess
+
+import (
+	"encoding/base64"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const harPageID = "page_1"
+
+// HAR builds a HAR 1.2 archive from the resource metadata gathered for a site visit. Each hop of a
+// redirect chain becomes its own entry, and requests which never got a response (because they failed,
+// were blocked or were canceled) get an entry with a status of 0 and the reason in its _error field.
+// If includeBodies is set, response bodies are read from the resources directory in the task's
+// temporary directory, so HAR must be called before storage.
+func HAR(rr *b.RawResult, resources map[string]b.DTResource, includeBodies bool) (*b.HAR, error) {
+	tw := rr.TaskSummary.TaskWrapper
+
+	har := b.HAR{
+		Log: b.HARLog{
+			Version: "1.2",
+			Creator: b.HARCreator{
+				Name:    "MIDA",
+				Version: rr.CrawlerInfo.MidaVersion,
+			},
+			Pages:   make([]b.HARPage, 0),
+			Entries: make([]b.HAREntry, 0),
+		},
+	}
+	if rr.CrawlerInfo.Browser != "" {
+		har.Log.Browser = &b.HARCreator{
+			Name:    rr.CrawlerInfo.Browser,
+			Version: rr.CrawlerInfo.BrowserVersion,
+		}
+	}
+
+	// The resource metadata only covers requests which got a response
+	all := make(map[string]b.DTResource, len(resources))
+	for requestID, resource := range resources {
+		all[requestID] = resource
+	}
+	for requestID, requests := range rr.DevTools.Network.RequestWillBeSent {
+		if _, ok := all[requestID]; !ok {
+			all[requestID] = b.DTResource{Requests: requests}
+		}
+	}
+
+	// Entries are sorted by when they started once they have all been built
+	started := make(map[int]time.Time)
+
+	var pageStart time.Time
+	for requestID, resource := range all {
+		for i, req := range resource.Requests {
+			if req.Request == nil {
+				continue
+			}
+
+			// The response to each hop in a redirect chain arrives with the next request
+			var resp *network.Response
+			var finished *network.EventLoadingFinished
+			isLastHop := i == len(resource.Requests)-1
+			if isLastHop {
+				resp = resource.Response.Response
+				if lf, ok := rr.DevTools.Network.LoadingFinished[requestID]; ok {
+					finished = &lf
+				}
+			} else {
+				resp = resource.Requests[i+1].RedirectResponse
+			}
+
+			entry := b.HAREntry{
+				PageRef:      harPageID,
+				Request:      harRequest(req.Request, resp),
+				Response:     harResponse(resp, finished),
+				Timings:      harTimings(resp, finished),
+				RequestID:    requestID,
+				ResourceType: req.Type.String(),
+			}
+
+			if req.WallTime != nil {
+				t := req.WallTime.Time()
+				entry.StartedDateTime = t.Format(time.RFC3339Nano)
+				started[len(har.Log.Entries)] = t
+				if pageStart.IsZero() || t.Before(pageStart) {
+					pageStart = t
+				}
+			}
+
+			if resp != nil {
+				entry.ServerIPAddress = resp.RemoteIPAddress
+				if resp.ConnectionID != 0 {
+					entry.Connection = strconv.FormatFloat(resp.ConnectionID, 'f', -1, 64)
+				}
+			}
+
+			if !isLastHop {
+				entry.Response.RedirectURL = resource.Requests[i+1].Request.URL
+			} else if resp == nil {
+				entry.Response.Error = harError(rr, requestID)
+			}
+
+			if isLastHop && includeBodies {
+				body, err := ioutil.ReadFile(path.Join(tw.TempDir, b.DefaultResourceSubdir, requestID))
+				if err == nil {
+					entry.Response.Content.Size = int64(len(body))
+					if utf8.Valid(body) {
+						entry.Response.Content.Text = string(body)
+					} else {
+						entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+						entry.Response.Content.Encoding = "base64"
+					}
+				}
+			}
+
+			for _, t := range []float64{entry.Timings.Blocked, entry.Timings.DNS, entry.Timings.Connect,
+				entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive} {
+				if t > 0 {
+					entry.Time += t
+				}
+			}
+
+			har.Log.Entries = append(har.Log.Entries, entry)
+		}
+	}
+
+	order := make([]int, len(har.Log.Entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return started[order[i]].Before(started[order[j]])
+	})
+	entries := make([]b.HAREntry, 0, len(order))
+	for _, i := range order {
+		entries = append(entries, har.Log.Entries[i])
+	}
+	har.Log.Entries = entries
+
+	page := b.HARPage{
+		ID:    harPageID,
+		Title: tw.SanitizedTask.URL,
+		PageTimings: b.HARPageTimings{
+			OnContentLoad: -1,
+			OnLoad:        -1,
+		},
+	}
+	if !pageStart.IsZero() {
+		page.StartedDateTime = pageStart.Format(time.RFC3339Nano)
+		timing := rr.TaskSummary.TaskTiming
+		if !timing.DOMContentEvent.IsZero() {
+			page.PageTimings.OnContentLoad = milliseconds(timing.DOMContentEvent.Sub(pageStart))
+		}
+		if !timing.LoadEvent.IsZero() {
+			page.PageTimings.OnLoad = milliseconds(timing.LoadEvent.Sub(pageStart))
+		}
+	}
+	har.Log.Pages = append(har.Log.Pages, page)
+
+	return &har, nil
+}
+
+func harRequest(req *network.Request, resp *network.Response) b.HARRequest {
+	result := b.HARRequest{
+		Method:      req.Method,
+		URL:         req.URL,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     make([]b.HARCookie, 0),
+		Headers:     harHeaders(req.Headers),
+		QueryString: make([]b.HARNameValue, 0),
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+
+	// Chrome adds headers (cookies, etc.) after Network.requestWillBeSent fires, so prefer
+	// the headers which were actually sent if the response tells us what they were
+	if resp != nil {
+		if len(resp.RequestHeaders) > 0 {
+			result.Headers = harHeaders(resp.RequestHeaders)
+		}
+		if resp.Protocol != "" {
+			result.HTTPVersion = harHTTPVersion(resp.Protocol)
+		}
+	}
+
+	if u, err := url.Parse(req.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				result.QueryString = append(result.QueryString, b.HARNameValue{Name: name, Value: value})
+			}
+		}
+		sort.SliceStable(result.QueryString, func(i, j int) bool {
+			return result.QueryString[i].Name < result.QueryString[j].Name
+		})
+	}
+
+	if req.HasPostData {
+		result.PostData = &b.HARPostData{
+			MimeType: headerValue(req.Headers, "Content-Type"),
+			Text:     req.PostData,
+		}
+		result.BodySize = int64(len(req.PostData))
+	}
+
+	return result
+}
+
+func harResponse(resp *network.Response, finished *network.EventLoadingFinished) b.HARResponse {
+	result := b.HARResponse{
+		Cookies:     make([]b.HARCookie, 0),
+		Headers:     make([]b.HARNameValue, 0),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if resp == nil {
+		// No response was received for this request (e.g., it failed or was blocked)
+		return result
+	}
+
+	result.Status = resp.Status
+	result.StatusText = resp.StatusText
+	result.HTTPVersion = harHTTPVersion(resp.Protocol)
+	result.Headers = harHeaders(resp.Headers)
+	result.RedirectURL = headerValue(resp.Headers, "Location")
+	result.Content.MimeType = resp.MimeType
+
+	// EncodedDataLength on the response only counts the headers received so far, while
+	// the loading finished event gives us the total size transferred over the network
+	if finished != nil {
+		result.BodySize = int64(finished.EncodedDataLength - resp.EncodedDataLength)
+		if result.BodySize < 0 {
+			result.BodySize = 0
+		}
+	}
+
+	return result
+}
+
+// harError describes why a request never got a response
+func harError(rr *b.RawResult, requestID string) string {
+	failed, ok := rr.DevTools.Network.LoadingFailed[requestID]
+	if !ok {
+		return "no response received"
+	}
+	if failed.BlockedReason != "" {
+		return "blocked: " + failed.BlockedReason.String()
+	}
+	if failed.ErrorText != "" {
+		return failed.ErrorText
+	}
+	if failed.Canceled {
+		return "canceled"
+	}
+	return "loading failed"
+}
+
+// harTimings converts the DevTools ResourceTiming for a response into HAR timings. ResourceTiming
+// values are milliseconds relative to RequestTime, with -1 marking phases which did not occur.
+func harTimings(resp *network.Response, finished *network.EventLoadingFinished) b.HARTimings {
+	result := b.HARTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		Send:    0,
+		Wait:    0,
+		Receive: 0,
+		SSL:     -1,
+	}
+	if resp == nil || resp.Timing == nil {
+		return result
+	}
+	t := resp.Timing
+
+	// Time spent queued before any network activity began
+	for _, start := range []float64{t.DNSStart, t.ConnectStart, t.SendStart} {
+		if start >= 0 {
+			result.Blocked = start
+			break
+		}
+	}
+
+	if t.DNSStart >= 0 && t.DNSEnd >= 0 {
+		result.DNS = t.DNSEnd - t.DNSStart
+	}
+	if t.ConnectStart >= 0 && t.ConnectEnd >= 0 {
+		result.Connect = t.ConnectEnd - t.ConnectStart
+	}
+	if t.SslStart >= 0 && t.SslEnd >= 0 {
+		result.SSL = t.SslEnd - t.SslStart
+	}
+	if t.SendStart >= 0 && t.SendEnd >= 0 {
+		result.Send = t.SendEnd - t.SendStart
+	}
+	if t.SendEnd >= 0 && t.ReceiveHeadersEnd >= 0 {
+		result.Wait = t.ReceiveHeadersEnd - t.SendEnd
+	}
+
+	if finished != nil && finished.Timestamp != nil && t.ReceiveHeadersEnd >= 0 {
+		finishedAt := finished.Timestamp.Time().Sub(*cdp.MonotonicTimeEpoch).Seconds() * 1000
+		headersReceivedAt := t.RequestTime*1000 + t.ReceiveHeadersEnd
+		if finishedAt > headersReceivedAt {
+			result.Receive = finishedAt - headersReceivedAt
+		}
+	}
+
+	return result
+}
+
+// harHeaders converts DevTools headers to a sorted list of HAR name/value pairs. DevTools joins
+// repeated headers (Set-Cookie, for example) with newlines, so we split them back apart.
+func harHeaders(headers network.Headers) []b.HARNameValue {
+	result := make([]b.HARNameValue, 0, len(headers))
+	for name, value := range headers {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, v := range strings.Split(s, "\n") {
+			result = append(result, b.HARNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+
+	return result
+}
+
+// headerValue does a case-insensitive lookup of a header, returning "" if it is not present
+func headerValue(headers network.Headers, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			if s, ok := v.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// harHTTPVersion converts DevTools protocol names ("http/1.1", "h2", etc.) to HAR format
+func harHTTPVersion(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case "":
+		return ""
+	case "h2":
+		return "HTTP/2"
+	case "h3", "http/2+quic/46", "quic":
+		return "HTTP/3"
+	default:
+		return strings.ToUpper(protocol)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
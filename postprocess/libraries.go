@@ -0,0 +1,269 @@
+package postprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Ways in which a library can be identified, from most to least reliable
+const (
+	LibraryByHash   = "hash"   // The script is byte-for-byte a known release of the library
+	LibraryByBanner = "banner" // The script contains the library's version banner (e.g., a license comment)
+	LibraryByURL    = "url"    // The script's URL names the library and version (e.g., jquery-3.4.1.min.js)
+)
+
+// libraryDBFile is the format of a library database file. For each library, banners and URL patterns are regular
+// expressions whose first capture group (if any) is the version, and hashes map SHA-256 hashes (hex) of known
+// release files to their versions.
+type libraryDBFile struct {
+	Libraries []struct {
+		Name    string            `json:"name"`
+		Banners []string          `json:"banners"`
+		URLs    []string          `json:"urls"`
+		Hashes  map[string]string `json:"hashes"`
+	} `json:"libraries"`
+}
+
+// A known library, ready for matching
+type knownLibrary struct {
+	name    string
+	banners []*regexp.Regexp
+	urls    []*regexp.Regexp
+}
+
+// A LibraryDB is a database of known JavaScript libraries and their versions
+type LibraryDB struct {
+	libraries []knownLibrary
+	hashes    map[string]b.Library // Name and version of each known release file, keyed by hash
+}
+
+// Library databases are shared by every task using them, so each is only read once
+var (
+	libraryDBs     = make(map[string]*LibraryDB)
+	libraryDBsLock sync.Mutex
+)
+
+// LoadLibraryDB reads the library database at the given path, or returns the copy already read
+func LoadLibraryDB(p string) (*LibraryDB, error) {
+	libraryDBsLock.Lock()
+	defer libraryDBsLock.Unlock()
+
+	if db, ok := libraryDBs[p]; ok {
+		return db, nil
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw libraryDBFile
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.New("failed to parse library database: " + err.Error())
+	}
+
+	db := &LibraryDB{hashes: make(map[string]b.Library)}
+	for _, lib := range raw.Libraries {
+		if lib.Name == "" {
+			return nil, errors.New("library database contains a library with no name")
+		}
+
+		known := knownLibrary{name: lib.Name}
+		for _, expr := range lib.Banners {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.New("invalid banner pattern for library " + lib.Name + ": " + err.Error())
+			}
+			known.banners = append(known.banners, re)
+		}
+		for _, expr := range lib.URLs {
+			re, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, errors.New("invalid URL pattern for library " + lib.Name + ": " + err.Error())
+			}
+			known.urls = append(known.urls, re)
+		}
+		for hash, version := range lib.Hashes {
+			db.hashes[strings.ToLower(hash)] = b.Library{Name: lib.Name, Version: version}
+		}
+		db.libraries = append(db.libraries, known)
+	}
+	libraryDBs[p] = db
+
+	return db, nil
+}
+
+// Libraries identifies the known JavaScript libraries loaded by a page. Scripts whose bodies were saved are
+// identified by hash (using the hashes already computed for the bodies, if any) and then by version banner.
+// Inline and eval'd scripts, which the debugger saw parsed but which have no request of their own, are
+// identified in the same way from the sources saved during the visit. Any other script can only be identified
+// by URL.
+func Libraries(rr *b.RawResult, db *LibraryDB, bodyHashes map[string]string) ([]b.Library, error) {
+	result := make([]b.Library, 0)
+	seen := make(map[b.Library]bool)
+	add := func(lib b.Library) {
+		// The same script may be loaded more than once, but we report it once
+		key := b.Library{Name: lib.Name, Version: lib.Version, URL: lib.URL}
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, lib)
+		}
+	}
+
+	tw := rr.TaskSummary.TaskWrapper
+	resourceDir := path.Join(tw.TempDir, b.DefaultResourceSubdir)
+	requestURLs := make(map[string]bool)
+
+	for k, requests := range rr.DevTools.Network.RequestWillBeSent {
+		if len(requests) == 0 || requests[len(requests)-1].Request == nil {
+			continue
+		}
+		req := requests[len(requests)-1]
+		requestURLs[req.Request.URL] = true
+
+		resp, hasResponse := rr.DevTools.Network.ResponseReceived[k]
+		isScript := req.Type == network.ResourceTypeScript
+		if hasResponse && resp.Response != nil && strings.Contains(resp.Response.MimeType, "javascript") {
+			isScript = true
+		}
+		if !isScript {
+			continue
+		}
+
+		bodyFile := path.Join(resourceDir, k)
+		if _, err := os.Stat(bodyFile); err == nil {
+			libs, err := db.sourceLibraries(bodyFile, bodyHashes[k])
+			if err != nil {
+				return result, err
+			}
+			if len(libs) > 0 {
+				for _, lib := range libs {
+					lib.URL, lib.RequestID = req.Request.URL, k
+					add(lib)
+				}
+				continue
+			}
+		}
+
+		if lib, ok := db.urlLibrary(req.Request.URL); ok {
+			lib.RequestID, lib.Method = k, LibraryByURL
+			add(lib)
+		}
+	}
+
+	sourceDir := path.Join(tw.TempDir, b.DefaultScriptSourceSubdir)
+	for id, script := range rr.DevTools.Debugger.ScriptParsed {
+		sourceFile := path.Join(sourceDir, id)
+		if _, err := os.Stat(sourceFile); err == nil {
+			libs, err := db.sourceLibraries(sourceFile, "")
+			if err != nil {
+				return result, err
+			}
+			if len(libs) > 0 {
+				for _, lib := range libs {
+					lib.URL, lib.ScriptID = script.URL, id
+					add(lib)
+				}
+				continue
+			}
+		}
+
+		if script.URL == "" || requestURLs[script.URL] {
+			continue
+		}
+		if lib, ok := db.urlLibrary(script.URL); ok {
+			lib.ScriptID, lib.Method = id, LibraryByURL
+			add(lib)
+		}
+	}
+
+	return result, nil
+}
+
+// sourceLibraries identifies the libraries in the script source saved at the given path, first by its hash
+// (computed here if not given) and then by version banners
+func (db *LibraryDB) sourceLibraries(sourceFile string, hash string) ([]b.Library, error) {
+	if hash == "" {
+		var err error
+		hash, err = fileHash(sourceFile)
+		if err != nil {
+			return nil, errors.New("failed to hash script: " + err.Error())
+		}
+	}
+	if lib, ok := db.hashes[hash]; ok {
+		lib.Method = LibraryByHash
+		return []b.Library{lib}, nil
+	}
+
+	libs, err := db.bannerLibraries(sourceFile)
+	if err != nil {
+		return nil, errors.New("failed to read script: " + err.Error())
+	}
+	for i := range libs {
+		libs[i].Method = LibraryByBanner
+	}
+
+	return libs, nil
+}
+
+// bannerLibraries returns the libraries whose version banners appear in the given script. A bundled script
+// may contain several libraries.
+func (db *LibraryDB) bannerLibraries(bodyFile string) ([]b.Library, error) {
+	f, err := os.Open(bodyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(f, b.DefaultLibraryScanLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	var libs []b.Library
+	for _, known := range db.libraries {
+		for _, re := range known.banners {
+			m := re.FindSubmatch(body)
+			if m == nil {
+				continue
+			}
+			lib := b.Library{Name: known.name}
+			if len(m) > 1 {
+				lib.Version = string(m[1])
+			}
+			libs = append(libs, lib)
+			break
+		}
+	}
+
+	return libs, nil
+}
+
+// urlLibrary returns the library named by a script's URL, if any
+func (db *LibraryDB) urlLibrary(scriptURL string) (b.Library, bool) {
+	for _, known := range db.libraries {
+		for _, re := range known.urls {
+			m := re.FindStringSubmatch(scriptURL)
+			if m == nil {
+				continue
+			}
+			lib := b.Library{Name: known.name, URL: scriptURL}
+			if len(m) > 1 {
+				lib.Version = m[1]
+			}
+			return lib, true
+		}
+	}
+
+	return b.Library{}, false
+}
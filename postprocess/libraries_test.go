@@ -0,0 +1,190 @@
+package postprocess
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/chromedp/cdproto/debugger"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/runtime"
+	b "github.com/pmurley/mida/base"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A jQuery release as packaged by Debian (libjs-jquery), whose hash is in the example library database
+const debianJQuery = "/usr/share/javascript/jquery/jquery.min.js"
+
+// writeTestSource saves the source of a script where a site visit would have saved it, as a resource body
+// (subdir b.DefaultResourceSubdir) or as the source of a script we only saw parsed (b.DefaultScriptSourceSubdir)
+func writeTestSource(t *testing.T, rr *b.RawResult, subdir string, id string, source []byte) {
+	dir := path.Join(rr.TaskSummary.TaskWrapper.TempDir, subdir)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(dir, id), source, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLibrariesKnownRelease(t *testing.T) {
+	release, err := ioutil.ReadFile(debianJQuery)
+	if os.IsNotExist(err) {
+		t.Skip("no packaged jQuery release to test with")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadLibraryDB(filepath.Join("..", "examples", "libraries.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const scriptURL = "https://cdn.example.com/js/site.js"
+	modified := append([]byte("\n"), release...)
+	tests := []struct {
+		name string
+		body []byte
+		want b.Library
+	}{
+		{
+			name: "release",
+			body: release,
+			want: b.Library{Name: "jquery", Version: "3.6.1", URL: scriptURL, RequestID: "1", Method: LibraryByHash},
+		},
+		{
+			name: "modified release",
+			body: modified,
+			want: b.Library{Name: "jquery", Version: "3.6.1", URL: scriptURL, RequestID: "1", Method: LibraryByBanner},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := newTestRawResult(t, "https://www.example.com/")
+			addTestRequest(rr, "1", network.ResourceTypeScript, scriptURL, "https://www.example.com/")
+			writeTestSource(t, rr, b.DefaultResourceSubdir, "1", test.body)
+
+			libs, err := Libraries(rr, db, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(libs, []b.Library{test.want}) {
+				t.Errorf("got %+v, want %+v", libs, test.want)
+			}
+		})
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	const pageAddress = "https://www.example.com/"
+	release := []byte("/*! Widgets v2.0.0 */\nwindow.widgets = {};\n")
+	sum := sha256.Sum256(release)
+	releaseHash := hex.EncodeToString(sum[:])
+
+	dbFile := filepath.Join(t.TempDir(), "libraries.json")
+	err := ioutil.WriteFile(dbFile, []byte(`{"libraries": [{
+		"name": "widgets",
+		"banners": ["Widgets v(\\d+\\.\\d+\\.\\d+)"],
+		"urls": ["/widgets-(\\d+\\.\\d+\\.\\d+)\\.js"],
+		"hashes": {"`+releaseHash+`": "2.0.0-release"}
+	}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadLibraryDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		requests   map[string]string // URLs of the scripts loaded by requests, keyed by request ID
+		bodies     map[string][]byte // Saved resource bodies, keyed by request ID
+		bodyHashes map[string]string
+		scripts    map[string]string // URLs of parsed scripts, keyed by script ID ("" for eval'd scripts)
+		sources    map[string][]byte // Saved sources of parsed scripts, keyed by script ID
+		want       []b.Library
+	}{
+		{
+			name:     "release body",
+			requests: map[string]string{"1": "https://cdn.example.com/site.js"},
+			bodies:   map[string][]byte{"1": release},
+			want: []b.Library{{Name: "widgets", Version: "2.0.0-release", URL: "https://cdn.example.com/site.js",
+				RequestID: "1", Method: LibraryByHash}},
+		},
+		{
+			name:       "release body with precomputed hash",
+			requests:   map[string]string{"1": "https://cdn.example.com/site.js"},
+			bodies:     map[string][]byte{"1": []byte("not the release")},
+			bodyHashes: map[string]string{"1": releaseHash},
+			want: []b.Library{{Name: "widgets", Version: "2.0.0-release", URL: "https://cdn.example.com/site.js",
+				RequestID: "1", Method: LibraryByHash}},
+		},
+		{
+			name:     "bundled body",
+			requests: map[string]string{"1": "https://cdn.example.com/site.js"},
+			bodies:   map[string][]byte{"1": append([]byte("var app = 1;\n"), release...)},
+			want: []b.Library{{Name: "widgets", Version: "2.0.0", URL: "https://cdn.example.com/site.js",
+				RequestID: "1", Method: LibraryByBanner}},
+		},
+		{
+			name:     "body not saved",
+			requests: map[string]string{"1": "https://cdn.example.com/widgets-1.2.3.js"},
+			scripts:  map[string]string{"10": "https://cdn.example.com/widgets-1.2.3.js"},
+			want: []b.Library{{Name: "widgets", Version: "1.2.3", URL: "https://cdn.example.com/widgets-1.2.3.js",
+				RequestID: "1", Method: LibraryByURL}},
+		},
+		{
+			name:    "inline script",
+			scripts: map[string]string{"10": pageAddress},
+			sources: map[string][]byte{"10": []byte("/*! Widgets v2.1.0 */ window.widgets = {};")},
+			want: []b.Library{{Name: "widgets", Version: "2.1.0", URL: pageAddress, ScriptID: "10",
+				Method: LibraryByBanner}},
+		},
+		{
+			name:    "eval'd release",
+			scripts: map[string]string{"11": ""},
+			sources: map[string][]byte{"11": release},
+			want:    []b.Library{{Name: "widgets", Version: "2.0.0-release", ScriptID: "11", Method: LibraryByHash}},
+		},
+		{
+			name:    "script without a request or source",
+			scripts: map[string]string{"12": "https://other.example.com/widgets-3.0.0.js", "13": pageAddress},
+			want: []b.Library{{Name: "widgets", Version: "3.0.0", URL: "https://other.example.com/widgets-3.0.0.js",
+				ScriptID: "12", Method: LibraryByURL}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := newTestRawResult(t, pageAddress)
+			for id, scriptURL := range test.requests {
+				addTestRequest(rr, id, network.ResourceTypeScript, scriptURL, pageAddress)
+			}
+			for id, body := range test.bodies {
+				writeTestSource(t, rr, b.DefaultResourceSubdir, id, body)
+			}
+			for id, scriptURL := range test.scripts {
+				rr.DevTools.Debugger.ScriptParsed[id] = debugger.EventScriptParsed{
+					ScriptID: runtime.ScriptID(id),
+					URL:      scriptURL,
+				}
+			}
+			for id, source := range test.sources {
+				writeTestSource(t, rr, b.DefaultScriptSourceSubdir, id, source)
+			}
+
+			libs, err := Libraries(rr, db, test.bodyHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(libs, test.want) {
+				t.Errorf("got %+v, want %+v", libs, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/security"
+	b "github.com/pmurley/mida/base"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Outcomes of an insecure request made by a secure document
+const (
+	MixedContentBlocked  = "blocked"  // The browser blocked the request
+	MixedContentUpgraded = "upgraded" // The browser (or a redirect) upgraded the request to a secure connection
+	MixedContentLoaded   = "loaded"   // The browser loaded the resource over an insecure connection
+	MixedContentFailed   = "failed"   // The request failed for some other reason
+)
+
+// MixedContent finds the requests for insecure (HTTP or WS) resources made by documents loaded over HTTPS, and
+// works out whether the browser blocked them, upgraded them, or loaded them insecurely. Navigating the page
+// itself is not mixed content, but loading a frame is. MIDA does not capture the DOM, so insecure form actions
+// (which only matter once a form is submitted) are not detected.
+func MixedContent(rr *b.RawResult) []b.MixedContentRequest {
+	result := make([]b.MixedContentRequest, 0)
+
+	mainRequestID := ""
+	if requests := pageRequests(rr); requests != nil {
+		mainRequestID = requests[0].RequestID.String()
+	}
+
+	// Sort by request ID so that results are in a stable order
+	var keys []string
+	for k := range rr.DevTools.Network.RequestWillBeSent {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		requests := rr.DevTools.Network.RequestWillBeSent[k]
+		if k == mainRequestID || len(requests) == 0 || requests[0].Request == nil {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(requests[0].DocumentURL), "https://") {
+			continue
+		}
+
+		// The first insecure URL in the chain of redirects, if any. The browser upgrades some requests before
+		// sending them, in which case we only see the secure URL, marked as mixed content.
+		var insecure *network.EventRequestWillBeSent
+		upgraded := false
+		for i := range requests {
+			if requests[i].Request != nil && !isSecureURL(requests[i].Request.URL) {
+				insecure = &requests[i]
+				break
+			}
+		}
+		if insecure == nil {
+			mct := requests[0].Request.MixedContentType
+			if mct != security.MixedContentTypeBlockable && mct != security.MixedContentTypeOptionallyBlockable {
+				continue
+			}
+			insecure = &requests[0]
+			upgraded = true
+		}
+
+		mcr := b.MixedContentRequest{
+			RequestID:        k,
+			URL:              insecure.Request.URL,
+			DocumentURL:      requests[0].DocumentURL,
+			Type:             insecure.Type.String(),
+			MixedContentType: mixedContentType(insecure),
+		}
+
+		failed, hasFailed := rr.DevTools.Network.LoadingFailed[k]
+		resp, hasResponse := rr.DevTools.Network.ResponseReceived[k]
+		last := requests[len(requests)-1].Request
+		switch {
+		case hasFailed && failed.BlockedReason == network.BlockedReasonMixedContent:
+			mcr.Outcome = MixedContentBlocked
+		case upgraded || (last != nil && isSecureURL(last.URL) && last != insecure.Request):
+			mcr.Outcome = MixedContentUpgraded
+		case hasResponse && resp.Response != nil && !isSecureURL(resp.Response.URL):
+			mcr.Outcome = MixedContentLoaded
+		default:
+			mcr.Outcome = MixedContentFailed
+		}
+		result = append(result, mcr)
+	}
+
+	return result
+}
+
+// isSecureURL returns true for URLs which are loaded over a secure connection (or are not loaded over the
+// network at all, like data URLs)
+func isSecureURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return true
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		// Browsers treat loopback addresses as secure
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return true
+	}
+}
+
+// mixedContentType returns how browsers treat a request as mixed content: "blockable" for active content, which
+// is always blocked, or "optionally-blockable" for passive content (images and media)
+func mixedContentType(req *network.EventRequestWillBeSent) string {
+	mct := req.Request.MixedContentType
+	if mct == security.MixedContentTypeBlockable || mct == security.MixedContentTypeOptionallyBlockable {
+		return mct.String()
+	}
+	if req.Type == network.ResourceTypeImage || req.Type == network.ResourceTypeMedia {
+		return security.MixedContentTypeOptionallyBlockable.String()
+	}
+	return security.MixedContentTypeBlockable.String()
+}
@@ -0,0 +1,136 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/security"
+	b "github.com/pmurley/mida/base"
+	"reflect"
+	"testing"
+)
+
+func TestMixedContent(t *testing.T) {
+	const pageAddress = "https://www.example.com/"
+
+	tests := []struct {
+		name  string
+		setup func(rr *b.RawResult) // Records request "2", made by the page unless the test says otherwise
+		want  []b.MixedContentRequest
+	}{
+		{
+			name: "secure request",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeScript, "https://cdn.example.com/app.js", pageAddress)
+				addTestResponse(rr, "2", network.ResourceTypeScript, "https://cdn.example.com/app.js", 200, nil)
+			},
+			want: []b.MixedContentRequest{},
+		},
+		{
+			name: "insecure image loaded",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeImage, "http://cdn.example.com/a.png", pageAddress)
+				addTestResponse(rr, "2", network.ResourceTypeImage, "http://cdn.example.com/a.png", 200, nil)
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "http://cdn.example.com/a.png",
+				DocumentURL: pageAddress, Type: "Image", MixedContentType: "optionally-blockable",
+				Outcome: MixedContentLoaded}},
+		},
+		{
+			name: "insecure script blocked",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeScript, "http://cdn.example.com/app.js", pageAddress)
+				rr.DevTools.Network.LoadingFailed["2"] = network.EventLoadingFailed{RequestID: "2",
+					ErrorText: "net::ERR_BLOCKED_BY_CLIENT", BlockedReason: network.BlockedReasonMixedContent}
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "http://cdn.example.com/app.js",
+				DocumentURL: pageAddress, Type: "Script", MixedContentType: "blockable",
+				Outcome: MixedContentBlocked}},
+		},
+		{
+			name: "insecure script failed",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeScript, "http://cdn.example.com/app.js", pageAddress)
+				rr.DevTools.Network.LoadingFailed["2"] = network.EventLoadingFailed{RequestID: "2",
+					ErrorText: "net::ERR_CONNECTION_REFUSED"}
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "http://cdn.example.com/app.js",
+				DocumentURL: pageAddress, Type: "Script", MixedContentType: "blockable",
+				Outcome: MixedContentFailed}},
+		},
+		{
+			name: "upgraded by the browser",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeImage, "https://cdn.example.com/a.png", pageAddress)
+				rr.DevTools.Network.RequestWillBeSent["2"][0].Request.MixedContentType =
+					security.MixedContentTypeOptionallyBlockable
+				addTestResponse(rr, "2", network.ResourceTypeImage, "https://cdn.example.com/a.png", 200, nil)
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "https://cdn.example.com/a.png",
+				DocumentURL: pageAddress, Type: "Image", MixedContentType: "optionally-blockable",
+				Outcome: MixedContentUpgraded}},
+		},
+		{
+			name: "upgraded by a redirect",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeStylesheet, "http://cdn.example.com/a.css", pageAddress)
+				addTestRequest(rr, "2", network.ResourceTypeStylesheet, "https://cdn.example.com/a.css", pageAddress)
+				addTestResponse(rr, "2", network.ResourceTypeStylesheet, "https://cdn.example.com/a.css", 200, nil)
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "http://cdn.example.com/a.css",
+				DocumentURL: pageAddress, Type: "Stylesheet", MixedContentType: "blockable",
+				Outcome: MixedContentUpgraded}},
+		},
+		{
+			name: "insecure frame",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeDocument, "http://widgets.example.net/", pageAddress)
+				addTestResponse(rr, "2", network.ResourceTypeDocument, "http://widgets.example.net/", 200, nil)
+			},
+			want: []b.MixedContentRequest{{RequestID: "2", URL: "http://widgets.example.net/",
+				DocumentURL: pageAddress, Type: "Document", MixedContentType: "blockable",
+				Outcome: MixedContentLoaded}},
+		},
+		{
+			name: "insecure request by an insecure frame",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeScript, "http://cdn.example.com/app.js",
+					"http://widgets.example.net/")
+				addTestResponse(rr, "2", network.ResourceTypeScript, "http://cdn.example.com/app.js", 200, nil)
+			},
+			want: []b.MixedContentRequest{},
+		},
+		{
+			name: "loopback request",
+			setup: func(rr *b.RawResult) {
+				addTestRequest(rr, "2", network.ResourceTypeXHR, "http://localhost:8080/api", pageAddress)
+				addTestResponse(rr, "2", network.ResourceTypeXHR, "http://localhost:8080/api", 200, nil)
+			},
+			want: []b.MixedContentRequest{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := newTestRawResult(t, pageAddress)
+			addTestRequest(rr, "1", network.ResourceTypeDocument, pageAddress, pageAddress)
+			addTestResponse(rr, "1", network.ResourceTypeDocument, pageAddress, 200, nil)
+			test.setup(rr)
+
+			got := MixedContent(rr)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMixedContentPageNavigation(t *testing.T) {
+	// Navigating the page from HTTP to HTTPS (or the other way) is not mixed content
+	rr := newTestRawResult(t, "http://www.example.com/")
+	addTestRequest(rr, "1", network.ResourceTypeDocument, "http://www.example.com/", "https://www.example.com/")
+	addTestRequest(rr, "1", network.ResourceTypeDocument, "https://www.example.com/", "https://www.example.com/")
+	addTestResponse(rr, "1", network.ResourceTypeDocument, "https://www.example.com/", 200, nil)
+
+	if got := MixedContent(rr); len(got) != 0 {
+		t.Errorf("got %+v, want nothing", got)
+	}
+}
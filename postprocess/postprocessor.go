@@ -0,0 +1,142 @@
+package postprocess
+
+import (
+	"encoding/json"
+	"errors"
+	b "github.com/pmurley/mida/base"
+	"sort"
+	"sync"
+)
+
+// A Postprocessor is an analysis run over the raw results of a site visit once the final result has been built
+// from them. It adds what it finds to the final result as named sections and extra files, which storage writes
+// alongside the other results, and may add counts to the task summary. A postprocessor takes any options of its
+// own from the task's postprocessing settings (see Options).
+type Postprocessor interface {
+	Name() string                                         // Name by which tasks select the postprocessor
+	Postprocess(rr *b.RawResult, fr *b.FinalResult) error // Analyze a raw result, adding to its final result
+}
+
+// The postprocessors tasks may select, keyed by name
+var (
+	registry     = make(map[string]Postprocessor)
+	registryLock sync.RWMutex
+)
+
+// Register makes a postprocessor available to tasks. Packages providing postprocessors should register them in
+// an init function. Register panics if a postprocessor with the same name is already registered.
+func Register(p Postprocessor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if p == nil {
+		panic("postprocess: cannot register a nil postprocessor")
+	}
+	if _, ok := registry[p.Name()]; ok {
+		panic("postprocess: postprocessor registered twice: " + p.Name())
+	}
+	registry[p.Name()] = p
+}
+
+// Lookup returns the registered postprocessor with the given name
+func Lookup(name string) (Postprocessor, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	p, ok := registry[name]
+	return p, ok
+}
+
+// Registered returns the names of all registered postprocessors, in alphabetical order
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// A postprocessor made from a function, for postprocessors which need no state of their own
+type postprocessorFunc struct {
+	name string
+	f    func(rr *b.RawResult, fr *b.FinalResult) error
+}
+
+func (p postprocessorFunc) Name() string {
+	return p.name
+}
+
+func (p postprocessorFunc) Postprocess(rr *b.RawResult, fr *b.FinalResult) error {
+	return p.f(rr, fr)
+}
+
+// NewPostprocessor makes a Postprocessor with the given name from a function
+func NewPostprocessor(name string, f func(rr *b.RawResult, fr *b.FinalResult) error) Postprocessor {
+	return postprocessorFunc{name: name, f: f}
+}
+
+// Selected returns true if the given postprocessing settings select the named postprocessor
+func Selected(pps b.PostprocessSettings, name string) bool {
+	if pps.Postprocessors == nil {
+		return false
+	}
+	for _, n := range *pps.Postprocessors {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Options decodes the options the task gives for the named postprocessor into v, leaving v untouched if
+// there are none
+func Options(rr *b.RawResult, name string, v interface{}) error {
+	options, ok := (*rr.TaskSummary.TaskWrapper.SanitizedTask.PPS.Options)[name]
+	if !ok {
+		return nil
+	}
+
+	err := json.Unmarshal(options, v)
+	if err != nil {
+		return errors.New("invalid options for " + name + " postprocessor: " + err.Error())
+	}
+
+	return nil
+}
+
+// Run postprocesses the raw result of a site visit. It builds the final result from the DevTools data, and then
+// runs the postprocessors selected by the task over it, in order. If anything fails, Run returns the final result
+// as far as it got, along with the error.
+func Run(rr *b.RawResult) (b.FinalResult, error) {
+	finalResult, err := DevTools(rr)
+	if err != nil {
+		return finalResult, err
+	}
+
+	for _, name := range *rr.TaskSummary.TaskWrapper.SanitizedTask.PPS.Postprocessors {
+		p, ok := Lookup(name)
+		if !ok {
+			return finalResult, errors.New("unknown postprocessor: " + name)
+		}
+		err = p.Postprocess(rr, &finalResult)
+		if err != nil {
+			return finalResult, errors.New(name + " postprocessor failed: " + err.Error())
+		}
+	}
+
+	// Each step of a session task is postprocessed just like a standalone site visit
+	for _, stepResult := range rr.Steps {
+		stepFinalResult, err := Run(stepResult)
+		if err != nil {
+			return finalResult, err
+		}
+		finalResult.Steps = append(finalResult.Steps, &stepFinalResult)
+	}
+
+	return finalResult, nil
+}
@@ -0,0 +1,57 @@
+package postprocess
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	b "github.com/pmurley/mida/base"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// BodyHashes computes the SHA-256 hash of each resource body saved during a site visit, keyed by request ID
+func BodyHashes(tw *b.TaskWrapper) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	resourceDir := path.Join(tw.TempDir, b.DefaultResourceSubdir)
+	files, err := ioutil.ReadDir(resourceDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hashes, nil
+		}
+		return hashes, errors.New("failed to read resources directory: " + err.Error())
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		hash, err := fileHash(path.Join(resourceDir, f.Name()))
+		if err != nil {
+			return hashes, errors.New("failed to hash resource body: " + err.Error())
+		}
+		hashes[f.Name()] = hash
+	}
+
+	return hashes, nil
+}
+
+// fileHash returns the SHA-256 hash (hex) of the contents of a file
+func fileHash(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,443 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severities of security header findings
+const (
+	SeverityHigh   = "high"
+	SeverityMedium = "medium"
+	SeverityLow    = "low"
+)
+
+// Thresholds for HSTS max-age values (in seconds)
+const (
+	hstsMinMaxAge     = 180 * 24 * 60 * 60 // Shorter policies lapse between visits by many users
+	hstsPreloadMaxAge = 365 * 24 * 60 * 60 // Minimum accepted for the HSTS preload list
+)
+
+// Features which should never be delegated to every origin
+var sensitiveFeatures = []string{"camera", "microphone", "geolocation", "payment", "usb", "serial", "hid",
+	"display-capture", "clipboard-read"}
+
+// SecurityHeaders parses and evaluates the security headers of every document (the page itself and any frames)
+// loaded during a site visit, along with the flags of every cookie set by a response. Note that the browser may
+// leave some Set-Cookie headers out of the response headers it reports, so cookies may be missing.
+func SecurityHeaders(rr *b.RawResult) *b.SecurityHeaders {
+	result := &b.SecurityHeaders{
+		Documents: make([]b.DocumentSecurityHeaders, 0),
+		Cookies:   make([]b.CookieFlags, 0),
+	}
+
+	mainRequestID := ""
+	if requests := pageRequests(rr); requests != nil {
+		mainRequestID = requests[0].RequestID.String()
+	}
+
+	// Sort by request ID so that results are in a stable order
+	var keys []string
+	for k := range rr.DevTools.Network.ResponseReceived {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ev := rr.DevTools.Network.ResponseReceived[k]
+		if ev.Response == nil {
+			continue
+		}
+		resp := ev.Response
+
+		if ev.Type == network.ResourceTypeDocument {
+			result.Documents = append(result.Documents, documentSecurityHeaders(k, resp, k == mainRequestID))
+		}
+
+		for _, line := range strings.Split(headerValue(resp.Headers, "Set-Cookie"), "\n") {
+			if strings.TrimSpace(line) != "" {
+				result.Cookies = append(result.Cookies, cookieFlags(k, resp.URL, line))
+			}
+		}
+	}
+
+	return result
+}
+
+// documentSecurityHeaders parses and evaluates the security headers of a single document
+func documentSecurityHeaders(requestID string, resp *network.Response, mainFrame bool) b.DocumentSecurityHeaders {
+	dsh := b.DocumentSecurityHeaders{
+		URL:       resp.URL,
+		RequestID: requestID,
+		MainFrame: mainFrame,
+		Findings:  make([]b.SecurityFinding, 0),
+	}
+	secure := strings.HasPrefix(strings.ToLower(resp.URL), "https://")
+	finding := func(header string, severity string, issue string) {
+		dsh.Findings = append(dsh.Findings, b.SecurityFinding{Header: header, Severity: severity, Issue: issue})
+	}
+
+	// Content-Security-Policy
+	if raw := headerValue(resp.Headers, "Content-Security-Policy"); raw != "" {
+		dsh.CSP = parseCSP(raw)
+		dsh.Findings = append(dsh.Findings, cspFindings(dsh.CSP)...)
+	} else if mainFrame {
+		finding("content-security-policy", SeverityLow, "no content security policy")
+	}
+	if raw := headerValue(resp.Headers, "Content-Security-Policy-Report-Only"); raw != "" {
+		dsh.CSPReportOnly = parseCSP(raw)
+		if dsh.CSP == nil {
+			finding("content-security-policy-report-only", SeverityLow, "content security policy is only reported, not enforced")
+		}
+	}
+
+	// Strict-Transport-Security
+	if raw := headerValue(resp.Headers, "Strict-Transport-Security"); raw != "" {
+		dsh.HSTS = parseHSTS(raw)
+		if !secure {
+			finding("strict-transport-security", SeverityLow, "HSTS header sent over HTTP, where browsers ignore it")
+		} else if dsh.HSTS.MaxAge == 0 {
+			finding("strict-transport-security", SeverityMedium, "max-age of 0 removes any HSTS policy for the host")
+		} else if dsh.HSTS.MaxAge < hstsMinMaxAge {
+			finding("strict-transport-security", SeverityLow, "max-age is shorter than 180 days")
+		}
+		if dsh.HSTS.Preload && (!dsh.HSTS.IncludeSubDomains || dsh.HSTS.MaxAge < hstsPreloadMaxAge) {
+			finding("strict-transport-security", SeverityLow, "preload requested, but the policy does not meet preload list requirements")
+		}
+	} else if secure && mainFrame {
+		finding("strict-transport-security", SeverityMedium, "no HSTS policy on an HTTPS page")
+	}
+
+	// X-Frame-Options (superseded by the CSP frame-ancestors directive, which browsers prefer if both are set)
+	dsh.XFrameOptions = strings.TrimSpace(headerValue(resp.Headers, "X-Frame-Options"))
+	switch xfo := strings.ToUpper(dsh.XFrameOptions); {
+	case xfo == "":
+		if mainFrame && !cspHasDirective(dsh.CSP, "frame-ancestors") {
+			finding("x-frame-options", SeverityMedium, "page may be framed by any site (no X-Frame-Options or frame-ancestors)")
+		}
+	case strings.HasPrefix(xfo, "ALLOW-FROM"):
+		finding("x-frame-options", SeverityLow, "ALLOW-FROM is not supported by current browsers, which ignore the header")
+	case xfo != "DENY" && xfo != "SAMEORIGIN":
+		finding("x-frame-options", SeverityMedium, "invalid value, which browsers ignore")
+	}
+
+	// Referrer-Policy (a comma-separated list, of which browsers use the last value they understand)
+	if raw := headerValue(resp.Headers, "Referrer-Policy"); raw != "" {
+		for _, p := range strings.Split(raw, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			switch p {
+			case "no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin", "same-origin",
+				"strict-origin", "strict-origin-when-cross-origin", "unsafe-url":
+				dsh.ReferrerPolicy = p
+			default:
+				finding("referrer-policy", SeverityLow, "unknown policy: "+p)
+			}
+		}
+		switch dsh.ReferrerPolicy {
+		case "unsafe-url":
+			finding("referrer-policy", SeverityMedium, "full URLs are sent to every site, including over HTTP")
+		case "no-referrer-when-downgrade":
+			finding("referrer-policy", SeverityLow, "full URLs are sent to every site over HTTPS")
+		}
+	}
+
+	// Permissions-Policy
+	if raw := headerValue(resp.Headers, "Permissions-Policy"); raw != "" {
+		dsh.PermissionsPolicy = parsePermissionsPolicy(raw)
+		for _, feature := range sensitiveFeatures {
+			for _, origin := range dsh.PermissionsPolicy[feature] {
+				if origin == "*" {
+					finding("permissions-policy", SeverityMedium, feature+" may be delegated to any origin")
+				}
+			}
+		}
+	}
+
+	// Cross-Origin-Opener-Policy and Cross-Origin-Embedder-Policy
+	dsh.COOP = strings.ToLower(strings.TrimSpace(structuredToken(headerValue(resp.Headers, "Cross-Origin-Opener-Policy"))))
+	switch dsh.COOP {
+	case "", "same-origin", "same-origin-allow-popups", "unsafe-none", "noopener-allow-popups":
+	default:
+		finding("cross-origin-opener-policy", SeverityLow, "invalid value, which browsers ignore")
+	}
+	dsh.COEP = strings.ToLower(strings.TrimSpace(structuredToken(headerValue(resp.Headers, "Cross-Origin-Embedder-Policy"))))
+	switch dsh.COEP {
+	case "", "require-corp", "credentialless", "unsafe-none":
+	default:
+		finding("cross-origin-embedder-policy", SeverityLow, "invalid value, which browsers ignore")
+	}
+	if (dsh.COEP == "require-corp" || dsh.COEP == "credentialless") && dsh.COOP != "same-origin" {
+		finding("cross-origin-opener-policy", SeverityLow, "COEP is set without COOP same-origin, so the page is not cross-origin isolated")
+	}
+
+	return dsh
+}
+
+// parseCSP parses a Content-Security-Policy header into its policies (separated by commas, or by newlines where
+// the header was sent more than once), each of which maps directive names to their source lists
+func parseCSP(raw string) *b.CSPolicy {
+	csp := &b.CSPolicy{
+		Raw:      raw,
+		Policies: make([]map[string][]string, 0),
+	}
+
+	for _, policy := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		directives := make(map[string][]string)
+		for _, directive := range strings.Split(policy, ";") {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 {
+				continue
+			}
+			name := strings.ToLower(fields[0])
+			// Browsers ignore repeated directives
+			if _, ok := directives[name]; ok {
+				continue
+			}
+			directives[name] = append([]string{}, fields[1:]...)
+		}
+		if len(directives) > 0 {
+			csp.Policies = append(csp.Policies, directives)
+		}
+	}
+
+	return csp
+}
+
+// cspHasDirective returns true if any policy in an enforced CSP has the given directive
+func cspHasDirective(csp *b.CSPolicy, directive string) bool {
+	if csp == nil {
+		return false
+	}
+	for _, p := range csp.Policies {
+		if _, ok := p[directive]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cspFindings evaluates a CSP. Every policy is enforced, so a weakness only matters if all of them share it.
+func cspFindings(csp *b.CSPolicy) []b.SecurityFinding {
+	counts := make(map[b.SecurityFinding]int)
+	var order []b.SecurityFinding
+	for _, p := range csp.Policies {
+		for _, f := range cspPolicyFindings(p) {
+			if counts[f] == 0 {
+				order = append(order, f)
+			}
+			counts[f] += 1
+		}
+	}
+
+	var findings []b.SecurityFinding
+	for _, f := range order {
+		if counts[f] == len(csp.Policies) {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// cspPolicyFindings evaluates a single CSP policy
+func cspPolicyFindings(policy map[string][]string) []b.SecurityFinding {
+	var findings []b.SecurityFinding
+	finding := func(severity string, issue string) {
+		findings = append(findings, b.SecurityFinding{Header: "content-security-policy", Severity: severity, Issue: issue})
+	}
+
+	scripts, ok := policy["script-src"]
+	if !ok {
+		scripts, ok = policy["default-src"]
+	}
+	if !ok {
+		finding(SeverityHigh, "scripts are not restricted (no script-src or default-src)")
+	} else {
+		nonceOrHash, strictDynamic := false, false
+		for _, s := range scripts {
+			ls := strings.ToLower(s)
+			if strings.HasPrefix(ls, "'nonce-") || strings.HasPrefix(ls, "'sha256-") ||
+				strings.HasPrefix(ls, "'sha384-") || strings.HasPrefix(ls, "'sha512-") {
+				nonceOrHash = true
+			}
+			if ls == "'strict-dynamic'" {
+				strictDynamic = true
+			}
+		}
+		for _, s := range scripts {
+			switch ls := strings.ToLower(s); {
+			case ls == "'unsafe-inline'" && !nonceOrHash:
+				// Browsers ignore 'unsafe-inline' alongside a nonce or hash
+				finding(SeverityHigh, "script-src allows inline scripts ('unsafe-inline')")
+			case ls == "'unsafe-eval'":
+				finding(SeverityMedium, "script-src allows eval ('unsafe-eval')")
+			case (ls == "*" || ls == "http:" || ls == "https:" || ls == "data:") && !strictDynamic:
+				// 'strict-dynamic' makes browsers ignore host and scheme sources
+				finding(SeverityHigh, "script-src allows scripts from any host ("+ls+")")
+			case strings.HasPrefix(ls, "http://") && !strictDynamic:
+				finding(SeverityMedium, "script-src allows scripts over HTTP ("+ls+")")
+			}
+		}
+	}
+
+	if _, ok := policy["object-src"]; !ok {
+		if _, ok := policy["default-src"]; !ok {
+			finding(SeverityMedium, "plugins are not restricted (no object-src or default-src)")
+		}
+	}
+	if _, ok := policy["base-uri"]; !ok {
+		finding(SeverityLow, "base URL is not restricted (no base-uri)")
+	}
+
+	return findings
+}
+
+// parseHSTS parses a Strict-Transport-Security header. Browsers use the first header if there is more than one.
+func parseHSTS(raw string) *b.HSTSPolicy {
+	hsts := &b.HSTSPolicy{Raw: raw}
+	raw = strings.SplitN(raw, "\n", 2)[0]
+	for _, directive := range strings.Split(raw, ";") {
+		name, value := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, value = directive[:i], directive[i+1:]
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			maxAge, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), "\""), 10, 64)
+			if err == nil {
+				hsts.MaxAge = maxAge
+			}
+		case "includesubdomains":
+			hsts.IncludeSubDomains = true
+		case "preload":
+			hsts.Preload = true
+		}
+	}
+
+	return hsts
+}
+
+// parsePermissionsPolicy parses a Permissions-Policy header (a structured header dictionary) into the
+// allowlist of each feature. An empty allowlist disables the feature, and "*" allows every origin.
+func parsePermissionsPolicy(raw string) map[string][]string {
+	result := make(map[string][]string)
+	for _, member := range splitOutsideParens(strings.Replace(raw, "\n", ",", -1)) {
+		i := strings.IndexByte(member, '=')
+		if i < 0 {
+			continue
+		}
+		feature := strings.ToLower(strings.TrimSpace(member[:i]))
+		value := strings.TrimSpace(member[i+1:])
+		// Parameters (e.g., ;report-to=x) follow the allowlist
+		if strings.HasPrefix(value, "(") {
+			if j := strings.IndexByte(value, ')'); j >= 0 {
+				value = value[1:j]
+			}
+		} else if j := strings.IndexByte(value, ';'); j >= 0 {
+			value = value[:j]
+		}
+
+		allowlist := make([]string, 0)
+		for _, origin := range strings.Fields(value) {
+			allowlist = append(allowlist, strings.Trim(origin, "\""))
+		}
+		result[feature] = allowlist
+	}
+
+	return result
+}
+
+// splitOutsideParens splits a string on commas which are not within parentheses
+func splitOutsideParens(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// structuredToken returns the token of a structured header item, without any parameters (e.g., report-to)
+func structuredToken(raw string) string {
+	return strings.SplitN(raw, ";", 2)[0]
+}
+
+// cookieFlags parses a single Set-Cookie header line and evaluates the cookie's flags
+func cookieFlags(requestID string, responseURL string, line string) b.CookieFlags {
+	attrs := strings.Split(line, ";")
+	cookie := b.CookieFlags{
+		RequestID: requestID,
+		URL:       responseURL,
+		Findings:  make([]b.SecurityFinding, 0),
+	}
+	if i := strings.IndexByte(attrs[0], '='); i >= 0 {
+		cookie.Name = strings.TrimSpace(attrs[0][:i])
+	} else {
+		cookie.Name = strings.TrimSpace(attrs[0])
+	}
+
+	for _, attr := range attrs[1:] {
+		name, value := attr, ""
+		if i := strings.IndexByte(attr, '='); i >= 0 {
+			name, value = attr[:i], strings.TrimSpace(attr[i+1:])
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "secure":
+			cookie.Secure = true
+		case "httponly":
+			cookie.HTTPOnly = true
+		case "samesite":
+			cookie.SameSite = strings.ToLower(value)
+		case "domain":
+			cookie.Domain = value
+		case "path":
+			cookie.Path = value
+		case "expires", "max-age":
+			cookie.Persistent = true
+		}
+	}
+
+	finding := func(severity string, issue string) {
+		cookie.Findings = append(cookie.Findings, b.SecurityFinding{Header: "set-cookie", Severity: severity, Issue: issue})
+	}
+	secure := false
+	if u, err := url.Parse(responseURL); err == nil {
+		secure = u.Scheme == "https"
+	}
+
+	if cookie.SameSite == "none" && !cookie.Secure {
+		finding(SeverityHigh, "SameSite=None without Secure, so browsers reject the cookie")
+	}
+	if secure && !cookie.Secure {
+		finding(SeverityMedium, "set over HTTPS without Secure, so it is also sent over HTTP")
+	}
+	if !cookie.HTTPOnly {
+		finding(SeverityLow, "no HttpOnly, so scripts can read the cookie")
+	}
+	if cookie.SameSite == "" {
+		finding(SeverityLow, "no SameSite, so browsers apply their own default")
+	}
+	if strings.HasPrefix(cookie.Name, "__Secure-") && !cookie.Secure {
+		finding(SeverityMedium, "__Secure- prefix without Secure, so browsers reject the cookie")
+	}
+	if strings.HasPrefix(cookie.Name, "__Host-") && (!cookie.Secure || cookie.Domain != "" || cookie.Path != "/") {
+		finding(SeverityMedium, "__Host- prefix requires Secure, Path=/ and no Domain, so browsers reject the cookie")
+	}
+
+	return cookie
+}
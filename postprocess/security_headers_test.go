@@ -0,0 +1,322 @@
+package postprocess
+
+import (
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"reflect"
+	"testing"
+)
+
+// Security headers which leave nothing to find on a page, which each test case then changes
+var strongSecurityHeaders = map[string]string{
+	"Content-Security-Policy":      "default-src 'self'; object-src 'none'; base-uri 'none'; frame-ancestors 'self'",
+	"Strict-Transport-Security":    "max-age=63072000; includeSubDomains; preload",
+	"X-Frame-Options":              "DENY",
+	"Referrer-Policy":              "strict-origin-when-cross-origin",
+	"Permissions-Policy":           "camera=(), geolocation=(self)",
+	"Cross-Origin-Opener-Policy":   "same-origin",
+	"Cross-Origin-Embedder-Policy": "require-corp",
+}
+
+// findingStrings flattens findings to "header|severity|issue" for comparison
+func findingStrings(findings []b.SecurityFinding) []string {
+	result := make([]string, 0)
+	for _, f := range findings {
+		result = append(result, f.Header+"|"+f.Severity+"|"+f.Issue)
+	}
+	return result
+}
+
+func TestSecurityHeadersFindings(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string            // Page URL, if not https://www.example.com/
+		headers map[string]string // Changes to the strong headers ("" to leave a header out)
+		want    []string
+	}{
+		{
+			name: "strong headers",
+			want: []string{},
+		},
+		{
+			name: "no headers",
+			headers: map[string]string{"Content-Security-Policy": "", "Strict-Transport-Security": "",
+				"X-Frame-Options": "", "Referrer-Policy": "", "Permissions-Policy": "",
+				"Cross-Origin-Opener-Policy": "", "Cross-Origin-Embedder-Policy": ""},
+			want: []string{
+				"content-security-policy|low|no content security policy",
+				"strict-transport-security|medium|no HSTS policy on an HTTPS page",
+				"x-frame-options|medium|page may be framed by any site (no X-Frame-Options or frame-ancestors)",
+			},
+		},
+		{
+			name:    "weak script-src",
+			headers: map[string]string{"Content-Security-Policy": "script-src * 'unsafe-inline' 'unsafe-eval'"},
+			want: []string{
+				"content-security-policy|high|script-src allows scripts from any host (*)",
+				"content-security-policy|high|script-src allows inline scripts ('unsafe-inline')",
+				"content-security-policy|medium|script-src allows eval ('unsafe-eval')",
+				"content-security-policy|medium|plugins are not restricted (no object-src or default-src)",
+				"content-security-policy|low|base URL is not restricted (no base-uri)",
+			},
+		},
+		{
+			name: "nonces and strict-dynamic",
+			headers: map[string]string{"Content-Security-Policy": "script-src 'nonce-abc' 'unsafe-inline' " +
+				"'strict-dynamic' https: http://cdn.example.com; object-src 'none'; base-uri 'none'"},
+			want: []string{},
+		},
+		{
+			name: "weaknesses of only one of several policies",
+			headers: map[string]string{"Content-Security-Policy": "script-src 'unsafe-inline'; object-src 'none', " +
+				"script-src 'self'; object-src 'none'"},
+			want: []string{
+				"content-security-policy|low|base URL is not restricted (no base-uri)",
+			},
+		},
+		{
+			name: "report-only policy",
+			headers: map[string]string{"Content-Security-Policy": "",
+				"Content-Security-Policy-Report-Only": "default-src 'self'"},
+			want: []string{
+				"content-security-policy|low|no content security policy",
+				"content-security-policy-report-only|low|content security policy is only reported, not enforced",
+			},
+		},
+		{
+			name:    "short HSTS max-age",
+			headers: map[string]string{"Strict-Transport-Security": "max-age=86400; includeSubDomains"},
+			want:    []string{"strict-transport-security|low|max-age is shorter than 180 days"},
+		},
+		{
+			name:    "HSTS max-age of 0",
+			headers: map[string]string{"Strict-Transport-Security": "max-age=0"},
+			want:    []string{"strict-transport-security|medium|max-age of 0 removes any HSTS policy for the host"},
+		},
+		{
+			name:    "HSTS preload without includeSubDomains",
+			headers: map[string]string{"Strict-Transport-Security": "max-age=31536000; preload"},
+			want: []string{
+				"strict-transport-security|low|preload requested, but the policy does not meet preload list requirements",
+			},
+		},
+		{
+			name:    "HSTS over HTTP",
+			url:     "http://www.example.com/",
+			headers: map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+			want:    []string{"strict-transport-security|low|HSTS header sent over HTTP, where browsers ignore it"},
+		},
+		{
+			name:    "X-Frame-Options ALLOW-FROM",
+			headers: map[string]string{"X-Frame-Options": "ALLOW-FROM https://example.org"},
+			want: []string{
+				"x-frame-options|low|ALLOW-FROM is not supported by current browsers, which ignore the header",
+			},
+		},
+		{
+			name:    "invalid X-Frame-Options",
+			headers: map[string]string{"X-Frame-Options": "ALLOWALL"},
+			want:    []string{"x-frame-options|medium|invalid value, which browsers ignore"},
+		},
+		{
+			name:    "frame-ancestors without X-Frame-Options",
+			headers: map[string]string{"X-Frame-Options": ""},
+			want:    []string{},
+		},
+		{
+			name:    "unsafe referrer policy",
+			headers: map[string]string{"Referrer-Policy": "no-referrer, bogus, unsafe-url"},
+			want: []string{
+				"referrer-policy|low|unknown policy: bogus",
+				"referrer-policy|medium|full URLs are sent to every site, including over HTTP",
+			},
+		},
+		{
+			name:    "sensitive feature delegated to any origin",
+			headers: map[string]string{"Permissions-Policy": `camera=*, geolocation=(self "https://maps.example.com")`},
+			want:    []string{"permissions-policy|medium|camera may be delegated to any origin"},
+		},
+		{
+			name:    "COEP without COOP",
+			headers: map[string]string{"Cross-Origin-Opener-Policy": ""},
+			want: []string{
+				"cross-origin-opener-policy|low|COEP is set without COOP same-origin, so the page is not cross-origin isolated",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pageAddress := "https://www.example.com/"
+			if test.url != "" {
+				pageAddress = test.url
+			}
+			headers := make(map[string]string)
+			for k, v := range strongSecurityHeaders {
+				headers[k] = v
+			}
+			for k, v := range test.headers {
+				if v == "" {
+					delete(headers, k)
+				} else {
+					headers[k] = v
+				}
+			}
+
+			rr := newTestRawResult(t, pageAddress)
+			addTestRequest(rr, "1", network.ResourceTypeDocument, pageAddress, pageAddress)
+			addTestResponse(rr, "1", network.ResourceTypeDocument, pageAddress, 200, headers)
+
+			result := SecurityHeaders(rr)
+			if len(result.Documents) != 1 {
+				t.Fatalf("got %d documents, want 1", len(result.Documents))
+			}
+			if !result.Documents[0].MainFrame {
+				t.Error("page is not the main frame")
+			}
+			if got := findingStrings(result.Documents[0].Findings); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got findings %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersParsing(t *testing.T) {
+	rr := newTestRawResult(t, "https://www.example.com/")
+	addTestRequest(rr, "1", network.ResourceTypeDocument, "https://www.example.com/", "https://www.example.com/")
+	addTestResponse(rr, "1", network.ResourceTypeDocument, "https://www.example.com/", 200, map[string]string{
+		"Content-Security-Policy":   "default-src 'self'; img-src *; default-src 'none'\nscript-src 'self'",
+		"Strict-Transport-Security": "max-age=\"600\"; includeSubDomains\nmax-age=0",
+		"Referrer-Policy":           "origin",
+		"Permissions-Policy":        `camera=(), geolocation=(self "https://maps.example.com");report-to=x, usb=*`,
+		"Set-Cookie":                "a=1; Secure\nb=2; HttpOnly",
+	})
+
+	// Frames don't need headers which only protect the page as a whole
+	addTestRequest(rr, "2", network.ResourceTypeDocument, "https://widgets.example.net/", "https://www.example.com/")
+	addTestResponse(rr, "2", network.ResourceTypeDocument, "https://widgets.example.net/", 200, nil)
+
+	result := SecurityHeaders(rr)
+	if len(result.Documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(result.Documents))
+	}
+	page, frame := result.Documents[0], result.Documents[1]
+
+	wantCSP := &b.CSPolicy{
+		Raw: "default-src 'self'; img-src *; default-src 'none'\nscript-src 'self'",
+		Policies: []map[string][]string{
+			{"default-src": {"'self'"}, "img-src": {"*"}},
+			{"script-src": {"'self'"}},
+		},
+	}
+	if !reflect.DeepEqual(page.CSP, wantCSP) {
+		t.Errorf("got CSP %+v, want %+v", page.CSP, wantCSP)
+	}
+	wantHSTS := &b.HSTSPolicy{Raw: "max-age=\"600\"; includeSubDomains\nmax-age=0", MaxAge: 600,
+		IncludeSubDomains: true}
+	if !reflect.DeepEqual(page.HSTS, wantHSTS) {
+		t.Errorf("got HSTS %+v, want %+v", page.HSTS, wantHSTS)
+	}
+	if page.ReferrerPolicy != "origin" {
+		t.Errorf("got referrer policy %q, want origin", page.ReferrerPolicy)
+	}
+	wantPermissions := map[string][]string{
+		"camera":      {},
+		"geolocation": {"self", "https://maps.example.com"},
+		"usb":         {"*"},
+	}
+	if !reflect.DeepEqual(page.PermissionsPolicy, wantPermissions) {
+		t.Errorf("got permissions policy %v, want %v", page.PermissionsPolicy, wantPermissions)
+	}
+
+	if frame.MainFrame || frame.URL != "https://widgets.example.net/" {
+		t.Errorf("got frame %s (main frame %v)", frame.URL, frame.MainFrame)
+	}
+	if len(frame.Findings) != 0 {
+		t.Errorf("got findings %q for a frame with no headers", findingStrings(frame.Findings))
+	}
+
+	var cookies []string
+	for _, c := range result.Cookies {
+		cookies = append(cookies, c.Name)
+	}
+	if !reflect.DeepEqual(cookies, []string{"a", "b"}) {
+		t.Errorf("got cookies %v, want [a b]", cookies)
+	}
+}
+
+func TestCookieFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		line  string
+		flags b.CookieFlags // Everything but the findings, request ID and URL
+		want  []string
+	}{
+		{
+			name:  "strong flags",
+			url:   "https://www.example.com/",
+			line:  "id=1; Secure; HttpOnly; SameSite=Lax; Path=/; Max-Age=3600",
+			flags: b.CookieFlags{Name: "id", Secure: true, HTTPOnly: true, SameSite: "lax", Path: "/", Persistent: true},
+			want:  []string{},
+		},
+		{
+			name:  "no flags",
+			url:   "https://www.example.com/",
+			line:  "id=1",
+			flags: b.CookieFlags{Name: "id"},
+			want: []string{
+				"set-cookie|medium|set over HTTPS without Secure, so it is also sent over HTTP",
+				"set-cookie|low|no HttpOnly, so scripts can read the cookie",
+				"set-cookie|low|no SameSite, so browsers apply their own default",
+			},
+		},
+		{
+			name:  "no flags over HTTP",
+			url:   "http://www.example.com/",
+			line:  "id=1; HttpOnly; SameSite=Strict",
+			flags: b.CookieFlags{Name: "id", HTTPOnly: true, SameSite: "strict"},
+			want:  []string{},
+		},
+		{
+			name:  "SameSite=None without Secure",
+			url:   "https://www.example.com/",
+			line:  "id=1; HttpOnly; SameSite=None; Domain=example.com; Expires=Wed, 21 Oct 2037 07:28:00 GMT",
+			flags: b.CookieFlags{Name: "id", HTTPOnly: true, SameSite: "none", Domain: "example.com", Persistent: true},
+			want: []string{
+				"set-cookie|high|SameSite=None without Secure, so browsers reject the cookie",
+				"set-cookie|medium|set over HTTPS without Secure, so it is also sent over HTTP",
+			},
+		},
+		{
+			name:  "__Secure- prefix without Secure",
+			url:   "http://www.example.com/",
+			line:  "__Secure-id=1; HttpOnly; SameSite=Lax",
+			flags: b.CookieFlags{Name: "__Secure-id", HTTPOnly: true, SameSite: "lax"},
+			want:  []string{"set-cookie|medium|__Secure- prefix without Secure, so browsers reject the cookie"},
+		},
+		{
+			name: "__Host- prefix with a domain",
+			url:  "https://www.example.com/",
+			line: "__Host-id=1; Secure; HttpOnly; SameSite=Strict; Path=/; Domain=example.com",
+			flags: b.CookieFlags{Name: "__Host-id", Secure: true, HTTPOnly: true, SameSite: "strict", Path: "/",
+				Domain: "example.com"},
+			want: []string{
+				"set-cookie|medium|__Host- prefix requires Secure, Path=/ and no Domain, so browsers reject the cookie",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := cookieFlags("1", test.url, test.line)
+			if findings := findingStrings(got.Findings); !reflect.DeepEqual(findings, test.want) {
+				t.Errorf("got findings %q, want %q", findings, test.want)
+			}
+			test.flags.RequestID, test.flags.URL, test.flags.Findings = "1", test.url, got.Findings
+			if !reflect.DeepEqual(got, test.flags) {
+				t.Errorf("got flags %+v, want %+v", got, test.flags)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package postprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/chromedp/cdproto/network"
+	b "github.com/pmurley/mida/base"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// An entity list maps domains to the organizations which own them
+type EntityList map[string]string
+
+// Entity lists are shared by every task using them, so each is only read once
+var (
+	entityLists     = make(map[string]EntityList)
+	entityListsLock sync.Mutex
+)
+
+// disconnectEntities is the format of a Disconnect-style entities file
+type disconnectEntities struct {
+	Entities map[string]struct {
+		Properties []string `json:"properties"` // Domains of the organization's own sites
+		Resources  []string `json:"resources"`  // Domains from which the organization serves resources
+	} `json:"entities"`
+}
+
+// LoadEntityList reads the Disconnect-style entity list at the given path, or returns the copy already read
+func LoadEntityList(path string) (EntityList, error) {
+	entityListsLock.Lock()
+	defer entityListsLock.Unlock()
+
+	if el, ok := entityLists[path]; ok {
+		return el, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw disconnectEntities
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.New("failed to parse entity list: " + err.Error())
+	}
+
+	el := make(EntityList)
+	for org, entity := range raw.Entities {
+		for _, domain := range append(entity.Properties, entity.Resources...) {
+			el[strings.ToLower(domain)] = org
+		}
+	}
+	entityLists[path] = el
+
+	return el, nil
+}
+
+// Organization returns the organization owning the given host, or "" if it is not in the entity list. Entries
+// cover their subdomains, so the most specific entry for the host wins.
+func (el EntityList) Organization(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for host != "" {
+		if org, ok := el[host]; ok {
+			return org
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+
+	return ""
+}
+
+// ThirdParties labels each request made during a site visit as first- or third-party, comparing the site (eTLD+1,
+// according to the public suffix list built into MIDA) of the request's final URL with that of the page. Third
+// parties are attributed to the organizations owning them when an entity list is given (el may be nil).
+func ThirdParties(rr *b.RawResult, el EntityList) (*b.ThirdPartyAnalysis, error) {
+	page, err := url.Parse(pageURL(rr))
+	if err != nil {
+		return nil, errors.New("failed to parse page URL for third-party analysis: " + err.Error())
+	}
+
+	result := &b.ThirdPartyAnalysis{
+		Site:          b.Site(page.Hostname()),
+		Resources:     make(map[string]b.PartyLabel),
+		Sites:         make(map[string]int),
+		Organizations: make(map[string]int),
+	}
+	if el != nil {
+		result.Organization = el.Organization(page.Hostname())
+	}
+
+	for k, requests := range rr.DevTools.Network.RequestWillBeSent {
+		if len(requests) == 0 || requests[len(requests)-1].Request == nil {
+			continue
+		}
+
+		// Data URLs and the like are part of the page which contains them
+		u, err := url.Parse(requests[len(requests)-1].Request.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		label := b.PartyLabel{
+			URL:  u.String(),
+			Site: b.Site(u.Hostname()),
+		}
+		label.ThirdParty = label.Site != result.Site
+		if el != nil {
+			label.Organization = el.Organization(u.Hostname())
+			// Sites belonging to the same organization as the page are not third parties
+			if label.Organization != "" && label.Organization == result.Organization {
+				label.ThirdParty = false
+			}
+		}
+		result.Resources[k] = label
+
+		if label.ThirdParty {
+			result.Sites[label.Site] += 1
+			if label.Organization != "" {
+				result.Organizations[label.Organization] += 1
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// pageURL returns the URL of the page we ended up on for a site visit, following any redirects of the
+// navigation to the URL given in the task
+func pageURL(rr *b.RawResult) string {
+	if requests := pageRequests(rr); requests != nil {
+		if last := requests[len(requests)-1].Request; last != nil {
+			return last.URL
+		}
+	}
+
+	return rr.TaskSummary.TaskWrapper.SanitizedTask.URL
+}
+
+// pageRequests returns the requests (including redirects) made to navigate to the URL given in the task,
+// or nil if we can't find them
+func pageRequests(rr *b.RawResult) []network.EventRequestWillBeSent {
+	taskURL := rr.TaskSummary.TaskWrapper.SanitizedTask.URL
+	for _, requests := range rr.DevTools.Network.RequestWillBeSent {
+		if len(requests) != 0 && requests[0].Type == network.ResourceTypeDocument &&
+			requests[0].Request != nil && requests[0].Request.URL == taskURL {
+			return requests
+		}
+	}
+
+	return nil
+}
@@ -1,16 +1,21 @@
 package sanitize
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/google/uuid"
 	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/postprocess"
 	"github.com/sirupsen/logrus"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -20,11 +25,14 @@ func Task(rt *b.RawTask) (b.TaskWrapper, error) {
 	var tw b.TaskWrapper
 	var err error
 
+	// Keep a copy of the raw task, so tasks derived from this one (e.g., when crawling) can share its settings
+	tw.RawTask = *rt
+
 	// Each task gets its own UUID
 	tw.UUID = uuid.New()
 
 	// Create our temporary directory for this specific site visit
-	tw.TempDir = path.Join(ExpandPath(b.DefaultTempDir), tw.UUID.String()[:8])
+	tw.TempDir = path.Join(ExpandPath(b.RunTempDir), tw.UUID.String()[:8])
 	err = os.MkdirAll(tw.TempDir, 0755)
 	if err != nil {
 		return b.TaskWrapper{}, errors.New("failed to create temporary directory for task: " + err.Error())
@@ -49,15 +57,46 @@ func Task(rt *b.RawTask) (b.TaskWrapper, error) {
 	}
 	tw.Log.Infof("initiated log for: %s", tw.SanitizedTask.URL)
 
-	tw.SanitizedTask.BrowserBinaryPath, err = getBrowserBinaryPath(rt, tw.Log)
+	tw.SanitizedTask.Driver, tw.SanitizedTask.ReplayFile, err = getDriver(rt)
 	if err != nil {
 		return b.TaskWrapper{}, err
 	}
 
-	tw.SanitizedTask.BrowserFlags, err = getBrowserFlags(rt, tw.Log)
+	tw.SanitizedTask.RemoteEndpoint, err = getRemoteEndpoint(rt)
 	if err != nil {
 		return b.TaskWrapper{}, err
 	}
+	if tw.SanitizedTask.RemoteEndpoint != "" && tw.SanitizedTask.Driver != b.Chromium {
+		return b.TaskWrapper{}, errors.New("remote browsers are only supported by the chromium driver")
+	}
+
+	// We only need a browser binary and flags if we are launching the browser ourselves
+	if tw.SanitizedTask.Driver == b.Chromium && tw.SanitizedTask.RemoteEndpoint == "" {
+		tw.SanitizedTask.BrowserBinaryPath, err = getBrowserBinaryPath(rt, tw.Log)
+		if err != nil {
+			return b.TaskWrapper{}, err
+		}
+
+		tw.SanitizedTask.BrowserFlags, err = getBrowserFlags(rt, tw.Log)
+		if err != nil {
+			return b.TaskWrapper{}, err
+		}
+
+		tw.SanitizedTask.DisplayMode, err = getDisplayMode(rt)
+		if err != nil {
+			return b.TaskWrapper{}, err
+		}
+		tw.Log.Debugf("using display mode: %s", tw.SanitizedTask.DisplayMode)
+
+		// Headless modes are selected with a browser flag
+		if tw.SanitizedTask.DisplayMode == b.Headless {
+			tw.SanitizedTask.BrowserFlags = append(tw.SanitizedTask.BrowserFlags, "--headless=new")
+		} else if tw.SanitizedTask.DisplayMode == b.HeadlessLegacy {
+			tw.SanitizedTask.BrowserFlags = append(tw.SanitizedTask.BrowserFlags, "--headless")
+		}
+	} else if tw.SanitizedTask.RemoteEndpoint != "" {
+		tw.Log.Debugf("using remote browser at %s", tw.SanitizedTask.RemoteEndpoint)
+	}
 
 	tw.SanitizedTask.UserDataDirectory, err = getUserDataDirectory(rt, tw.TempDir)
 	if err != nil {
@@ -66,6 +105,27 @@ func Task(rt *b.RawTask) (b.TaskWrapper, error) {
 		tw.Log.Debugf("set user data directory: %s", tw.SanitizedTask.UserDataDirectory)
 	}
 
+	tw.SanitizedTask.ProfilePath, err = getProfilePath(rt)
+	if err != nil {
+		return b.TaskWrapper{}, err
+	} else if tw.SanitizedTask.ProfilePath != "" {
+		tw.Log.Debugf("using profile: %s", tw.SanitizedTask.ProfilePath)
+	}
+	if rt.Browser != nil && rt.Browser.Profile != nil {
+		if rt.Browser.Profile.Persist != nil && *rt.Browser.Profile.Persist {
+			if tw.SanitizedTask.ProfilePath == "" {
+				return b.TaskWrapper{}, errors.New("cannot persist profile without a profile name")
+			}
+			tw.SanitizedTask.PersistProfile = true
+		}
+		if rt.Browser.Profile.Archive != nil {
+			tw.SanitizedTask.ArchiveProfile = *rt.Browser.Profile.Archive
+		}
+	}
+	if tw.SanitizedTask.RemoteEndpoint != "" && (tw.SanitizedTask.ProfilePath != "" || tw.SanitizedTask.ArchiveProfile) {
+		return b.TaskWrapper{}, errors.New("cannot use a profile with a remote browser")
+	}
+
 	tw.SanitizedTask.CS, err = CompletionSettings(rt.Completion)
 	if err != nil {
 		return b.TaskWrapper{}, err
@@ -81,6 +141,40 @@ func Task(rt *b.RawTask) (b.TaskWrapper, error) {
 		return b.TaskWrapper{}, err
 	}
 
+	tw.SanitizedTask.CrawlS, err = CrawlSettings(rt.Crawl)
+	if err != nil {
+		return b.TaskWrapper{}, err
+	}
+
+	tw.SanitizedTask.RetryS, err = RetrySettings(rt.Retry)
+	if err != nil {
+		return b.TaskWrapper{}, err
+	}
+
+	tw.SanitizedTask.PPS, err = PostprocessSettings(rt.Postprocess)
+	if err != nil {
+		return b.TaskWrapper{}, err
+	}
+
+	if rt.ParentUUID != nil {
+		tw.SanitizedTask.ParentUUID = *rt.ParentUUID
+	}
+	tw.SanitizedTask.RootUUID = tw.UUID.String()
+	if rt.RootUUID != nil {
+		tw.SanitizedTask.RootUUID = *rt.RootUUID
+	}
+	if rt.Depth != nil {
+		if *rt.Depth < 0 {
+			return b.TaskWrapper{}, errors.New("task depth must be non-negative")
+		}
+		tw.SanitizedTask.Depth = *rt.Depth
+	}
+
+	tw.SanitizedTask.Session, err = SessionSteps(rt.Session, tw.SanitizedTask.CS)
+	if err != nil {
+		return b.TaskWrapper{}, err
+	}
+
 	return tw, nil
 }
 
@@ -237,6 +331,45 @@ func getBrowserFlags(rt *b.RawTask, log *logrus.Logger) ([]string, error) {
 	return result, nil
 }
 
+// getDisplayMode reads a raw task and returns the display mode for the browser. If the task does not set one,
+// we pick one which will work on this machine, so the same task can be run on both laptops and servers:
+//   1. Headful, if we are not on Linux, or there is already a display (DISPLAY is set)
+//   2. Xvfb, if it is installed
+//   3. Headless
+func getDisplayMode(rt *b.RawTask) (b.DisplayMode, error) {
+	if rt.Browser == nil || rt.Browser.DisplayMode == nil || *rt.Browser.DisplayMode == "" {
+		if runtime.GOOS != "linux" || os.Getenv("DISPLAY") != "" {
+			return b.Headful, nil
+		} else if _, err := exec.LookPath("Xvfb"); err == nil {
+			return b.Xvfb, nil
+		} else {
+			return b.Headless, nil
+		}
+	}
+
+	var mode b.DisplayMode
+	for _, m := range b.DisplayModes {
+		if m == *rt.Browser.DisplayMode {
+			mode = m
+		}
+	}
+
+	switch mode {
+	case "":
+		return "", errors.New("invalid display mode: " + string(*rt.Browser.DisplayMode))
+	case b.Headful:
+		if runtime.GOOS == "linux" && os.Getenv("DISPLAY") == "" {
+			return "", errors.New("headful display mode requires DISPLAY to be set")
+		}
+	case b.Xvfb:
+		if _, err := exec.LookPath("Xvfb"); err != nil {
+			return "", errors.New("xvfb display mode requires Xvfb to be installed")
+		}
+	}
+
+	return mode, nil
+}
+
 // getUserDataDirectory reads a raw task. If the task specifies a valid user data directory, it is
 // returned. Otherwise, getUserDataDirectory selects a default directory based on the task UUID
 func getUserDataDirectory(rt *b.RawTask, tempDir string) (string, error) {
@@ -248,6 +381,101 @@ func getUserDataDirectory(rt *b.RawTask, tempDir string) (string, error) {
 	}
 }
 
+// getDriver reads a raw task and returns the driver which will carry out the site visit, along with the
+// full path to the replay file for the stub driver (which must exist)
+func getDriver(rt *b.RawTask) (b.BrowserDriver, string, error) {
+	if rt.Browser == nil || rt.Browser.Driver == nil || *rt.Browser.Driver == "" {
+		return b.DefaultBrowserDriver, "", nil
+	}
+
+	var driver b.BrowserDriver
+	for _, d := range b.BrowserDrivers {
+		if d == *rt.Browser.Driver {
+			driver = d
+		}
+	}
+	if driver == "" {
+		return "", "", errors.New("invalid browser driver: " + string(*rt.Browser.Driver))
+	}
+
+	if driver != b.Stub {
+		return driver, "", nil
+	}
+
+	if rt.Browser.ReplayFile == nil || *rt.Browser.ReplayFile == "" {
+		return "", "", errors.New("the stub driver requires a replay file")
+	}
+	replayFile, err := filepath.Abs(ExpandPath(*rt.Browser.ReplayFile))
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(replayFile); err != nil {
+		return "", "", errors.New("replay file does not exist: " + replayFile)
+	}
+
+	return driver, replayFile, nil
+}
+
+// getRemoteEndpoint reads a raw task and returns the DevTools endpoint of the remote browser it should
+// connect to, or "" if MIDA should launch a browser itself. Both WebSocket and HTTP endpoints are allowed.
+func getRemoteEndpoint(rt *b.RawTask) (string, error) {
+	if rt.Browser == nil || rt.Browser.RemoteEndpoint == nil || *rt.Browser.RemoteEndpoint == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(*rt.Browser.RemoteEndpoint)
+	if err != nil {
+		return "", errors.New("invalid remote browser endpoint: " + err.Error())
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("remote browser endpoint must be a ws, wss, http or https URL")
+	}
+	if u.Host == "" {
+		return "", errors.New("remote browser endpoint is missing a host")
+	}
+
+	return u.String(), nil
+}
+
+// getProfilePath reads a raw task and returns the full path to the profile template it names, or "" if it
+// does not name one. Profiles are copied into a fresh user data directory for each visit, so they cannot be
+// combined with a fixed user data directory. A template which does not exist yet is only allowed if the
+// profile will be persisted, since the first visit will then create it.
+func getProfilePath(rt *b.RawTask) (string, error) {
+	if rt.Browser == nil || rt.Browser.Profile == nil || rt.Browser.Profile.Name == nil || *rt.Browser.Profile.Name == "" {
+		return "", nil
+	}
+	ps := rt.Browser.Profile
+
+	if strings.ContainsAny(*ps.Name, "/\\") || *ps.Name == "." || *ps.Name == ".." {
+		return "", errors.New("invalid profile name: " + *ps.Name)
+	}
+
+	if rt.Browser.UserDataDirectory != nil && *rt.Browser.UserDataDirectory != "" {
+		return "", errors.New("cannot use both a profile and a user data directory")
+	}
+
+	dir := b.DefaultProfileDirectory
+	if ps.Directory != nil && *ps.Directory != "" {
+		dir = *ps.Directory
+	}
+
+	profilePath, err := filepath.Abs(path.Join(ExpandPath(dir), *ps.Name))
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(profilePath)
+	if err == nil && !info.IsDir() {
+		return "", errors.New("profile is not a directory: " + profilePath)
+	} else if err != nil && (ps.Persist == nil || !*ps.Persist) {
+		return "", errors.New("profile does not exist: " + profilePath)
+	}
+
+	return profilePath, nil
+}
+
 // CompletionSettings takes a raw CompletionSettings struct and sanitizes it
 func CompletionSettings(cs *b.CompletionSettings) (b.CompletionSettings, error) {
 	result := b.AllocateNewCompletionSettings()
@@ -256,6 +484,10 @@ func CompletionSettings(cs *b.CompletionSettings) (b.CompletionSettings, error)
 		*result.CompletionCondition = b.DefaultCompletionCondition
 		*result.Timeout = b.DefaultTimeout
 		*result.TimeAfterLoad = b.DefaultTimeAfterLoad
+		*result.NetworkIdleConnections = b.DefaultNetworkIdleConnections
+		*result.NetworkIdleTime = b.DefaultNetworkIdleTime
+		*result.PollInterval = b.DefaultPollInterval
+		*result.GracePeriod = b.DefaultGracePeriod
 		return *result, nil
 	}
 
@@ -293,6 +525,293 @@ func CompletionSettings(cs *b.CompletionSettings) (b.CompletionSettings, error)
 		}
 	}
 
+	if cs.NetworkIdleConnections == nil {
+		*result.NetworkIdleConnections = b.DefaultNetworkIdleConnections
+	} else {
+		if *cs.NetworkIdleConnections < 0 {
+			return b.CompletionSettings{}, errors.New("network_idle_connections value must be non-negative")
+		} else {
+			*result.NetworkIdleConnections = *cs.NetworkIdleConnections
+		}
+	}
+
+	if cs.NetworkIdleTime == nil {
+		*result.NetworkIdleTime = b.DefaultNetworkIdleTime
+	} else {
+		if *cs.NetworkIdleTime <= 0 {
+			return b.CompletionSettings{}, errors.New("network_idle_time value must be positive")
+		} else {
+			*result.NetworkIdleTime = *cs.NetworkIdleTime
+		}
+	}
+
+	if cs.Selector != nil {
+		*result.Selector = strings.TrimSpace(*cs.Selector)
+	}
+	if *result.CompletionCondition == b.SelectorPresent && *result.Selector == "" {
+		return b.CompletionSettings{}, errors.New("a selector is required for the SelectorPresent completion condition")
+	}
+
+	if cs.Expression != nil {
+		*result.Expression = strings.TrimSpace(*cs.Expression)
+	}
+	if *result.CompletionCondition == b.JSPredicate && *result.Expression == "" {
+		return b.CompletionSettings{}, errors.New("an expression is required for the JSPredicate completion condition")
+	}
+
+	if cs.PollInterval == nil {
+		*result.PollInterval = b.DefaultPollInterval
+	} else {
+		if *cs.PollInterval <= 0 {
+			return b.CompletionSettings{}, errors.New("poll_interval value must be positive")
+		} else {
+			*result.PollInterval = *cs.PollInterval
+		}
+	}
+
+	if cs.GracePeriod == nil {
+		*result.GracePeriod = b.DefaultGracePeriod
+	} else {
+		if *cs.GracePeriod < 0 {
+			return b.CompletionSettings{}, errors.New("grace_period value must be non-negative")
+		} else {
+			*result.GracePeriod = *cs.GracePeriod
+		}
+	}
+
+	return *result, nil
+}
+
+// SessionSteps sanitizes the steps of a session task. Steps without their own completion settings
+// use the (already sanitized) completion settings of the task itself.
+func SessionSteps(steps *[]b.SessionStep, taskCS b.CompletionSettings) ([]b.SanitizedSessionStep, error) {
+	var result []b.SanitizedSessionStep
+	if steps == nil {
+		return result, nil
+	}
+
+	for i, step := range *steps {
+		if step.URL == nil || *step.URL == "" {
+			return nil, errors.New("missing or empty URL for session step " + strconv.Itoa(i+1))
+		}
+
+		u, err := ValidateURL(*step.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		cs := taskCS
+		if step.Completion != nil {
+			cs, err = CompletionSettings(step.Completion)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result = append(result, b.SanitizedSessionStep{
+			URL: u,
+			CS:  cs,
+		})
+	}
+
+	return result, nil
+}
+
+// RetrySettings takes a raw RetrySettings struct and sanitizes it, checking that all failure classes are valid
+func RetrySettings(rs *b.RetrySettings) (b.RetrySettings, error) {
+	result := b.AllocateNewRetrySettings()
+	*result.MaxAttempts = b.DefaultRetryMaxAttempts
+	*result.Backoff = b.DefaultRetryBackoff
+	*result.BackoffMultiplier = b.DefaultRetryBackoffMultiplier
+	*result.RetryableClasses = append(*result.RetryableClasses, b.DefaultRetryableClasses...)
+
+	if rs == nil {
+		return *result, nil
+	}
+
+	if rs.MaxAttempts != nil && *rs.MaxAttempts != 0 {
+		if *rs.MaxAttempts < 0 {
+			return b.RetrySettings{}, errors.New("max_attempts value must be positive")
+		}
+		*result.MaxAttempts = *rs.MaxAttempts
+	}
+
+	if rs.Backoff != nil {
+		if *rs.Backoff < 0 {
+			return b.RetrySettings{}, errors.New("backoff value must be non-negative")
+		}
+		*result.Backoff = *rs.Backoff
+	}
+
+	if rs.BackoffMultiplier != nil && *rs.BackoffMultiplier != 0 {
+		if *rs.BackoffMultiplier < 1 {
+			return b.RetrySettings{}, errors.New("backoff_multiplier value must be at least 1")
+		}
+		*result.BackoffMultiplier = *rs.BackoffMultiplier
+	}
+
+	if rs.RetryableClasses != nil && len(*rs.RetryableClasses) != 0 {
+		*result.RetryableClasses = make([]b.FailureClass, 0)
+		for _, fc := range *rs.RetryableClasses {
+			valid := false
+			for _, c := range b.FailureClasses {
+				if c == fc {
+					valid = true
+				}
+			}
+			if !valid {
+				return b.RetrySettings{}, errors.New("invalid failure class: " + string(fc))
+			}
+			*result.RetryableClasses = append(*result.RetryableClasses, fc)
+		}
+	}
+
+	return *result, nil
+}
+
+// PostprocessSettings takes a raw PostprocessSettings struct and sanitizes it, checking that any entity list,
+// filter lists and library database exist, that every postprocessor listed (or given options) is registered, and
+// that the postprocessors selected have the files they need
+func PostprocessSettings(pps *b.PostprocessSettings) (b.PostprocessSettings, error) {
+	result := b.AllocateNewPostprocessSettings()
+	*result.Postprocessors = append(*result.Postprocessors, b.DefaultPostprocessors...)
+	*result.Options = make(map[string]json.RawMessage)
+
+	if pps == nil {
+		return *result, nil
+	}
+
+	if pps.Postprocessors != nil && len(*pps.Postprocessors) != 0 {
+		*result.Postprocessors = make([]string, 0)
+		seen := make(map[string]bool)
+		for _, name := range *pps.Postprocessors {
+			if _, ok := postprocess.Lookup(name); !ok {
+				return b.PostprocessSettings{}, errors.New("unknown postprocessor: " + name)
+			}
+			if seen[name] {
+				return b.PostprocessSettings{}, errors.New("postprocessor listed more than once: " + name)
+			}
+			seen[name] = true
+			*result.Postprocessors = append(*result.Postprocessors, name)
+		}
+	}
+
+	if pps.Options != nil {
+		for name, options := range *pps.Options {
+			if _, ok := postprocess.Lookup(name); !ok {
+				return b.PostprocessSettings{}, errors.New("options given for unknown postprocessor: " + name)
+			}
+			(*result.Options)[name] = options
+		}
+	}
+
+	if pps.EntityList != nil && *pps.EntityList != "" {
+		entityList, err := filepath.Abs(ExpandPath(*pps.EntityList))
+		if err != nil {
+			return b.PostprocessSettings{}, err
+		}
+		if _, err := os.Stat(entityList); err != nil {
+			return b.PostprocessSettings{}, errors.New("could not find entity list: " + entityList)
+		}
+		*result.EntityList = entityList
+	}
+
+	if pps.FilterLists != nil {
+		filterLists, err := FilterLists(*pps.FilterLists)
+		if err != nil {
+			return b.PostprocessSettings{}, err
+		}
+		*result.FilterLists = filterLists
+	}
+
+	if pps.LibraryDB != nil && *pps.LibraryDB != "" {
+		libraryDB, err := filepath.Abs(ExpandPath(*pps.LibraryDB))
+		if err != nil {
+			return b.PostprocessSettings{}, err
+		}
+		if _, err := os.Stat(libraryDB); err != nil {
+			return b.PostprocessSettings{}, errors.New("could not find library database: " + libraryDB)
+		}
+		*result.LibraryDB = libraryDB
+	}
+
+	// Catch built-in postprocessors which could only fail for want of their files here, rather than after the visit
+	if postprocess.Selected(*result, postprocess.LibrariesPostprocessor) && *result.LibraryDB == "" {
+		return b.PostprocessSettings{}, errors.New("the libraries postprocessor requires a library database")
+	}
+	if postprocess.Selected(*result, postprocess.FilterListsPostprocessor) && len(*result.FilterLists) == 0 &&
+		len(postprocess.GlobalFilterLists()) == 0 {
+		return b.PostprocessSettings{}, errors.New("the filter_lists postprocessor requires filter lists, " +
+			"from the task or the global configuration")
+	}
+
+	return *result, nil
+}
+
+// FilterLists expands the paths of the given filter lists to absolute paths, checking that each one exists
+func FilterLists(paths []string) ([]string, error) {
+	result := make([]string, 0)
+	for _, fl := range paths {
+		filterList, err := filepath.Abs(ExpandPath(fl))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filterList); err != nil {
+			return nil, errors.New("could not find filter list: " + filterList)
+		}
+		result = append(result, filterList)
+	}
+
+	return result, nil
+}
+
+// CrawlSettings takes a raw CrawlSettings struct and sanitizes it, checking that any regexes compile
+func CrawlSettings(cs *b.CrawlSettings) (b.CrawlSettings, error) {
+	result := b.AllocateNewCrawlSettings()
+	*result.MaxDepth = b.DefaultCrawlMaxDepth
+	*result.SameSite = b.DefaultCrawlSameSite
+	*result.MaxLinks = b.DefaultCrawlMaxLinks
+
+	if cs == nil {
+		return *result, nil
+	}
+
+	if cs.MaxDepth != nil {
+		if *cs.MaxDepth < 0 {
+			return b.CrawlSettings{}, errors.New("max_depth value must be non-negative")
+		}
+		*result.MaxDepth = *cs.MaxDepth
+	}
+
+	if cs.SameSite != nil {
+		*result.SameSite = *cs.SameSite
+	}
+
+	if cs.MaxLinks != nil {
+		if *cs.MaxLinks <= 0 {
+			return b.CrawlSettings{}, errors.New("max_links value must be positive")
+		}
+		*result.MaxLinks = *cs.MaxLinks
+	}
+
+	if cs.IncludeRegex != nil {
+		for _, r := range *cs.IncludeRegex {
+			if _, err := regexp.Compile(r); err != nil {
+				return b.CrawlSettings{}, errors.New("invalid include regex: " + r)
+			}
+			*result.IncludeRegex = append(*result.IncludeRegex, r)
+		}
+	}
+
+	if cs.ExcludeRegex != nil {
+		for _, r := range *cs.ExcludeRegex {
+			if _, err := regexp.Compile(r); err != nil {
+				return b.CrawlSettings{}, errors.New("invalid exclude regex: " + r)
+			}
+			*result.ExcludeRegex = append(*result.ExcludeRegex, r)
+		}
+	}
+
 	return *result, nil
 }
 
@@ -316,9 +835,136 @@ func DataSettings(rawDataSettings *b.DataSettings, parentSettings *b.DataSetting
 		*result.AllResources = *rawDataSettings.AllResources
 	}
 
+	*result.HAR = b.DefaultHAR
+	if parentSettings != nil && parentSettings.HAR != nil {
+		*result.HAR = *parentSettings.HAR
+	}
+	if rawDataSettings != nil && rawDataSettings.HAR != nil {
+		*result.HAR = *rawDataSettings.HAR
+	}
+
+	*result.HARBodies = b.DefaultHARBodies
+	if parentSettings != nil && parentSettings.HARBodies != nil {
+		*result.HARBodies = *parentSettings.HARBodies
+	}
+	if rawDataSettings != nil && rawDataSettings.HARBodies != nil {
+		*result.HARBodies = *rawDataSettings.HARBodies
+	}
+
+	*result.ContentAddressed = b.DefaultContentAddressed
+	if parentSettings != nil && parentSettings.ContentAddressed != nil {
+		*result.ContentAddressed = *parentSettings.ContentAddressed
+	}
+	if rawDataSettings != nil && rawDataSettings.ContentAddressed != nil {
+		*result.ContentAddressed = *rawDataSettings.ContentAddressed
+	}
+
+	*result.Coverage = b.DefaultCoverage
+	if parentSettings != nil && parentSettings.Coverage != nil {
+		*result.Coverage = *parentSettings.Coverage
+	}
+	if rawDataSettings != nil && rawDataSettings.Coverage != nil {
+		*result.Coverage = *rawDataSettings.Coverage
+	}
+
+	*result.PerformanceMetrics = b.DefaultPerformanceMetrics
+	if parentSettings != nil && parentSettings.PerformanceMetrics != nil {
+		*result.PerformanceMetrics = *parentSettings.PerformanceMetrics
+	}
+	if rawDataSettings != nil && rawDataSettings.PerformanceMetrics != nil {
+		*result.PerformanceMetrics = *rawDataSettings.PerformanceMetrics
+	}
+
+	*result.Trace = b.DefaultTrace
+	if parentSettings != nil && parentSettings.Trace != nil {
+		*result.Trace = *parentSettings.Trace
+	}
+	if rawDataSettings != nil && rawDataSettings.Trace != nil {
+		*result.Trace = *rawDataSettings.Trace
+	}
+
+	*result.TraceCategories = append(*result.TraceCategories, b.DefaultTraceCategories...)
+	if parentSettings != nil && parentSettings.TraceCategories != nil && len(*parentSettings.TraceCategories) != 0 {
+		*result.TraceCategories = append([]string{}, *parentSettings.TraceCategories...)
+	}
+	if rawDataSettings != nil && rawDataSettings.TraceCategories != nil && len(*rawDataSettings.TraceCategories) != 0 {
+		*result.TraceCategories = append([]string{}, *rawDataSettings.TraceCategories...)
+	}
+
+	// Body filters which are lists replace (rather than add to) those of the parent settings
+	*result.BodyAllowTypes = stringListSetting(rawDataSettings, parentSettings, func(ds *b.DataSettings) *[]string {
+		return ds.BodyAllowTypes
+	})
+	*result.BodyDenyTypes = stringListSetting(rawDataSettings, parentSettings, func(ds *b.DataSettings) *[]string {
+		return ds.BodyDenyTypes
+	})
+	*result.BodyURLInclude = stringListSetting(rawDataSettings, parentSettings, func(ds *b.DataSettings) *[]string {
+		return ds.BodyURLInclude
+	})
+	*result.BodyURLExclude = stringListSetting(rawDataSettings, parentSettings, func(ds *b.DataSettings) *[]string {
+		return ds.BodyURLExclude
+	})
+	for _, r := range append(append([]string{}, *result.BodyURLInclude...), *result.BodyURLExclude...) {
+		if _, err := regexp.Compile(r); err != nil {
+			return b.DataSettings{}, errors.New("invalid body URL regex: " + r)
+		}
+	}
+
+	*result.BodyMaxSize = b.DefaultBodyMaxSize
+	if parentSettings != nil && parentSettings.BodyMaxSize != nil {
+		*result.BodyMaxSize = *parentSettings.BodyMaxSize
+	}
+	if rawDataSettings != nil && rawDataSettings.BodyMaxSize != nil {
+		*result.BodyMaxSize = *rawDataSettings.BodyMaxSize
+	}
+	if *result.BodyMaxSize < 0 {
+		return b.DataSettings{}, errors.New("invalid maximum body size")
+	}
+
+	*result.StreamBodyThreshold = b.DefaultStreamBodyThreshold
+	if parentSettings != nil && parentSettings.StreamBodyThreshold != nil {
+		*result.StreamBodyThreshold = *parentSettings.StreamBodyThreshold
+	}
+	if rawDataSettings != nil && rawDataSettings.StreamBodyThreshold != nil {
+		*result.StreamBodyThreshold = *rawDataSettings.StreamBodyThreshold
+	}
+	if *result.StreamBodyThreshold < 0 {
+		return b.DataSettings{}, errors.New("invalid body streaming threshold")
+	}
+
+	*result.BodyParty = b.DefaultBodyParty
+	if parentSettings != nil && parentSettings.BodyParty != nil && *parentSettings.BodyParty != "" {
+		*result.BodyParty = *parentSettings.BodyParty
+	}
+	if rawDataSettings != nil && rawDataSettings.BodyParty != nil && *rawDataSettings.BodyParty != "" {
+		*result.BodyParty = *rawDataSettings.BodyParty
+	}
+	validParty := false
+	for _, bp := range b.BodyParties {
+		if *result.BodyParty == bp {
+			validParty = true
+		}
+	}
+	if !validParty {
+		return b.DataSettings{}, errors.New("invalid body party: " + string(*result.BodyParty))
+	}
+
 	return *result, nil
 }
 
+// stringListSetting picks a list setting out of the raw data settings, falling back to the parent settings,
+// using get to select the setting. An empty list counts as unset.
+func stringListSetting(rawDataSettings *b.DataSettings, parentSettings *b.DataSettings,
+	get func(*b.DataSettings) *[]string) []string {
+	if rawDataSettings != nil && get(rawDataSettings) != nil && len(*get(rawDataSettings)) != 0 {
+		return append([]string{}, *get(rawDataSettings)...)
+	}
+	if parentSettings != nil && get(parentSettings) != nil && len(*get(parentSettings)) != 0 {
+		return append([]string{}, *get(parentSettings)...)
+	}
+	return []string{}
+}
+
 // OutputSettings takes in a set of output settings, along with some default data
 // settings, ensures validity, and returns a newly/fully allocated set of sanitized OutputSettings
 func OutputSettings(ops *b.OutputSettings, ds *b.DataSettings) (b.OutputSettings, error) {
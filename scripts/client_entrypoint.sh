@@ -1,21 +1,16 @@
 #!/bin/bash
 
+# MIDA starts (and cleans up) a virtual display for each crawler itself when there is
+# no DISPLAY, so all we need to do is run it and relay SIGTERM so it can exit gracefully.
+
 _kill_procs() {
   kill -TERM $mida
   wait $mida
-  kill -TERM $xvfb
 }
 
 # Setup a trap to catch SIGTERM and relay it to child processes
 trap _kill_procs SIGTERM
 
-XVFB_WHD=${XVFB_WHD:-1280x720x16}
-
-# Start Xvfb
-Xvfb :99 -ac -screen 0 $XVFB_WHD -nolisten tcp &
-xvfb=$!
-
-export DISPLAY=:99
-
-/usr/local/bin/mida client
-mida=$!
\ No newline at end of file
+/usr/local/bin/mida client &
+mida=$!
+wait $mida
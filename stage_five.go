@@ -3,6 +3,7 @@ package main
 import (
 	t "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/monitor"
 	"github.com/pmurley/mida/storage"
 	"sync"
 )
@@ -11,6 +12,8 @@ func stage5(finalResultChan <-chan *t.FinalResult, monitoringChan chan<- *t.Task
 	storageWG *sync.WaitGroup, pipelineWG *sync.WaitGroup) {
 
 	for fr := range finalResultChan {
+		monitor.QueueDepth.WithLabelValues(monitor.StageStorage).Dec()
+
 		err := storage.StoreAll(fr)
 		if err != nil {
 			log.Log.Error(err)
@@ -2,25 +2,59 @@ package main
 
 import (
 	b "github.com/pmurley/mida/base"
-	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/monitor"
 	"github.com/pmurley/mida/postprocess"
+	"sync"
 )
 
-// stage4 is the postprocessing stage of the MIDA pipeline. It takes a RawResult produced by stage3
-// (which conducts the site visit) and conducts postprocessing to turn it into a FinalResult.
-func stage4(rawResultChan <-chan *b.RawResult, finalResultChan chan<- *b.FinalResult) {
+// stage4 is a postprocessing worker. It takes a RawResult produced by stage3 (which conducts the
+// site visit) and conducts postprocessing to turn it into a FinalResult. Any child tasks generated
+// by crawling are sent back to stage2, unless their crawl has already visited the page (visited is shared
+// by all workers). There may be several workers, so the final result channel is closed by InitPipeline
+// once all of them have exited.
+func stage4(rawResultChan <-chan *b.RawResult, finalResultChan chan<- *b.FinalResult,
+	requeueTaskChan chan<- *b.RawTask, visited *postprocess.VisitedSet, postprocessWG *sync.WaitGroup,
+	pipelineWG *sync.WaitGroup) {
 	for rawResult := range rawResultChan {
-		fr, err := postprocess.DevTools(rawResult)
+		monitor.QueueDepth.WithLabelValues(monitor.StagePostprocess).Dec()
+
+		fr, err := postprocess.Run(rawResult)
 		if err != nil {
-			log.Log.Error(err)
-			continue
+			// The task must still be stored and leave the pipeline, with whatever results we have
+			tw := rawResult.TaskSummary.TaskWrapper
+			tw.Log.Error("postprocessing failed: " + err.Error())
+			if tw.FailureCode == "" {
+				tw.FailureCode = "postprocessing failed: " + err.Error()
+				tw.FailureClass = b.FailureOther
+			}
+			fr.Summary.Success = false
+		}
+
+		// The task a crawl starts from counts as a visit to its own page. Tasks generated by crawling were
+		// counted when they were queued.
+		st := rawResult.TaskSummary.TaskWrapper.SanitizedTask
+		if st.ParentUUID == "" {
+			u, err := postprocess.NormalizeURL(st.URL)
+			if err != nil {
+				u = st.URL
+			}
+			visited.Visit(st.RootUUID, u)
 		}
 
+		// Child tasks must be counted before their parent leaves the pipeline in stage5
+		for _, child := range fr.ChildTasks {
+			if !visited.Visit(*child.RootUUID, *child.URL) {
+				continue
+			}
+			fr.Summary.ChildURLs = append(fr.Summary.ChildURLs, *child.URL)
+			pipelineWG.Add(1)
+			requeueTaskChan <- child
+		}
+		visited.Done(st.RootUUID)
+
+		monitor.QueueDepth.WithLabelValues(monitor.StageStorage).Inc()
 		finalResultChan <- &fr
 	}
 
-	// All PostProcessed results have been sent so close the channel
-	close(finalResultChan)
-
-	return
+	postprocessWG.Done()
 }
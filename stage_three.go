@@ -1,21 +1,152 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	t "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/browser"
-	"sync"
+	"github.com/pmurley/mida/monitor"
+	"github.com/pmurley/mida/storage"
+	"github.com/spf13/viper"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"time"
 )
 
-func stage3(taskWrapperChan <-chan *t.TaskWrapper, rawResultChan chan<- *t.RawResult, crawlerWG *sync.WaitGroup) {
+// stage3 is a crawler worker. It visits the site for each sanitized task it receives, and sends the raw results
+// on to postprocessing. A task whose visit cannot be carried out at all still produces a (failed) raw result, so
+// every task leaves the pipeline and the crawler keeps serving tasks. stage3 returns once the task channel is
+// closed; if it panics instead, the task it was handling is sent on as failed before the panic continues on up
+// to the supervisor (see superviseCrawler).
+func stage3(crawlerIndex int, taskWrapperChan <-chan *t.TaskWrapper, rawResultChan chan<- *t.RawResult,
+	retryTaskChan chan<- *t.TaskWrapper) {
+
+	label := strconv.Itoa(crawlerIndex)
+
+	// Each crawler creates its own drivers as tasks need them, so drivers which keep a
+	// browser open between tasks (in pool mode) never share it with another crawler
+	drivers := make(map[t.BrowserDriver]browser.Driver)
+	driverOpts := browser.DriverOptions{
+		Pooled:       viper.GetBool("pool"),
+		RecycleAfter: viper.GetInt("pool-recycle"),
+	}
+
+	// The task currently being handled, which has not yet been sent on
+	var current *t.TaskWrapper
+
+	defer func() {
+		for _, driver := range drivers {
+			driver.Close()
+		}
+
+		if r := recover(); r != nil {
+			if current != nil {
+				monitor.QueueDepth.WithLabelValues(monitor.StagePostprocess).Inc()
+				rawResultChan <- browser.FailedResult(current, "crawler crashed: "+fmt.Sprint(r), t.FailureOther, time.Now())
+			}
+			panic(r)
+		}
+	}()
 
 	for tw := range taskWrapperChan {
-		rawResult, err := browser.VisitPageDevtoolsProtocol(tw)
+		current = tw
+		monitor.CrawlerState.WithLabelValues(label).Set(monitor.WorkerVisiting)
+		monitor.CrawlerLastActive.WithLabelValues(label).SetToCurrentTime()
+
+		start := time.Now()
+		rawResult, err := visit(drivers, driverOpts, tw)
 		if err != nil {
-			break
+			monitor.CrawlerVisitErrors.WithLabelValues(label).Inc()
+			rawResult = browser.FailedResult(tw, "site visit failed: "+err.Error(), t.FailureOther, start)
+		}
+
+		monitor.CrawlerState.WithLabelValues(label).Set(monitor.WorkerIdle)
+		monitor.CrawlerLastActive.WithLabelValues(label).SetToCurrentTime()
+
+		tw.Attempts = append(tw.Attempts, t.Attempt{
+			Number:       len(tw.Attempts) + 1,
+			Start:        start,
+			End:          time.Now(),
+			FailureCode:  tw.FailureCode,
+			FailureClass: tw.FailureClass,
+		})
+
+		delay, retry := retryDelay(tw)
+		if retry {
+			// Attempts must be independent, so a retry may not see anything left behind by this attempt
+			err = storage.CleanupAttempt(tw)
+			if err != nil {
+				tw.Log.Errorf("not retrying, since we could not clean up after the failed attempt: %s", err.Error())
+				retry = false
+			}
+		}
+		if retry {
+			// The task stays in the pipeline while we wait, and goes back to stage2 to be visited again
+			tw.Log.Warnf("attempt %d failed (%s), retrying in %s", len(tw.Attempts), tw.FailureClass, delay)
+			tw.FailureCode = ""
+			tw.FailureClass = ""
+			time.AfterFunc(delay, func() {
+				retryTaskChan <- tw
+			})
+			current = nil
+			continue
 		}
 
+		rawResult.TaskSummary.Attempts = tw.Attempts
+		current = nil
+		monitor.QueueDepth.WithLabelValues(monitor.StagePostprocess).Inc()
 		rawResultChan <- rawResult
 	}
+}
+
+// visit visits the site for a task using the crawler's driver of the right type, creating the driver if the
+// crawler does not have one yet. A panic during the visit is returned as an error. A driver which fails is
+// closed and dropped, so that the next task gets a fresh one.
+func visit(drivers map[t.BrowserDriver]browser.Driver, opts browser.DriverOptions,
+	tw *t.TaskWrapper) (rawResult *t.RawResult, err error) {
+
+	driver, ok := drivers[tw.SanitizedTask.Driver]
+	if !ok {
+		driver, err = browser.NewDriver(tw.SanitizedTask.Driver, opts)
+		if err != nil {
+			return nil, err
+		}
+		drivers[tw.SanitizedTask.Driver] = driver
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tw.Log.Errorf("panic during site visit: %v\n%s", r, debug.Stack())
+			rawResult, err = nil, errors.New("panic during site visit: "+fmt.Sprint(r))
+		}
+		if err != nil {
+			delete(drivers, tw.SanitizedTask.Driver)
+			driver.Close()
+		}
+	}()
+
+	return driver.Visit(tw)
+}
+
+// retryDelay decides whether a task whose latest attempt failed should be retried, according to its retry
+// settings, and if so, how long to wait before retrying it. The wait grows exponentially with each retry.
+func retryDelay(tw *t.TaskWrapper) (time.Duration, bool) {
+	rs := tw.SanitizedTask.RetryS
+	if tw.FailureCode == "" || len(tw.Attempts) >= *rs.MaxAttempts {
+		return 0, false
+	}
+
+	retryable := false
+	for _, fc := range *rs.RetryableClasses {
+		if fc == tw.FailureClass {
+			retryable = true
+		}
+	}
+	if !retryable {
+		return 0, false
+	}
 
-	crawlerWG.Done()
+	backoff := float64(*rs.Backoff) * math.Pow(*rs.BackoffMultiplier, float64(len(tw.Attempts)-1))
+	return time.Duration(backoff * float64(time.Second)), true
 }
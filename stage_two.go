@@ -3,27 +3,77 @@ package main
 import (
 	b "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/monitor"
 	"github.com/pmurley/mida/sanitize"
 	"sync"
 )
 
-// stage2 takes raw tasks from stage1 and produces sanitized tasks for
-func stage2(rawTaskChan <-chan *b.RawTask, sanitizedTaskChan chan<- *b.TaskWrapper, pipelineWG *sync.WaitGroup) {
-	for r := range rawTaskChan {
-		st, err := sanitize.Task(r)
-		if err != nil {
-			log.Log.Error(err)
-			continue
+// stage2 takes raw tasks from stage1 and produces sanitized tasks for stage3. It also accepts tasks generated
+// by later stages of the pipeline (e.g., child tasks from crawling) through requeueTaskChan. Those tasks must
+// already have been added to pipelineWG by the stage which generated them, before their parent task is done.
+// Failed tasks being retried come back from stage3 through retryTaskChan, already sanitized (and still in the pipeline).
+func stage2(rawTaskChan <-chan *b.RawTask, requeueTaskChan <-chan *b.RawTask, retryTaskChan <-chan *b.TaskWrapper,
+	sanitizedTaskChan chan<- *b.TaskWrapper, pipelineWG *sync.WaitGroup) {
+
+	// Requeued tasks can arrive at any time, so we keep them here rather than blocking the stages which
+	// generate them (which could otherwise deadlock with the crawlers)
+	pending := make([]*b.TaskWrapper, 0)
+	pipelineEmpty := make(chan bool)
+
+	for {
+		monitor.QueueDepth.WithLabelValues(monitor.StageCrawl).Set(float64(len(pending)))
+
+		// We only take a new task from stage1 once we have nothing pending, so that we never pull tasks
+		// from stage1 (and possibly a remote queue) faster than the crawlers can handle them
+		var in <-chan *b.RawTask
+		var out chan<- *b.TaskWrapper
+		var next *b.TaskWrapper
+		if len(pending) == 0 {
+			in = rawTaskChan
+		} else {
+			out = sanitizedTaskChan
+			next = pending[0]
 		}
-		pipelineWG.Add(1)
 
-		sanitizedTaskChan <- &st
-	}
+		select {
+		case r, ok := <-in:
+			if !ok {
+				// Stage1 has given us all of its tasks. Once the pipeline is clear (including any tasks
+				// requeued along the way), we close the sanitized task channel, which causes MIDA to shutdown
+				rawTaskChan = nil
+				go func() {
+					pipelineWG.Wait()
+					close(pipelineEmpty)
+				}()
+				continue
+			}
+
+			st, err := sanitize.Task(r)
+			if err != nil {
+				log.Log.Error(err)
+				continue
+			}
+			pipelineWG.Add(1)
+			pending = append(pending, &st)
 
-	// Wait until the pipeline is clear before we close the sanitized task channel,
-	// which will cause MIDA to shutdown
-	pipelineWG.Wait()
-	close(sanitizedTaskChan)
+		case r := <-requeueTaskChan:
+			st, err := sanitize.Task(r)
+			if err != nil {
+				log.Log.Error(err)
+				pipelineWG.Done()
+				continue
+			}
+			pending = append(pending, &st)
 
-	return
+		case tw := <-retryTaskChan:
+			pending = append(pending, tw)
+
+		case out <- next:
+			pending = pending[1:]
+
+		case <-pipelineEmpty:
+			close(sanitizedTaskChan)
+			return
+		}
+	}
 }
@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	b "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/log"
 	"io/ioutil"
@@ -27,6 +28,16 @@ func Local(finalResult *b.FinalResult, dataSettings *b.DataSettings, outPath str
 		return errors.New("task local output directory exists")
 	}
 
+	data, err := json.Marshal(finalResult.Summary)
+	if err != nil {
+		return errors.New("failed to marshal task summary for local storage: " + err.Error())
+	}
+
+	err = ioutil.WriteFile(path.Join(outPath, b.DefaultCrawlMetadataFile), data, 0644)
+	if err != nil {
+		return errors.New("failed to write task summary file: " + err.Error())
+	}
+
 	if *dataSettings.ResourceMetadata {
 		data, err := json.Marshal(finalResult.DTResourceMetadata)
 		if err != nil {
@@ -39,13 +50,110 @@ func Local(finalResult *b.FinalResult, dataSettings *b.DataSettings, outPath str
 		}
 	}
 
-	if *dataSettings.AllResources {
+	if *dataSettings.HAR && finalResult.HAR != nil {
+		data, err := json.Marshal(finalResult.HAR)
+		if err != nil {
+			return errors.New("failed to marshal HAR for local storage: " + err.Error())
+		}
+
+		err = ioutil.WriteFile(path.Join(outPath, b.DefaultHARFile), data, 0644)
+		if err != nil {
+			return errors.New("failed to write HAR file: " + err.Error())
+		}
+	}
+
+	if *dataSettings.Coverage && finalResult.Coverage != nil {
+		data, err := json.Marshal(finalResult.Coverage)
+		if err != nil {
+			return errors.New("failed to marshal coverage for local storage: " + err.Error())
+		}
+
+		err = ioutil.WriteFile(path.Join(outPath, b.DefaultCoverageFile), data, 0644)
+		if err != nil {
+			return errors.New("failed to write coverage file: " + err.Error())
+		}
+	}
+
+	if *dataSettings.PerformanceMetrics && finalResult.PerformanceMetrics != nil {
+		data, err := json.Marshal(finalResult.PerformanceMetrics)
+		if err != nil {
+			return errors.New("failed to marshal performance metrics for local storage: " + err.Error())
+		}
+
+		err = ioutil.WriteFile(path.Join(outPath, b.DefaultPerformanceFile), data, 0644)
+		if err != nil {
+			return errors.New("failed to write performance metrics file: " + err.Error())
+		}
+	}
+
+	if *dataSettings.Trace {
+		// Tracing can fail without failing the site visit, so a missing trace is not a storage error
+		err = os.Rename(path.Join(tw.TempDir, b.DefaultTraceFile), path.Join(outPath, b.DefaultTraceFile))
+		if err != nil {
+			log.Log.Error("failed to copy trace file into results directory")
+		}
+	}
+
+	if *dataSettings.AllResources && *dataSettings.ContentAddressed {
+		// The bodies themselves go into the shared resource store, so we only record which ones the task loaded
+		data, err := json.Marshal(finalResult.BodyHashes)
+		if err != nil {
+			return errors.New("failed to marshal resource hashes for local storage: " + err.Error())
+		}
+
+		err = ioutil.WriteFile(path.Join(outPath, b.DefaultResourceHashesFile), data, 0644)
+		if err != nil {
+			return errors.New("failed to write resource hashes file: " + err.Error())
+		}
+	} else if *dataSettings.AllResources {
 		err = os.Rename(path.Join(tw.TempDir, b.DefaultResourceSubdir), path.Join(outPath, b.DefaultResourceSubdir))
 		if err != nil {
 			return errors.New("failed to copy resources directory into results directory")
 		}
 	}
 
+	// Each step of a session task gets its own subdirectory, laid out just like the results of a single visit
+	for _, stepResult := range finalResult.Steps {
+		stepPath := path.Join(outPath, fmt.Sprintf(b.DefaultSessionStepSubdir, stepResult.Summary.TaskWrapper.Step))
+		err = Local(stepResult, dataSettings, stepPath)
+		if err != nil {
+			return errors.New("failed to store session step results: " + err.Error())
+		}
+	}
+
+	// Sections and files from postprocessors go alongside the rest of the results, but may not replace them.
+	// One bad section does not stop the rest of the results (including the task log) from being stored.
+	for name, section := range finalResult.Sections {
+		data, err := json.Marshal(section)
+		if err != nil {
+			tw.Log.Errorf("failed to marshal section %s for local storage: %s", name, err.Error())
+			continue
+		}
+
+		err = writeNewFile(outPath, name+".json", data)
+		if err != nil {
+			tw.Log.Error(err.Error())
+		}
+	}
+	for name, data := range finalResult.Files {
+		err = writeNewFile(outPath, name, data)
+		if err != nil {
+			tw.Log.Error(err.Error())
+		}
+	}
+
+	// Session steps share the log of their task, which is stored once, at the top level
+	if tw.Step != 0 {
+		return nil
+	}
+
+	if tw.SanitizedTask.ArchiveProfile {
+		err = os.Rename(path.Join(tw.TempDir, b.DefaultProfileArchiveFile), path.Join(outPath, b.DefaultProfileArchiveFile))
+		if err != nil {
+			log.Log.Error("failed to copy profile archive into results directory")
+		}
+	}
+
 	// Store our log
 	tw.LogFile.Close()
 	err = os.Rename(tw.LogFile.Name(), path.Join(outPath, b.DefaultTaskLogFile))
@@ -55,3 +163,24 @@ func Local(finalResult *b.FinalResult, dataSettings *b.DataSettings, outPath str
 
 	return nil
 }
+
+// writeNewFile writes a file added by a postprocessor into the results directory, refusing to write outside
+// of it or to replace an existing file
+func writeNewFile(outPath string, name string, data []byte) error {
+	if name == "" || name != path.Base(name) || name == "." || name == ".." {
+		return errors.New("invalid postprocessor output file name: " + name)
+	}
+
+	p := path.Join(outPath, name)
+	_, err := os.Stat(p)
+	if err == nil || name == b.DefaultTaskLogFile || name == b.DefaultProfileArchiveFile {
+		return errors.New("postprocessor output would replace existing results file: " + name)
+	}
+
+	err = ioutil.WriteFile(p, data, 0644)
+	if err != nil {
+		return errors.New("failed to write postprocessor output file " + name + ": " + err.Error())
+	}
+
+	return nil
+}
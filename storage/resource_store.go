@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	b "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ResourceIndex counts the tasks referencing each body in a content-addressed resource store. Bodies are named
+// by their SHA-256 hashes, so storage backends can skip storing (or uploading) a body which is in the store
+// already.
+type ResourceIndex struct {
+	Refs map[string]int `json:"refs"` // Number of tasks referencing each body, keyed by hash
+}
+
+// Locks for the resource stores we have used so far, keyed by the location of the store. These keep our own
+// storers from contending for the store's lock file, which keeps out other processes (see lockStore).
+var storeLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// storeFS is a file system which can hold a content-addressed resource store: the local file system, or a
+// remote one reached over SFTP
+type storeFS interface {
+	ReadFile(p string) ([]byte, error)
+	WriteFile(p string, data []byte) error
+	MkdirAll(p string) error
+	CopyIn(localPath string, p string) error // Copies a local file into the store's file system
+	CreateNew(p string) error                // Creates an empty file, failing if it already exists
+	Remove(p string) error
+	Stat(p string) (os.FileInfo, error)
+}
+
+// storeResources adds the resource bodies saved for a task (including any session steps) to the content-addressed
+// store at storePath, skipping bodies which the store has already, and then writes the store's updated index.
+// Several processes (e.g., instances of MIDA on different machines storing over SFTP) may share a store, so
+// the index is read afresh and updated while holding the store's lock.
+func storeResources(fr *b.FinalResult, fs storeFS, key string, storePath string) error {
+	storeLocks.Lock()
+	l, ok := storeLocks.m[key]
+	if !ok {
+		l = new(sync.Mutex)
+		storeLocks.m[key] = l
+	}
+	storeLocks.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+
+	err := fs.MkdirAll(storePath)
+	if err != nil {
+		return errors.New("failed to create resource store: " + err.Error())
+	}
+
+	// Each body the task references, with the path to a copy of it in a temporary directory
+	bodies := make(map[string]string)
+	collectBodies(fr, bodies)
+
+	// Bodies are copied in before taking the store's lock, so a long upload does not hold it. Bodies are named by
+	// their hashes, so two processes storing the same body at once both store the same contents.
+	for hash, localPath := range bodies {
+		bodyPath := ResourceStorePath(storePath, hash)
+		if _, err = fs.Stat(bodyPath); err == nil {
+			continue
+		}
+		err = fs.MkdirAll(path.Join(storePath, hash[:2]))
+		if err != nil {
+			return errors.New("failed to create resource store directory: " + err.Error())
+		}
+		err = fs.CopyIn(localPath, bodyPath)
+		if err != nil {
+			return errors.New("failed to add resource body to store: " + err.Error())
+		}
+	}
+
+	// References are only counted once every new body is safely stored, so a failed attempt can simply be repeated
+	err = lockStore(fs, storePath)
+	if err != nil {
+		return err
+	}
+	defer unlockStore(fs, storePath)
+
+	index, err := readResourceIndex(fs, storePath)
+	if err != nil {
+		return err
+	}
+	for hash := range bodies {
+		index.Refs[hash] += 1
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.New("failed to marshal resource store index: " + err.Error())
+	}
+	err = fs.WriteFile(path.Join(storePath, b.DefaultResourceStoreIndex), data)
+	if err != nil {
+		return errors.New("failed to write resource store index: " + err.Error())
+	}
+
+	return nil
+}
+
+// ResourceStorePath gives the path of the body with the given hash within the store at storePath. Bodies are
+// spread over subdirectories named by the first two characters of their hashes, to keep directories small.
+func ResourceStorePath(storePath string, hash string) string {
+	return path.Join(storePath, hash[:2], hash)
+}
+
+// lockStore takes the lock on the store at storePath, waiting for any other process holding it. The lock is a
+// file created exclusively, which works for remote stores as well as local ones. A process which dies while
+// holding the lock leaves the file behind, so a lock older than DefaultResourceStoreLockTimeout is broken.
+func lockStore(fs storeFS, storePath string) error {
+	lockPath := path.Join(storePath, b.DefaultResourceStoreLock)
+	giveUp := time.Now().Add(2 * b.DefaultResourceStoreLockTimeout * time.Second)
+	for {
+		err := fs.CreateNew(lockPath)
+		if err == nil {
+			return nil
+		}
+
+		info, statErr := fs.Stat(lockPath)
+		if statErr == nil && time.Since(info.ModTime()) > b.DefaultResourceStoreLockTimeout*time.Second {
+			log.Log.Warnf("breaking stale resource store lock: %s", lockPath)
+			_ = fs.Remove(lockPath)
+			continue
+		} else if statErr != nil && !os.IsNotExist(statErr) {
+			return errors.New("failed to lock resource store: " + err.Error())
+		}
+
+		if time.Now().After(giveUp) {
+			return errors.New("timed out waiting for resource store lock: " + lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unlockStore releases the lock taken by lockStore
+func unlockStore(fs storeFS, storePath string) {
+	err := fs.Remove(path.Join(storePath, b.DefaultResourceStoreLock))
+	if err != nil {
+		log.Log.Errorf("failed to release resource store lock: %s", err.Error())
+	}
+}
+
+// tempName gives a name for a temporary copy of the file at p, unique among all processes sharing a store, so
+// that the copy can be renamed into place once complete
+func tempName(p string) string {
+	return p + "." + uuid.New().String()[:8] + ".tmp"
+}
+
+// readResourceIndex reads the index of the store at storePath, which must be locked
+func readResourceIndex(fs storeFS, storePath string) (*ResourceIndex, error) {
+	index := &ResourceIndex{Refs: make(map[string]int)}
+	data, err := fs.ReadFile(path.Join(storePath, b.DefaultResourceStoreIndex))
+	if err == nil {
+		err = json.Unmarshal(data, index)
+		if err != nil {
+			return nil, errors.New("failed to parse resource store index: " + err.Error())
+		}
+		if index.Refs == nil {
+			index.Refs = make(map[string]int)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.New("failed to read resource store index: " + err.Error())
+	}
+
+	return index, nil
+}
+
+// collectBodies adds the bodies saved for a final result and its session steps to bodies, mapping hash to file
+func collectBodies(fr *b.FinalResult, bodies map[string]string) {
+	for requestID, hash := range fr.BodyHashes {
+		bodies[hash] = path.Join(fr.Summary.TaskWrapper.TempDir, b.DefaultResourceSubdir, requestID)
+	}
+	for _, stepResult := range fr.Steps {
+		collectBodies(stepResult, bodies)
+	}
+}
+
+// localFS is the local file system, holding a resource store within the local results directory
+type localFS struct{}
+
+func (localFS) ReadFile(p string) ([]byte, error) {
+	return ioutil.ReadFile(p)
+}
+
+func (localFS) WriteFile(p string, data []byte) error {
+	err := ioutil.WriteFile(p+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (localFS) MkdirAll(p string) error {
+	return os.MkdirAll(p, 0755)
+}
+
+// CopyIn hard links the file into the store if it is on the same file system, and otherwise copies it. Either
+// way, the body never has to be held in memory.
+func (localFS) CopyIn(localPath string, p string) error {
+	tmp := tempName(p)
+	if os.Link(localPath, tmp) != nil {
+		src, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		closeErr := dst.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, p)
+}
+
+func (localFS) CreateNew(p string) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (localFS) Remove(p string) error {
+	return os.Remove(p)
+}
+
+func (localFS) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(p)
+}
+
+// sftpFS is a remote file system reached over SFTP, holding a resource store within the remote results directory
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (fs sftpFS) ReadFile(p string) ([]byte, error) {
+	f, err := fs.client.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func (fs sftpFS) WriteFile(p string, data []byte) error {
+	f, err := fs.client.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return fs.client.PosixRename(p+".tmp", p)
+}
+
+func (fs sftpFS) MkdirAll(p string) error {
+	return fs.client.MkdirAll(p)
+}
+
+func (fs sftpFS) CopyIn(localPath string, p string) error {
+	srcFile, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	tmp := tempName(p)
+	dstFile, err := fs.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFile, srcFile)
+	closeErr := dstFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.client.Remove(tmp)
+		return err
+	}
+
+	return fs.client.PosixRename(tmp, p)
+}
+
+func (fs sftpFS) CreateNew(p string) error {
+	f, err := fs.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (fs sftpFS) Remove(p string) error {
+	return fs.client.Remove(p)
+}
+
+func (fs sftpFS) Stat(p string) (os.FileInfo, error) {
+	return fs.client.Stat(p)
+}
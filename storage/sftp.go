@@ -117,6 +117,17 @@ func StoreResultsSSH(r *b.FinalResult, activeConn *SftpConn, remotePath string)
 		log.Log.Error(err)
 	}
 
+	// Bodies go into the remote resource store, and only those which are new to it are uploaded
+	ds := tw.SanitizedTask.OPS.SftpOut.DS
+	if *ds.AllResources && *ds.ContentAddressed {
+		storePath := path.Join(remotePath, b.DefaultResourceStoreSubdir)
+		key := activeConn.Client.User() + "@" + activeConn.Client.RemoteAddr().String() + ":" + storePath
+		err = storeResources(r, sftpFS{client: sftpClient}, key, storePath)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -135,7 +146,7 @@ func copyDirRemote(sftpConn *sftp.Client, localDirname string, remoteDirname str
 		localizedPath := strings.TrimPrefix(p, localDirname+"/")
 
 		if info.IsDir() {
-			err = sftpConn.MkdirAll(path.Join(remoteDirname, info.Name()))
+			err = sftpConn.MkdirAll(path.Join(remoteDirname, localizedPath))
 			if err != nil {
 				return err
 			}
@@ -5,6 +5,7 @@ import (
 	b "github.com/pmurley/mida/base"
 	"github.com/pmurley/mida/log"
 	"golang.org/x/crypto/ssh"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
@@ -48,6 +49,14 @@ func StoreAll(finalResult *b.FinalResult) error {
 		if err != nil {
 			return err
 		}
+
+		if *st.OPS.LocalOut.DS.AllResources && *st.OPS.LocalOut.DS.ContentAddressed {
+			storePath := path.Join(*st.OPS.LocalOut.Path, b.DefaultResourceStoreSubdir)
+			err = storeResources(finalResult, localFS{}, "local:"+storePath, storePath)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	if *st.OPS.SftpOut.Enable {
@@ -109,6 +118,36 @@ func CleanupTask(fr *b.FinalResult) error {
 	return nil
 }
 
+// CleanupAttempt deletes everything a failed attempt at a site visit left behind, so that a retry starts from
+// scratch: partial results in the task's temporary directory (except for the task log, which covers every
+// attempt), and the user data directory with its cookies and cache. A user data directory named in the task
+// itself is left alone, since the task asked for it to be reused.
+func CleanupAttempt(tw *b.TaskWrapper) error {
+	entries, err := ioutil.ReadDir(tw.TempDir)
+	if err != nil {
+		return errors.New("failed to read temporary directory: " + err.Error())
+	}
+	for _, e := range entries {
+		if e.Name() == b.DefaultTaskLogFile {
+			continue
+		}
+		err = os.RemoveAll(path.Join(tw.TempDir, e.Name()))
+		if err != nil {
+			return errors.New("failed to remove results of failed attempt: " + err.Error())
+		}
+	}
+
+	rt := tw.RawTask
+	if rt.Browser == nil || rt.Browser.UserDataDirectory == nil || *rt.Browser.UserDataDirectory == "" {
+		err = os.RemoveAll(tw.SanitizedTask.UserDataDirectory)
+		if err != nil {
+			return errors.New("failed to remove user data directory of failed attempt: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
 // DirNameFromURL takes a URL and sanitizes/escapes it so it can safely be used as a filename
 func DirNameFromURL(s string) (string, error) {
 	u, err := url.ParseRequestURI(s)
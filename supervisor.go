@@ -0,0 +1,50 @@
+package main
+
+import (
+	t "github.com/pmurley/mida/base"
+	"github.com/pmurley/mida/log"
+	"github.com/pmurley/mida/monitor"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// superviseCrawler runs a crawler worker (stage3), restarting it whenever it crashes, until it exits normally
+// because there are no more tasks. Worker health is reported through the crawler metrics in the monitor package.
+func superviseCrawler(crawlerIndex int, taskWrapperChan <-chan *t.TaskWrapper, rawResultChan chan<- *t.RawResult,
+	retryTaskChan chan<- *t.TaskWrapper, crawlerWG *sync.WaitGroup) {
+
+	label := strconv.Itoa(crawlerIndex)
+	monitor.CrawlerState.WithLabelValues(label).Set(monitor.WorkerIdle)
+
+	for restarts := 1; ; restarts++ {
+		if runCrawler(crawlerIndex, taskWrapperChan, rawResultChan, retryTaskChan) {
+			break
+		}
+
+		monitor.CrawlerRestarts.WithLabelValues(label).Inc()
+		monitor.CrawlerState.WithLabelValues(label).Set(monitor.WorkerIdle)
+		log.Log.Errorf("restarting crawler %d (restart #%d)", crawlerIndex, restarts)
+
+		// Avoid spinning if the crawler crashes straight away every time
+		time.Sleep(time.Second)
+	}
+
+	monitor.CrawlerState.WithLabelValues(label).Set(monitor.WorkerStopped)
+	crawlerWG.Done()
+}
+
+// runCrawler runs a crawler worker, returning true if it exited normally and false if it crashed
+func runCrawler(crawlerIndex int, taskWrapperChan <-chan *t.TaskWrapper, rawResultChan chan<- *t.RawResult,
+	retryTaskChan chan<- *t.TaskWrapper) (finished bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Log.Errorf("crawler %d crashed: %v\n%s", crawlerIndex, r, debug.Stack())
+		}
+	}()
+
+	stage3(crawlerIndex, taskWrapperChan, rawResultChan, retryTaskChan)
+	return true
+}